@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+const (
+	// btrfsOpts are the options btrfs filesystems are mounted with, both
+	// while installing & in the installed system.
+	btrfsOpts = "compress=zstd"
+	// btrfsTopDir is where the top level of a new btrfs root filesystem is
+	// mounted while its subvolumes are created.
+	btrfsTopDir = "/tmp/install_mounts/btrfs"
+)
+
+// btrfsTools are the commands run to create a btrfs root filesystem, its
+// subvolumes & the snapshot of the fresh install.
+var btrfsTools = []string{"mkfs.btrfs", "btrfs"}
+
+// Subvolume is a btrfs subvolume of the root filesystem, mounted in the
+// installed system in place of the filesystem's top level.
+type Subvolume struct {
+	Name       string `json:"name"`
+	MountPoint string `json:"mount_point"`
+}
+
+// rootSubvolumes are the subvolumes of a btrfs root filesystem. @ is
+// mounted at /, & is what snapshots of the system are taken of; @home
+// & @var_log keep user data & logs out of them, & @snapshots holds them.
+var rootSubvolumes = []Subvolume{
+	{Name: "@", MountPoint: "/"},
+	{Name: "@home", MountPoint: "/home"},
+	{Name: "@var_log", MountPoint: "/var/log"},
+	{Name: "@snapshots", MountPoint: "/.snapshots"},
+}
+
+// addSubvolumes plans the subvolumes of the root filesystem, if it is
+// btrfs. Subvolumes are left out where another partition or logical
+// volume is mounted, such as a separate /home.
+func (p *PartitionPlan) addSubvolumes() {
+	fs := ""
+	if lv := p.VolumeAt("/"); lv != nil {
+		fs = lv.Filesystem
+	} else if part := p.MountedAt("/"); part != nil && !part.Existing {
+		fs = part.Filesystem
+	}
+	if fs != "btrfs" {
+		return
+	}
+	for _, sv := range rootSubvolumes {
+		if sv.MountPoint == "/" || (p.MountedAt(sv.MountPoint) == nil && p.VolumeAt(sv.MountPoint) == nil) {
+			p.Subvolumes = append(p.Subvolumes, sv)
+		}
+	}
+}
+
+// rootDevice returns the device holding the root filesystem while
+// installing: its logical volume, or its partition's dm-crypt mapping if
+// encrypted.
+func rootDevice(installState *State, plan *PartitionPlan) string {
+	if lv := plan.VolumeAt("/"); lv != nil {
+		return lv.device(plan.VolumeGroup)
+	}
+	return fsDevice(installState, plan.MountedAt("/"))
+}
+
+// subvolumeOps returns the commands which create the subvolumes of the
+// btrfs root filesystem on dev, by mounting its top level.
+func subvolumeOps(plan *PartitionPlan, dev string) []diskOp {
+	ops := []diskOp{{
+		Desc: "Creating mount point " + btrfsTopDir,
+		Argv: []string{"mkdir", "-p", btrfsTopDir},
+	}, {
+		Desc:   "Mounting btrfs root filesystem on " + dev,
+		Argv:   []string{"mount", "-t", "btrfs", "-o", "subvolid=5", dev, btrfsTopDir},
+		Mounts: btrfsTopDir,
+	}}
+	for _, sv := range plan.Subvolumes {
+		ops = append(ops, diskOp{
+			Desc: fmt.Sprintf("Creating subvolume %s for %s", sv.Name, sv.MountPoint),
+			Argv: []string{"btrfs", "subvolume", "create", path.Join(btrfsTopDir, sv.Name)},
+		})
+	}
+	return append(ops, diskOp{
+		Desc:     "Unmounting btrfs root filesystem",
+		Argv:     []string{"umount", btrfsTopDir},
+		Settle:   time.Second,
+		Unmounts: btrfsTopDir,
+	})
+}
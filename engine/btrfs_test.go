@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewPartitionPlanBtrfs(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	tcs := []struct {
+		name string
+		opts PartitionOptions
+		want []string
+	}{
+		{name: "ext4", opts: PartitionOptions{}},
+		{name: "default", opts: PartitionOptions{RootFS: "btrfs"}, want: []string{"@ /", "@home /home", "@var_log /var/log", "@snapshots /.snapshots"}},
+		{name: "lvm", opts: PartitionOptions{RootFS: "btrfs", LVM: &LVMOptions{RootMB: 20 * 1024}}, want: []string{"@ /", "@var_log /var/log", "@snapshots /.snapshots"}},
+		{
+			name: "home partition",
+			opts: PartitionOptions{Layout: []CustomPartition{
+				{SizeMB: 512, Filesystem: "ext4", MountPoint: "/boot"},
+				{SizeMB: 8192, Filesystem: "btrfs", MountPoint: "/", Encrypted: true},
+				{Filesystem: "xfs", MountPoint: "/home"},
+			}},
+			want: []string{"@ /", "@var_log /var/log", "@snapshots /.snapshots"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := NewPartitionPlan(disk, tc.opts)
+			if err := plan.Validate(); err != nil {
+				t.Fatalf("Validate() failed: %v", err)
+			}
+			var got []string
+			for _, sv := range plan.Subvolumes {
+				got = append(got, sv.Name+" "+sv.MountPoint)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("subvolumes = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if err := NewPartitionPlan(disk, PartitionOptions{RootFS: "xfs"}).Validate(); err == nil {
+		t.Error("Validate() with an xfs root succeeded, want an error")
+	}
+}
+
+func TestPartitionStepBtrfs(t *testing.T) {
+	fake := useFakeRunner(t)
+	state := State{Pw: "hunter2", RootFS: "btrfs", InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+		"partprobe /dev/sdz",
+		"mkfs.ext4 -qF /dev/sdz1",
+		"cryptsetup luksFormat --type luks2 /dev/sdz2 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+		"cryptsetup luksOpen --key-file - /dev/sdz2 cryptroot",
+		"mkfs.btrfs -f /dev/mapper/cryptroot",
+		"mkfs.ext4 -qF /dev/sdz3",
+		"mkdir -p /tmp/install_mounts/btrfs",
+		"mount -t btrfs -o subvolid=5 /dev/mapper/cryptroot /tmp/install_mounts/btrfs",
+		"btrfs subvolume create /tmp/install_mounts/btrfs/@",
+		"btrfs subvolume create /tmp/install_mounts/btrfs/@home",
+		"btrfs subvolume create /tmp/install_mounts/btrfs/@var_log",
+		"btrfs subvolume create /tmp/install_mounts/btrfs/@snapshots",
+		"umount /tmp/install_mounts/btrfs",
+	})
+	if state.ledger().holds(resource{Kind: resMount, Name: btrfsTopDir}) {
+		t.Error("the top level mount remains in the ledger once unmounted")
+	}
+	fake.Responses = map[string]FakeResponse{"umount " + btrfsTopDir: {Stderr: "umount: " + btrfsTopDir + ": target is busy.", Err: errFake}}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err == nil {
+		t.Fatal("Run() with a busy top level succeeded, want an error")
+	}
+	if !state.ledger().holds(resource{Kind: resMount, Name: btrfsTopDir}) {
+		t.Error("the top level mount was not left in the ledger to be unwound")
+	}
+
+	// The subvolumes are mounted in place of the root filesystem, & so
+	// unmounted in reverse.
+	var cleanup []string
+	for _, a := range (&CleanupStep{}).Plan(&state) {
+		cleanup = append(cleanup, strings.Join(a.Argv, " "))
+	}
+	if got, want := strings.Join(cleanup, "\n"), strings.Join([]string{
+		"umount /tmp/install_mounts/root/var/log",
+		"umount /tmp/install_mounts/root/home",
+		"umount /tmp/install_mounts/root/.snapshots",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/boot",
+		"cryptsetup luksClose cryptroot",
+	}, "\n"); got != want {
+		t.Errorf("cleanup plan =\n%s\nwant:\n%s", got, want)
+	}
+	for _, m := range installMounts(&state) {
+		if m.Filesystem == "btrfs" && (m.Dev != "/dev/mapper/cryptroot" || m.Subvol == "") {
+			t.Errorf("mount of %s = %+v, want a subvolume of /dev/mapper/cryptroot", m.MountPoint, m)
+		}
+	}
+}
+
+func TestFstabEntriesBtrfs(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	plan := NewPartitionPlan(disk, PartitionOptions{RootFS: "btrfs"})
+	uuids := map[int]string{1: "b00t", 2: "r00t"}
+
+	want := "/dev/mapper/cryptroot / btrfs compress=zstd,noatime,subvol=@ 0 0\n" +
+		"/dev/mapper/cryptroot /.snapshots btrfs compress=zstd,noatime,subvol=@snapshots 0 0\n" +
+		"UUID=b00t /boot ext4 defaults 0 2\n" +
+		"/dev/mapper/cryptroot /home btrfs compress=zstd,noatime,subvol=@home 0 0\n" +
+		"/dev/mapper/cryptroot /var/log btrfs compress=zstd,noatime,subvol=@var_log 0 0\n"
+	if got := fstabEntries(plan, uuids); got != want {
+		t.Errorf("fstabEntries() =\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := rootArgs(plan, uuids), "cryptdevice=UUID=r00t:cryptroot root=/dev/mapper/cryptroot rootflags=subvol=@"; got != want {
+		t.Errorf("rootArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestSnapshotStep(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	if plan := (&SnapshotStep{}).Plan(&State{InstallDevice: disk}); plan != nil {
+		t.Errorf("Plan() for an ext4 root = %+v, want nothing", plan)
+	}
+
+	fake := useFakeRunner(t)
+	state := State{InstallDevice: disk}
+	if err := (&SnapshotStep{}).Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("Run() for an ext4 root ran %v, want nothing", calls)
+	}
+
+	state.RootFS = "btrfs"
+	plan := (&SnapshotStep{}).Plan(&state)
+	if len(plan) != 1 || strings.Join(plan[0].Argv, " ") != "btrfs subvolume snapshot -r /tmp/install_mounts/root /tmp/install_mounts/root/.snapshots/fresh-install" {
+		t.Errorf("Plan() = %+v", plan)
+	}
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkpointPath is where progress is recorded, so a failed installation
+// can be resumed. It lives on a tmpfs & is only readable by root, as it
+// holds the disk encryption password needed to re-open the root partition.
+var checkpointPath = "/run/twlinst/checkpoint.json"
+
+// Checkpoint records the progress of an installation.
+type Checkpoint struct {
+	// Completed is the number of Steps which finished successfully.
+	Completed int `json:"completed"`
+	// Device is the path of the install disk.
+	Device string `json:"device"`
+	// UUIDs maps partition numbers to the UUIDs of the filesystems (or
+	// LUKS headers) created on them, to check the disk is unchanged.
+	UUIDs map[int]string `json:"uuids,omitempty"`
+	// State holds the settings of the installation.
+	State State `json:"state"`
+}
+
+// ResumeStep returns the index into Steps which a resumed installation
+// starts from: the first step not completed, or the nearest earlier step
+// which can safely be repeated. It returns false if the installation
+// cannot be resumed, and must be started afresh.
+func (c *Checkpoint) ResumeStep() (int, bool) {
+	i := c.Completed
+	if i >= len(Steps) {
+		return 0, false
+	}
+	for ; i >= 0; i-- {
+		if Steps[i].Idempotent(&c.State) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// StepName returns the name of the step a resumed installation starts
+// from.
+func (c *Checkpoint) StepName() string {
+	i, ok := c.ResumeStep()
+	if !ok {
+		return ""
+	}
+	return Steps[i].Name()
+}
+
+// resolveUUIDs returns the UUIDs of the partitions created on the install
+// disk.
+func resolveUUIDs(updateChan chan Update, state *State) (map[int]string, error) {
+	out := map[int]string{}
+	for _, p := range state.PartitionPlan().Partitions {
+		if p.Existing {
+			continue
+		}
+		uuid, err := getUUID(updateChan, state.InstallDevice.pathForPartition(p.Num))
+		if err != nil {
+			return nil, err
+		}
+		out[p.Num] = uuid
+	}
+	return out, nil
+}
+
+// saveCheckpoint records that the first completed steps of the
+// installation have finished.
+func saveCheckpoint(updateChan chan Update, state *State, completed int) error {
+	c := Checkpoint{
+		Completed: completed,
+		Device:    state.InstallDevice.Path,
+		State:     *state,
+	}
+	c.State.held = nil
+	// The partitions only exist once the first step has completed.
+	if completed > 0 {
+		uuids, err := resolveUUIDs(updateChan, state)
+		if err != nil {
+			return err
+		}
+		c.UUIDs = uuids
+	}
+
+	d, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(checkpointPath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checkpointPath, d, 0600)
+}
+
+func removeCheckpoint() error {
+	if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LoadCheckpoint returns the checkpoint of a failed installation, or
+// nil if there is none.
+func LoadCheckpoint() (*Checkpoint, error) {
+	d, err := ioutil.ReadFile(checkpointPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(d, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", checkpointPath, err)
+	}
+	if c.State.InstallDevice == nil {
+		return nil, fmt.Errorf("%s: missing install device", checkpointPath)
+	}
+	return &c, nil
+}
+
+// Resume continues the installation recorded by a checkpoint. The
+// mounts & mappings of the completed steps are re-established, and the
+// installation continues from the step given by ResumeStep.
+func Resume(ctx context.Context, updateChan chan Update, c *Checkpoint) error {
+	from, ok := c.ResumeStep()
+	if !ok {
+		return errors.New("installation cannot be resumed")
+	}
+	state := c.State
+
+	if len(c.UUIDs) > 0 {
+		uuids, err := resolveUUIDs(updateChan, &state)
+		if err != nil {
+			return err
+		}
+		for num, want := range c.UUIDs {
+			if uuids[num] != want {
+				return fmt.Errorf("%s has changed since the failed installation (partition %d has UUID %q, want %q)", c.Device, num, uuids[num], want)
+			}
+		}
+	}
+
+	progressInfo(updateChan, "Resuming installation from %s.\n", Steps[from].Name())
+	for _, step := range Steps[:from] {
+		r, ok := step.(Reopener)
+		if !ok {
+			continue
+		}
+		if err := r.Reopen(ctx, updateChan, &state); err != nil {
+			err = fmt.Errorf("re-opening %s: %v", step.Name(), err)
+			updateChan <- Update{
+				Kind:   KindFailed,
+				Err:    err,
+				ErrMsg: fmt.Sprintf("\nError!: %v\n", err),
+			}
+			state.ledger().unwind(updateChan)
+			return err
+		}
+	}
+	return runFrom(ctx, updateChan, &state, from)
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeStep is an InstallStep which records when it is run & reopened.
+type fakeStep struct {
+	name       string
+	idempotent bool
+	failures   int // the number of runs which should fail
+	log        *[]string
+}
+
+func (s *fakeStep) Run(ctx context.Context, updateChan chan Update, state *State) error {
+	*s.log = append(*s.log, "run "+s.name)
+	if s.failures > 0 {
+		s.failures--
+		return errFake
+	}
+	return nil
+}
+
+func (s *fakeStep) Reopen(ctx context.Context, updateChan chan Update, state *State) error {
+	*s.log = append(*s.log, "reopen "+s.name)
+	return nil
+}
+
+func (s *fakeStep) Plan(*State) []Action   { return nil }
+func (s *fakeStep) Weight(*State) int      { return 1 }
+func (s *fakeStep) Idempotent(*State) bool { return s.idempotent }
+func (s *fakeStep) Name() string           { return s.name }
+
+// useFakeSteps replaces Steps for the duration of the test.
+func useFakeSteps(t *testing.T, steps ...InstallStep) {
+	old := Steps
+	Steps = steps
+	t.Cleanup(func() { Steps = old })
+}
+
+func TestResumeStep(t *testing.T) {
+	var log []string
+	useFakeSteps(t,
+		&fakeStep{name: "partition", log: &log},
+		&fakeStep{name: "copy", idempotent: true, log: &log},
+		&fakeStep{name: "configure", log: &log},
+		&fakeStep{name: "cleanup", idempotent: true, log: &log},
+	)
+
+	tcs := []struct {
+		completed int
+		want      int
+		wantOK    bool
+	}{
+		{completed: 0, wantOK: false},
+		{completed: 1, want: 1, wantOK: true},
+		// configure can't be repeated, so copy is run again.
+		{completed: 2, want: 1, wantOK: true},
+		{completed: 3, want: 3, wantOK: true},
+		{completed: 4, wantOK: false},
+	}
+	for _, tc := range tcs {
+		c := Checkpoint{Completed: tc.completed}
+		if got, ok := c.ResumeStep(); got != tc.want || ok != tc.wantOK {
+			t.Errorf("ResumeStep() with %d completed = %d, %v, want %d, %v", tc.completed, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	fake := useFakeRunner(t)
+	uuidCmd := "lsblk --nodeps -nr -o UUID /dev/sdz"
+	fake.Responses = map[string]FakeResponse{
+		uuidCmd + "1": {Stdout: "boot-uuid\n"},
+		uuidCmd + "2": {Stdout: "luks-uuid\n"},
+		uuidCmd + "3": {Stdout: "meta-uuid\n"},
+	}
+	var log []string
+	useFakeSteps(t,
+		&fakeStep{name: "partition", log: &log},
+		&fakeStep{name: "copy", idempotent: true, log: &log},
+		&fakeStep{name: "configure", idempotent: true, failures: 1, log: &log},
+	)
+
+	state := State{Pw: "hunter2", InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}}
+	if err := Run(context.Background(), discardUpdates(t), &state); err != errFake {
+		t.Fatalf("Run() returned %v, want %v", err, errFake)
+	}
+
+	c, err := LoadCheckpoint()
+	if err != nil || c == nil {
+		t.Fatalf("LoadCheckpoint() = %v, %v, want a checkpoint", c, err)
+	}
+	if want := map[int]string{1: "boot-uuid", 2: "luks-uuid", 3: "meta-uuid"}; c.Completed != 2 || c.Device != "/dev/sdz" || !reflect.DeepEqual(c.UUIDs, want) {
+		t.Errorf("checkpoint = %+v, want 2 steps completed on /dev/sdz with UUIDs %v", c, want)
+	}
+	if c.State.Pw != "hunter2" {
+		t.Errorf("checkpoint password = %q, want %q", c.State.Pw, "hunter2")
+	}
+
+	// A changed disk must not be resumed.
+	fake.Responses[uuidCmd+"1"] = FakeResponse{Stdout: "other-uuid\n"}
+	if err := Resume(context.Background(), discardUpdates(t), c); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("Resume() on changed disk returned %v, want an error", err)
+	}
+	fake.Responses[uuidCmd+"1"] = FakeResponse{Stdout: "boot-uuid\n"}
+
+	if err := Resume(context.Background(), discardUpdates(t), c); err != nil {
+		t.Fatalf("Resume() failed: %v", err)
+	}
+	want := []string{"run partition", "run copy", "run configure", "reopen partition", "reopen copy", "run configure"}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("steps run = %q, want %q", log, want)
+	}
+
+	// Once finished, there is nothing to resume.
+	if c, err := LoadCheckpoint(); c != nil || err != nil {
+		t.Errorf("LoadCheckpoint() after install = %v, %v, want nil", c, err)
+	}
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Runner executes external commands. All commands invoked during an
+// installation are run by CmdRunner.
+type Runner interface {
+	Run(*Cmd) error
+}
+
+// CmdRunner is the Runner used to execute external commands. It may be
+// replaced to observe or fake the commands run during an installation.
+var CmdRunner Runner = HostRunner{}
+
+// HostRunner is a Runner which executes commands on the host system.
+type HostRunner struct{}
+
+// Run executes the command, returning once it has exited. If the command
+// has a context which is cancelled, the command and any processes it
+// started are killed.
+func (HostRunner) Run(c *Cmd) error {
+	ctx := c.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	e := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	e.Stdin, e.Stdout, e.Stderr = c.Stdin, c.Stdout, c.Stderr
+	// Run the command in its own process group, so children (such as
+	// those spawned by dpkg within a chroot) are killed along with it.
+	e.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	e.Cancel = func() error {
+		return syscall.Kill(-e.Process.Pid, syscall.SIGKILL)
+	}
+	if err := e.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Cmd describes an external command. It mirrors the subset of
+// exec.Cmd used by the install steps.
+type Cmd struct {
+	// Args holds the command line, including the command as Args[0].
+	Args []string
+	// Ctx, if set, aborts the command when it is cancelled.
+	Ctx context.Context
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// command returns a Cmd to run the named program with the given arguments.
+func command(name string, args ...string) *Cmd {
+	return &Cmd{Args: append([]string{name}, args...)}
+}
+
+// commandContext is like command, but the returned Cmd is aborted if ctx
+// is cancelled before it completes.
+func commandContext(ctx context.Context, name string, args ...string) *Cmd {
+	c := command(name, args...)
+	c.Ctx = ctx
+	return c
+}
+
+// Run runs the command using CmdRunner.
+func (c *Cmd) Run() error {
+	return CmdRunner.Run(c)
+}
+
+// Output runs the command, returning its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	err := c.Run()
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command, returning its combined standard
+// output & standard error.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+func runCmd(ctx context.Context, updateChan chan Update, logPrefix, cmd string, args ...string) error {
+	e := commandContext(ctx, cmd, args...)
+	progressInfo(updateChan, "%s%s\n", logPrefix, args)
+	out, err := e.CombinedOutput()
+	if len(out) > 4 {
+		progressInfo(updateChan, "  Output: %q\n", string(out))
+	}
+	return err
+}
+
+type cmdInteractiveWriter struct {
+	updateChan chan Update
+	logPrefix  string
+	IsErr      bool
+	IsProgress bool
+
+	// ParsePercent, if set, is called on each line of output. If it
+	// returns true, the step's progress is updated to the returned percent.
+	ParsePercent func(line string) (int, bool)
+}
+
+func (c *cmdInteractiveWriter) Write(in []byte) (int, error) {
+	for _, line := range strings.Split(string(in), "\n") {
+		line = strings.Trim(line, " \r\n")
+		if len(line) < 2 {
+			continue
+		}
+
+		var out Update
+		if c.IsErr {
+			out = Update{
+				WarnMsg: fmt.Sprintf("  %s%s\n", c.logPrefix, line),
+			}
+		} else {
+			out = Update{
+				InfoMsg: fmt.Sprintf("  %s%s\n", c.logPrefix, line),
+			}
+		}
+		out.IsProgress = c.IsProgress
+		c.updateChan <- out
+
+		if c.ParsePercent != nil {
+			if pct, ok := c.ParsePercent(line); ok {
+				progressPercent(c.updateChan, pct)
+			}
+		}
+	}
+	return len(in), nil
+}
+
+func runCmdInteractive(ctx context.Context, updateChan chan Update, logPrefix, cmd string, args ...string) error {
+	e := commandContext(ctx, cmd, args...)
+	progressInfo(updateChan, "%s%s\n", logPrefix, args)
+
+	e.Stdout = &cmdInteractiveWriter{
+		updateChan: updateChan,
+		logPrefix:  logPrefix,
+	}
+	e.Stderr = &cmdInteractiveWriter{
+		updateChan: updateChan,
+		logPrefix:  logPrefix,
+		IsErr:      true,
+	}
+
+	return e.Run()
+}
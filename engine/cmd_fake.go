@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// FakeCall records a command run by a FakeRunner.
+type FakeCall struct {
+	Argv  []string
+	Stdin string
+}
+
+// FakeResponse is the scripted result of a command run by a FakeRunner.
+type FakeResponse struct {
+	Stdout, Stderr string
+	Err            error
+}
+
+// FakeRunner is a Runner which records the commands it is asked to
+// run instead of executing them, for use in tests.
+type FakeRunner struct {
+	// Responses maps a command line (the arguments joined by spaces)
+	// to its scripted result. Commands with no response succeed with
+	// no output.
+	Responses map[string]FakeResponse
+	// OnRun, if set, is called with each command as it is run.
+	OnRun func(FakeCall)
+
+	mu    sync.Mutex
+	calls []FakeCall
+}
+
+// Run records the command & writes out its scripted response.
+func (f *FakeRunner) Run(c *Cmd) error {
+	if c.Ctx != nil && c.Ctx.Err() != nil {
+		return c.Ctx.Err()
+	}
+
+	var call FakeCall
+	call.Argv = append(call.Argv, c.Args...)
+	if c.Stdin != nil {
+		in, err := ioutil.ReadAll(c.Stdin)
+		if err != nil {
+			return err
+		}
+		call.Stdin = string(in)
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	resp := f.Responses[strings.Join(c.Args, " ")]
+	f.mu.Unlock()
+	if f.OnRun != nil {
+		f.OnRun(call)
+	}
+
+	if c.Stdout != nil && resp.Stdout != "" {
+		if _, err := io.WriteString(c.Stdout, resp.Stdout); err != nil {
+			return err
+		}
+	}
+	if c.Stderr != nil && resp.Stderr != "" {
+		if _, err := io.WriteString(c.Stderr, resp.Stderr); err != nil {
+			return err
+		}
+	}
+	return resp.Err
+}
+
+// Calls returns the commands run so far, in order.
+func (f *FakeRunner) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
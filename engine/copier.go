@@ -0,0 +1,464 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Whence values for seeking to the data & holes of sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// copyChunk is the most data copied between progress updates.
+const copyChunk = 4 * 1024 * 1024
+
+// fileID identifies an inode.
+type fileID struct {
+	Dev, Ino uint64
+}
+
+// copyEntry is a file or directory to copy, with the source's metadata.
+type copyEntry struct {
+	Src, Dst string
+	St       *syscall.Stat_t
+}
+
+// copier copies directory trees, preserving ownership, permissions,
+// timestamps, symlinks, hardlinks, device nodes, extended attributes
+// (which hold ACLs, file capabilities & security labels) and the holes
+// in sparse files. Regular files are copied by Workers goroutines.
+type copier struct {
+	// Workers is the number of files copied concurrently.
+	Workers int
+
+	// Exclude, if set, is called with the slash-separated path of each
+	// file relative to the root of the copy, returning true to skip it
+	// (and, for a directory, its contents).
+	Exclude func(rel string) bool
+	// Adjust, if set, may change the ownership & permissions in the
+	// metadata of each file (given by its relative path) before the
+	// file is copied.
+	Adjust func(rel string, st *syscall.Stat_t)
+
+	// Files & Bytes count the files & bytes copied so far. They are
+	// updated atomically while a copy is running.
+	Files, Bytes int64
+
+	// inodes maps the source inode of files with multiple links to the
+	// destination of the first copy, which later links are linked to.
+	inodes map[fileID]string
+}
+
+// Copy copies the tree rooted at src to dst. If dst is an existing
+// directory, src's contents are merged into it & existing files are
+// replaced.
+func (c *copier) Copy(ctx context.Context, src, dst string) error {
+	if c.inodes == nil {
+		c.inodes = map[fileID]string{}
+	}
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	files := make(chan copyEntry)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range files {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := c.copyFile(e); err != nil {
+					fail(fmt.Errorf("copying %s: %v", e.Src, err))
+				}
+			}
+		}()
+	}
+
+	var dirs []copyEntry
+	var links [][2]string
+	walkErr := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if c.Exclude != nil && c.Exclude(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := copyEntry{Src: p, Dst: filepath.Join(dst, rel), St: info.Sys().(*syscall.Stat_t)}
+		if c.Adjust != nil {
+			c.Adjust(filepath.ToSlash(rel), e.St)
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(e.Dst, 0700); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("copying %s: %v", p, err)
+			}
+			dirs = append(dirs, e)
+		case mode.IsRegular():
+			if e.St.Nlink > 1 {
+				id := fileID{Dev: uint64(e.St.Dev), Ino: e.St.Ino}
+				if first, ok := c.inodes[id]; ok {
+					links = append(links, [2]string{first, e.Dst})
+					return nil
+				}
+				c.inodes[id] = e.Dst
+			}
+			select {
+			case files <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case mode&os.ModeSymlink != 0:
+			if err := c.copySymlink(e); err != nil {
+				return fmt.Errorf("copying %s: %v", p, err)
+			}
+		default:
+			if err := c.copyNode(e); err != nil {
+				return fmt.Errorf("copying %s: %v", p, err)
+			}
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+
+	// Hardlinks are made once the files they link to have been copied.
+	for _, l := range links {
+		if err := removeExisting(l[1]); err != nil {
+			return err
+		}
+		if err := os.Link(l[0], l[1]); err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.Files, 1)
+	}
+
+	// Directory metadata is applied last & deepest first, as creating
+	// entries updates the modification time of a directory.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setMetadata(dirs[i]); err != nil {
+			return fmt.Errorf("copying %s: %v", dirs[i].Src, err)
+		}
+	}
+	return nil
+}
+
+// removeExisting removes p if it exists & is not a directory, so it can
+// be replaced.
+func removeExisting(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	return os.Remove(p)
+}
+
+func (c *copier) copyFile(e copyEntry) error {
+	in, err := os.Open(e.Src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := removeExisting(e.Dst); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(e.Dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := c.copyData(out, in, e.St.Size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := setMetadata(e); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.Files, 1)
+	return nil
+}
+
+// copyData copies the contents of a file, skipping its holes.
+func (c *copier) copyData(out, in *os.File, size int64) error {
+	var off int64
+	for off < size {
+		data, err := in.Seek(off, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				break // The rest of the file is a hole.
+			}
+			if off == 0 {
+				// The filesystem can't find holes; copy the whole file.
+				return c.copyRange(out, in, 0, size)
+			}
+			return err
+		}
+		hole, err := in.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.Bytes, data-off)
+		if err := c.copyRange(out, in, data, hole-data); err != nil {
+			return err
+		}
+		off = hole
+	}
+	atomic.AddInt64(&c.Bytes, size-off)
+	// Extend the file over any trailing hole.
+	return out.Truncate(size)
+}
+
+// copyRange copies n bytes at offset off in chunks, counting progress.
+func (c *copier) copyRange(out, in *os.File, off, n int64) error {
+	if _, err := in.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > copyChunk {
+			chunk = copyChunk
+		}
+		written, err := io.CopyN(out, in, chunk)
+		atomic.AddInt64(&c.Bytes, written)
+		if err != nil {
+			return err
+		}
+		n -= written
+	}
+	return nil
+}
+
+func (c *copier) copySymlink(e copyEntry) error {
+	target, err := os.Readlink(e.Src)
+	if err != nil {
+		return err
+	}
+	if err := removeExisting(e.Dst); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, e.Dst); err != nil {
+		return err
+	}
+	if err := setMetadata(e); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.Files, 1)
+	return nil
+}
+
+// copyNode copies a device node, FIFO or socket.
+func (c *copier) copyNode(e copyEntry) error {
+	if err := removeExisting(e.Dst); err != nil {
+		return err
+	}
+	if err := syscall.Mknod(e.Dst, e.St.Mode, int(e.St.Rdev)); err != nil {
+		return err
+	}
+	if err := setMetadata(e); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.Files, 1)
+	return nil
+}
+
+// setMetadata applies the ownership, permissions, extended attributes &
+// timestamps of the source to the copy. Ownership is changed first, as
+// doing so clears the setuid/setgid bits & file capabilities.
+func setMetadata(e copyEntry) error {
+	if err := os.Lchown(e.Dst, int(e.St.Uid), int(e.St.Gid)); err != nil {
+		return err
+	}
+	if e.St.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		if err := syscall.Chmod(e.Dst, e.St.Mode&07777); err != nil {
+			return err
+		}
+	}
+	if err := copyXattrs(e.Src, e.Dst); err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{e.St.Atim, e.St.Mtim}
+	return lutimesNano(e.Dst, ts)
+}
+
+// copyXattrs copies the extended attributes of src to dst, without
+// following symlinks. POSIX ACLs are stored as the system.posix_acl_*
+// attributes, so are copied too.
+func copyXattrs(src, dst string) error {
+	names, err := llistxattr(src)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		val, err := lgetxattr(src, name)
+		if err != nil {
+			return fmt.Errorf("reading xattr %s: %v", name, err)
+		}
+		if err := lsetxattr(dst, name, val); err != nil {
+			return fmt.Errorf("setting xattr %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// The syscall package lacks the l*xattr variants, which don't follow
+// symlinks.
+
+func llistxattr(p string) ([]string, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := xattrSyscall(syscall.SYS_LLISTXATTR, p, "", buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*4)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func lgetxattr(p, name string) ([]byte, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := xattrSyscall(syscall.SYS_LGETXATTR, p, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*4)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func lsetxattr(p, name string, val []byte) error {
+	pp, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return err
+	}
+	np, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var vp unsafe.Pointer
+	if len(val) > 0 {
+		vp = unsafe.Pointer(&val[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(np)), uintptr(vp), uintptr(len(val)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// xattrSyscall invokes llistxattr (with an empty name) or lgetxattr.
+func xattrSyscall(trap uintptr, p, name string, buf []byte) (int, error) {
+	pp, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return 0, err
+	}
+	var r1 uintptr
+	var errno syscall.Errno
+	if trap == syscall.SYS_LLISTXATTR {
+		r1, _, errno = syscall.Syscall(trap, uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	} else {
+		np, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return 0, err
+		}
+		r1, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(np)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r1), nil
+}
+
+// Flags for utimensat: atFdcwd resolves relative paths from the working
+// directory, and atSymlinkNofollow operates on a symlink itself.
+const (
+	atFdcwd           = -100
+	atSymlinkNofollow = 0x100
+)
+
+// lutimesNano sets the access & modification times of p, without
+// following symlinks.
+func lutimesNano(p string, ts []syscall.Timespec) error {
+	pp, err := syscall.BytePtrFromString(p)
+	if err != nil {
+		return err
+	}
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(pp)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
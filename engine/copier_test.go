@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func lstat(t *testing.T, p string) *syscall.Stat_t {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		t.Fatal(err)
+	}
+	return &st
+}
+
+// makeCopySource builds a tree exercising the kinds of files & metadata
+// the copier preserves.
+func makeCopySource(t *testing.T) string {
+	src := t.TempDir()
+	mustDo := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustDo(os.MkdirAll(filepath.Join(src, "etc/sub"), 0750))
+	mustDo(ioutil.WriteFile(filepath.Join(src, "etc/passwd"), []byte("root:x:0:0::/root:/bin/bash\n"), 0644))
+	mustDo(ioutil.WriteFile(filepath.Join(src, "etc/sub/setuid"), []byte("#!/bin/sh\n"), 0755))
+	mustDo(os.Chmod(filepath.Join(src, "etc/sub/setuid"), 0755|os.ModeSetuid))
+	mustDo(os.Symlink("../etc/passwd", filepath.Join(src, "etc/sub/link")))
+	mustDo(os.Link(filepath.Join(src, "etc/passwd"), filepath.Join(src, "etc/hardlink")))
+
+	// A sparse file with a hole in the middle & at the end.
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	mustDo(err)
+	_, err = f.WriteAt([]byte("start"), 0)
+	mustDo(err)
+	_, err = f.WriteAt([]byte("middle"), 8*1024*1024)
+	mustDo(err)
+	mustDo(f.Truncate(32 * 1024 * 1024))
+	mustDo(f.Close())
+
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mustDo(os.Chtimes(filepath.Join(src, "etc/passwd"), old, old))
+	mustDo(os.Chtimes(filepath.Join(src, "etc/sub"), old, old))
+	return src
+}
+
+func TestCopier(t *testing.T) {
+	src := makeCopySource(t)
+	if err := lsetxattr(filepath.Join(src, "etc/passwd"), "user.twl", []byte("label")); err != nil {
+		t.Logf("xattrs not supported: %v", err)
+	}
+	if os.Geteuid() == 0 {
+		if err := syscall.Mknod(filepath.Join(src, "null"), syscall.S_IFCHR|0666, 1<<8|3); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Lchown(filepath.Join(src, "etc/sub/setuid"), 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(src, "etc/sub/setuid"), 0755|os.ModeSetuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		dst := filepath.Join(t.TempDir(), "dst")
+		c := copier{Workers: workers}
+		if err := c.Copy(context.Background(), src, dst); err != nil {
+			t.Fatalf("Copy() with %d workers failed: %v", workers, err)
+		}
+
+		for _, p := range []string{"etc", "etc/sub", "etc/passwd", "etc/sub/setuid", "etc/sub/link", "sparse"} {
+			want, got := lstat(t, filepath.Join(src, p)), lstat(t, filepath.Join(dst, p))
+			if got.Mode != want.Mode {
+				t.Errorf("%s: mode = %o, want %o", p, got.Mode, want.Mode)
+			}
+			if got.Uid != want.Uid || got.Gid != want.Gid {
+				t.Errorf("%s: owner = %d:%d, want %d:%d", p, got.Uid, got.Gid, want.Uid, want.Gid)
+			}
+			if got.Mtim != want.Mtim {
+				t.Errorf("%s: mtime = %v, want %v", p, got.Mtim, want.Mtim)
+			}
+		}
+
+		if target, err := os.Readlink(filepath.Join(dst, "etc/sub/link")); err != nil || target != "../etc/passwd" {
+			t.Errorf("symlink = %q, %v, want %q", target, err, "../etc/passwd")
+		}
+		if a, b := lstat(t, filepath.Join(dst, "etc/passwd")), lstat(t, filepath.Join(dst, "etc/hardlink")); a.Ino != b.Ino {
+			t.Error("hardlink was not preserved")
+		}
+		if v, err := lgetxattr(filepath.Join(src, "etc/passwd"), "user.twl"); err == nil {
+			if got, err := lgetxattr(filepath.Join(dst, "etc/passwd"), "user.twl"); err != nil || string(got) != string(v) {
+				t.Errorf("xattr = %q, %v, want %q", got, err, v)
+			}
+		}
+
+		sparse := lstat(t, filepath.Join(dst, "sparse"))
+		if sparse.Size != 32*1024*1024 {
+			t.Errorf("sparse file size = %d, want %d", sparse.Size, 32*1024*1024)
+		}
+		if srcBlocks := lstat(t, filepath.Join(src, "sparse")).Blocks; sparse.Blocks > srcBlocks {
+			t.Errorf("sparse file uses %d blocks, want at most %d", sparse.Blocks, srcBlocks)
+		}
+		d, err := ioutil.ReadFile(filepath.Join(dst, "sparse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d[:5]) != "start" || string(d[8*1024*1024:8*1024*1024+6]) != "middle" {
+			t.Error("sparse file contents not preserved")
+		}
+
+		if os.Geteuid() == 0 {
+			if st := lstat(t, filepath.Join(dst, "null")); st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 1<<8|3 {
+				t.Errorf("device node = mode %o rdev %d, want a character device 1:3", st.Mode, st.Rdev)
+			}
+		}
+
+		size, files := treeSize(src, nil)
+		if c.Bytes != size || c.Files != files {
+			t.Errorf("copied %d files (%d bytes), want %d files (%d bytes)", c.Files, c.Bytes, files, size)
+		}
+	}
+}
+
+func TestCopierMerge(t *testing.T) {
+	src, dst := makeCopySource(t), t.TempDir()
+	// Files left by an earlier, interrupted copy are replaced.
+	if err := os.MkdirAll(filepath.Join(dst, "etc/sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "etc/passwd"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("elsewhere", filepath.Join(dst, "etc/sub/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := copier{Workers: 2}
+	if err := c.Copy(context.Background(), src, dst); err != nil {
+		t.Fatalf("Copy() failed: %v", err)
+	}
+	if d, err := ioutil.ReadFile(filepath.Join(dst, "etc/passwd")); err != nil || string(d) != "root:x:0:0::/root:/bin/bash\n" {
+		t.Errorf("etc/passwd = %q, %v, want it replaced", d, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "etc/sub/link")); err != nil || target != "../etc/passwd" {
+		t.Errorf("symlink = %q, %v, want %q", target, err, "../etc/passwd")
+	}
+}
+
+func TestCopierError(t *testing.T) {
+	c := copier{Workers: 2}
+	err := c.Copy(context.Background(), filepath.Join(t.TempDir(), "missing"), t.TempDir())
+	if err == nil {
+		t.Fatal("Copy() of a missing tree succeeded")
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import "fmt"
+
+// Disk describes a block device & its partitions.
+type Disk struct {
+	Name, Path string
+
+	Model    string
+	Serial   string
+	Bus, Rev string
+	Symlinks []string
+
+	// NumBlocks is the size of the device, in 512-byte blocks regardless
+	// of its sector size.
+	NumBlocks int
+	// LogicalBlockSize is the sector size the disk is addressed in, &
+	// PhysicalBlockSize the size it reads & writes internally.
+	LogicalBlockSize, PhysicalBlockSize int
+	// Removable is set for removable media, & Rotational for spinning
+	// disks.
+	Removable, Rotational bool
+	// OptimalIOSize is the preferred unit of I/O, such as a RAID stripe,
+	// or zero if unknown. AlignmentOffset is the offset of the first
+	// physically aligned sector from the start of the disk, in bytes.
+	OptimalIOSize, AlignmentOffset int
+	// Holders are the dm or md devices built on the device.
+	Holders []string
+
+	Major, Minor int
+	PartN        int
+	// Start is the offset of a partition from the start of its disk, in
+	// 512-byte blocks like NumBlocks.
+	Start int
+
+	PartTabType string
+	// PartUUID is the UUID of a disk's partition table, or of a
+	// partition's entry in it.
+	PartUUID string
+	// PartType is a partition's type: a GUID on GPT tables, or a hex type
+	// code such as 0x7 on msdos tables.
+	PartType   string
+	FsUUID     string
+	Partitions []*Disk
+	FS, Label  string
+
+	// InUse lists why the disk is unsafe to install onto, such as its
+	// partitions being mounted.
+	InUse []string
+	// LiveMedium is set if the disk holds the running live system.
+	LiveMedium bool
+}
+
+func (d *Disk) pathForPartition(partNum int) string {
+	// The kernel separates the partition number with a 'p' if the disk
+	// name ends in a digit (nvme0n1p1, mmcblk0p1, loop0p1), and
+	// appends it directly otherwise (sda1).
+	if last := d.Path[len(d.Path)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", d.Path, partNum)
+	}
+	return fmt.Sprintf("%s%d", d.Path, partNum)
+}
+
+// SizeBytes returns the capacity of the device.
+func (d *Disk) SizeBytes() int64 {
+	return int64(d.NumBlocks) * blockSize
+}
+
+// logicalBlockSize returns the sector size the disk is addressed in,
+// assuming 512 bytes if unknown.
+func (d *Disk) logicalBlockSize() int {
+	if d.LogicalBlockSize <= 0 {
+		return 512
+	}
+	return d.LogicalBlockSize
+}
+
+// physicalBlockSize returns the size of the disk's physical sectors,
+// assuming they match the logical sectors if unknown.
+func (d *Disk) physicalBlockSize() int {
+	if d.PhysicalBlockSize < d.logicalBlockSize() {
+		return d.logicalBlockSize()
+	}
+	return d.PhysicalBlockSize
+}
+
+// DevNumBlocks returns the size of the named block device, in 512-byte
+// blocks.
+func DevNumBlocks(name string) (int, error) {
+	return readSysfsInt(name, "size")
+}
+
+// GetDiskInfo returns information about each disk attached to the system.
+func GetDiskInfo() ([]Disk, error) {
+	out, err := readDisks()
+	if err != nil {
+		return nil, err
+	}
+	if err := markDisksInUse(out); err != nil {
+		return nil, fmt.Errorf("checking which disks are in use: %v", err)
+	}
+	return out, nil
+}
+
+// ByteCountDecimal formats a number of bytes with SI units.
+func ByteCountDecimal(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// udevDataDir is udev's database of device properties. Tests point it at
+// a fixture.
+var udevDataDir = "/run/udev/data"
+
+// scsiTypeROM is the SCSI peripheral type of CD & DVD drives.
+const scsiTypeROM = "5"
+
+// readSysfs returns the trimmed contents of a file beneath the named
+// device in /sys/class/block.
+func readSysfs(name string, elem ...string) (string, error) {
+	d, err := ioutil.ReadFile(filepath.Join(append([]string{sysClassBlock, name}, elem...)...))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(d)), nil
+}
+
+// readSysfsInt is like readSysfs, for files holding a single number.
+func readSysfsInt(name string, elem ...string) (int, error) {
+	s, err := readSysfs(name, elem...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+// readUdevData returns the properties (E: lines) & /dev symlinks (S:
+// lines) recorded by udev for the device major:minor. Devices udev has not
+// processed have no entry, which is not an error.
+func readUdevData(major, minor int) (map[string]string, []string, error) {
+	props := map[string]string{}
+	f, err := os.Open(filepath.Join(udevDataDir, fmt.Sprintf("b%d:%d", major, minor)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return props, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var links []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "E:"):
+			if i := strings.IndexByte(line, '='); i > 2 {
+				props[line[2:i]] = line[i+1:]
+			}
+		case strings.HasPrefix(line, "S:"):
+			links = append(links, "/dev/"+line[2:])
+		}
+	}
+	return props, links, s.Err()
+}
+
+// readBlockDev describes the named disk or partition from sysfs & the udev
+// database.
+func readBlockDev(name string) (*Disk, error) {
+	out := Disk{Name: name, Path: "/dev/" + name}
+
+	dev, err := readSysfs(name, "dev")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(dev, "%d:%d", &out.Major, &out.Minor); err != nil {
+		return nil, fmt.Errorf("decoding %s device number %q: %v", name, dev, err)
+	}
+	if out.NumBlocks, err = readSysfsInt(name, "size"); err != nil {
+		return nil, fmt.Errorf("reading %s size: %v", name, err)
+	}
+	if holders, err := ioutil.ReadDir(filepath.Join(sysClassBlock, name, "holders")); err == nil {
+		for _, h := range holders {
+			out.Holders = append(out.Holders, h.Name())
+		}
+	}
+
+	props, links, err := readUdevData(out.Major, out.Minor)
+	if err != nil {
+		return nil, fmt.Errorf("reading udev data for %s: %v", name, err)
+	}
+	out.Symlinks = links
+	out.Model = props["ID_MODEL"]
+	out.Serial = props["ID_SERIAL"]
+	out.Rev = props["ID_REVISION"]
+	out.Bus = props["ID_BUS"]
+	out.PartTabType = props["ID_PART_TABLE_TYPE"]
+	out.PartUUID = props["ID_PART_TABLE_UUID"]
+	if out.PartN, err = readSysfsInt(name, "partition"); err == nil {
+		// A partition's ID_PART_TABLE_UUID is that of its disk.
+		out.PartUUID = props["ID_PART_ENTRY_UUID"]
+		out.PartType = props["ID_PART_ENTRY_TYPE"]
+		if out.Start, err = readSysfsInt(name, "start"); err != nil {
+			return nil, fmt.Errorf("reading %s start: %v", name, err)
+		}
+	}
+	out.FS = props["ID_FS_TYPE"]
+	out.Label = props["ID_FS_LABEL"]
+	out.FsUUID = props["ID_FS_UUID"]
+	return &out, nil
+}
+
+// readDisk describes the named disk & its partitions.
+func readDisk(name string) (*Disk, error) {
+	out, err := readBlockDev(name)
+	if err != nil {
+		return nil, err
+	}
+	if out.Model == "" {
+		out.Model, _ = readSysfs(name, "device", "model")
+	}
+	if out.LogicalBlockSize, err = readSysfsInt(name, "queue", "logical_block_size"); err != nil {
+		return nil, fmt.Errorf("reading %s logical block size: %v", name, err)
+	}
+	if out.PhysicalBlockSize, err = readSysfsInt(name, "queue", "physical_block_size"); err != nil {
+		return nil, fmt.Errorf("reading %s physical block size: %v", name, err)
+	}
+	// These are absent on older kernels, where zero is the default.
+	out.OptimalIOSize, _ = readSysfsInt(name, "queue", "optimal_io_size")
+	out.AlignmentOffset, _ = readSysfsInt(name, "alignment_offset")
+	removable, _ := readSysfs(name, "removable")
+	out.Removable = removable == "1"
+	rotational, _ := readSysfs(name, "queue", "rotational")
+	out.Rotational = rotational == "1"
+
+	// Partitions are listed beneath the disk, whatever they are named.
+	entries, err := ioutil.ReadDir(filepath.Join(sysClassBlock, name))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(sysClassBlock, name, e.Name(), "partition")); err != nil {
+			continue
+		}
+		part, err := readBlockDev(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		part.LogicalBlockSize, part.PhysicalBlockSize = out.LogicalBlockSize, out.PhysicalBlockSize
+		out.Partitions = append(out.Partitions, part)
+	}
+	sort.Slice(out.Partitions, func(i, j int) bool {
+		return out.Partitions[i].PartN < out.Partitions[j].PartN
+	})
+	return out, nil
+}
+
+// isInstallTarget returns true if the named block device is a disk which
+// could be installed to: partitions, virtual devices (loop, dm, md, zram),
+// optical drives & empty card readers are skipped.
+func isInstallTarget(name string) bool {
+	if _, err := os.Stat(filepath.Join(sysClassBlock, name, "partition")); err == nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(sysClassBlock, name, "device")); err != nil {
+		return false
+	}
+	if t, _ := readSysfs(name, "device", "type"); t == scsiTypeROM {
+		return false
+	}
+	size, err := readSysfsInt(name, "size")
+	return err == nil && size > 0
+}
+
+// readDisks describes each disk attached to the system, sorted by name.
+func readDisks() ([]Disk, error) {
+	entries, err := ioutil.ReadDir(sysClassBlock)
+	if err != nil {
+		return nil, err
+	}
+	var out []Disk
+	for _, e := range entries {
+		if !isInstallTarget(e.Name()) {
+			continue
+		}
+		d, err := readDisk(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *d)
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles creates files, keyed by their path beneath dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for p, contents := range files {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeDisk adds a disk with numParts partitions to a sysfs fixture.
+func fakeDisk(files map[string]string, name, dev string, size, sectorSize int, partName func(int) string, numParts int) {
+	files["block/"+name+"/dev"] = dev + "\n"
+	files["block/"+name+"/size"] = fmt.Sprintf("%d\n", size)
+	files["block/"+name+"/removable"] = "0\n"
+	files["block/"+name+"/device/.keep"] = ""
+	files["block/"+name+"/queue/logical_block_size"] = fmt.Sprintf("%d\n", sectorSize)
+	files["block/"+name+"/queue/physical_block_size"] = "4096\n"
+	files["block/"+name+"/queue/rotational"] = "0\n"
+	var major, minor int
+	fmt.Sscanf(dev, "%d:%d", &major, &minor)
+	for i := 1; i <= numParts; i++ {
+		p := partName(i)
+		files["block/"+name+"/"+p+"/partition"] = fmt.Sprintf("%d\n", i)
+		files["block/"+p+"/partition"] = fmt.Sprintf("%d\n", i)
+		files["block/"+p+"/dev"] = fmt.Sprintf("%d:%d\n", major, minor+i)
+		files["block/"+p+"/size"] = "2048\n"
+		files["block/"+p+"/start"] = fmt.Sprintf("%d\n", 2048*i)
+	}
+}
+
+// makeFakeDisks writes a fixture of /sys/class/block & /run/udev/data
+// describing:
+//   - sda, a SATA SSD with a GPT holding an ESP & a LUKS partition,
+//   - nvme0n1, with 13 partitions, which is 4Kn,
+//   - sdb, an empty card reader,
+//   - sr0, a DVD drive,
+//   - loop0 & dm-0, virtual devices.
+func makeFakeDisks(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	fakeDisk(files, "sda", "8:0", 500118192, 512, func(i int) string { return fmt.Sprintf("sda%d", i) }, 2)
+	files["block/sda/queue/rotational"] = "1\n"
+	files["block/sda2/holders/dm-0/.keep"] = ""
+	fakeDisk(files, "nvme0n1", "259:0", 1000215216, 4096, func(i int) string { return fmt.Sprintf("nvme0n1p%d", i) }, 13)
+	fakeDisk(files, "sdb", "8:16", 0, 512, nil, 0)
+	files["block/sdb/removable"] = "1\n"
+	fakeDisk(files, "sr0", "11:0", 8388608, 2048, nil, 0)
+	files["block/sr0/device/type"] = "5\n"
+	files["block/loop0/dev"] = "7:0\n"
+	files["block/loop0/size"] = "1024\n"
+	files["block/dm-0/dev"] = "253:0\n"
+	files["block/dm-0/size"] = "1024\n"
+
+	files["udev/b8:0"] = "S:disk/by-id/ata-Samsung_SSD_860_EVO_S3Z9NB0K123456\n" +
+		"S:disk/by-path/pci-0000:00:17.0-ata-1\n" +
+		"L:0\n" +
+		"E:ID_MODEL=Samsung_SSD_860_EVO\n" +
+		"E:ID_SERIAL=Samsung_SSD_860_EVO_S3Z9NB0K123456\n" +
+		"E:ID_REVISION=RVT04B6Q\n" +
+		"E:ID_BUS=ata\n" +
+		"E:ID_PART_TABLE_TYPE=gpt\n" +
+		"E:ID_PART_TABLE_UUID=0c4a1b3e-8d2f-4e0a-9b55-6b1f0c7d2e11\n" +
+		"G:systemd\n"
+	files["udev/b8:1"] = "E:ID_FS_TYPE=vfat\n" +
+		"E:ID_FS_LABEL=EFI\n" +
+		"E:ID_FS_UUID=1A2B-3C4D\n" +
+		"E:ID_PART_TABLE_UUID=0c4a1b3e-8d2f-4e0a-9b55-6b1f0c7d2e11\n" +
+		"E:ID_PART_ENTRY_UUID=5f3a1c2e-0b4d-4c6e-8a7f-9e1d2c3b4a51\n" +
+		"E:ID_PART_ENTRY_TYPE=c12a7328-f81f-11d2-ba4b-00a0c93ec93b\n"
+	files["udev/b8:2"] = "E:ID_FS_TYPE=crypto_LUKS\n" +
+		"E:ID_FS_UUID=7b9c1d2e-3f40-4a5b-8c6d-7e8f9a0b1c2d\n"
+	// The NVMe disk has no udev entry, so its model is read from sysfs.
+	files["block/nvme0n1/device/model"] = "WDC WDS100T2B0C  \n"
+	writeFiles(t, dir, files)
+
+	oldBlock, oldUdev := sysClassBlock, udevDataDir
+	sysClassBlock = filepath.Join(dir, "block")
+	udevDataDir = filepath.Join(dir, "udev")
+	t.Cleanup(func() {
+		sysClassBlock, udevDataDir = oldBlock, oldUdev
+	})
+}
+
+func TestReadDisks(t *testing.T) {
+	makeFakeDisks(t)
+	disks, err := readDisks()
+	if err != nil {
+		t.Fatalf("readDisks() failed: %v", err)
+	}
+	var names []string
+	for _, d := range disks {
+		names = append(names, d.Name)
+	}
+	if want := []string{"nvme0n1", "sda"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("readDisks() returned %q, want %q", names, want)
+	}
+
+	nvme, sda := disks[0], disks[1]
+	if len(nvme.Partitions) != 13 {
+		t.Fatalf("nvme0n1 has %d partitions, want 13", len(nvme.Partitions))
+	}
+	for i, p := range nvme.Partitions {
+		if want := fmt.Sprintf("/dev/nvme0n1p%d", i+1); p.Path != want || p.PartN != i+1 {
+			t.Errorf("nvme0n1 partition %d = %s (%d), want %s", i, p.Path, p.PartN, want)
+		}
+	}
+	if nvme.Model != "WDC WDS100T2B0C" || nvme.LogicalBlockSize != 4096 || nvme.Rotational {
+		t.Errorf("nvme0n1 = %+v", nvme)
+	}
+
+	sda.Partitions = nil
+	want := Disk{
+		Name:              "sda",
+		Path:              "/dev/sda",
+		Model:             "Samsung_SSD_860_EVO",
+		Serial:            "Samsung_SSD_860_EVO_S3Z9NB0K123456",
+		Bus:               "ata",
+		Rev:               "RVT04B6Q",
+		Symlinks:          []string{"/dev/disk/by-id/ata-Samsung_SSD_860_EVO_S3Z9NB0K123456", "/dev/disk/by-path/pci-0000:00:17.0-ata-1"},
+		NumBlocks:         500118192,
+		LogicalBlockSize:  512,
+		PhysicalBlockSize: 4096,
+		Rotational:        true,
+		Major:             8,
+		PartTabType:       "gpt",
+		PartUUID:          "0c4a1b3e-8d2f-4e0a-9b55-6b1f0c7d2e11",
+	}
+	if !reflect.DeepEqual(sda, want) {
+		t.Errorf("sda = %+v\nwant %+v", sda, want)
+	}
+
+	parts := disks[1].Partitions
+	wantParts := []*Disk{
+		{
+			Name: "sda1", Path: "/dev/sda1", NumBlocks: 2048, LogicalBlockSize: 512, PhysicalBlockSize: 4096,
+			Major: 8, Minor: 1, PartN: 1, Start: 2048, PartUUID: "5f3a1c2e-0b4d-4c6e-8a7f-9e1d2c3b4a51",
+			PartType: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+			FsUUID:   "1A2B-3C4D", FS: "vfat", Label: "EFI",
+		},
+		{
+			Name: "sda2", Path: "/dev/sda2", NumBlocks: 2048, LogicalBlockSize: 512, PhysicalBlockSize: 4096,
+			Holders: []string{"dm-0"}, Major: 8, Minor: 2, PartN: 2, Start: 4096,
+			FsUUID: "7b9c1d2e-3f40-4a5b-8c6d-7e8f9a0b1c2d", FS: "crypto_LUKS",
+		},
+	}
+	if !reflect.DeepEqual(parts, wantParts) {
+		for i := range parts {
+			t.Logf("partition %d = %+v", i, parts[i])
+		}
+		t.Error("sda partitions differ")
+	}
+}
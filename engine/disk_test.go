@@ -0,0 +1,27 @@
+package engine
+
+import "testing"
+
+func TestPathForPartition(t *testing.T) {
+	tcs := []struct {
+		path    string
+		partNum int
+		want    string
+	}{
+		{"/dev/sda", 1, "/dev/sda1"},
+		{"/dev/sdb", 12, "/dev/sdb12"},
+		{"/dev/vda", 2, "/dev/vda2"},
+		{"/dev/nvme0n1", 1, "/dev/nvme0n1p1"},
+		{"/dev/mmcblk0", 3, "/dev/mmcblk0p3"},
+		{"/dev/loop0", 1, "/dev/loop0p1"},
+		{"/dev/loop1", 1, "/dev/loop1p1"},
+		{"/dev/loop12", 2, "/dev/loop12p2"},
+	}
+
+	for _, tc := range tcs {
+		d := Disk{Path: tc.path}
+		if got := d.pathForPartition(tc.partNum); got != tc.want {
+			t.Errorf("Disk{Path: %q}.pathForPartition(%d) = %q, want %q", tc.path, tc.partNum, got, tc.want)
+		}
+	}
+}
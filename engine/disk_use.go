@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The kernel interfaces inspected to find disks which are in use. Tests
+// point them at fixtures.
+var (
+	sysClassBlock = "/sys/class/block"
+	procMountinfo = "/proc/self/mountinfo"
+	procSwaps     = "/proc/swaps"
+)
+
+// liveMediumMounts are where live systems mount the medium they booted
+// from, in addition to the root filesystem.
+var liveMediumMounts = []string{"/", "/run/live/medium", "/lib/live/mount/medium", "/run/initramfs/live", "/cdrom"}
+
+// CheckEligible returns an error if installing to the disk could destroy
+// data in use. Disks which are mounted, hold swap or back dm/md devices
+// may be installed to if override is set; the live boot medium never may.
+func (d *Disk) CheckEligible(override bool) error {
+	switch {
+	case d.LiveMedium:
+		return fmt.Errorf("%s holds the running live system", d.Path)
+	case len(d.InUse) > 0 && !override:
+		return fmt.Errorf("%s is in use: %s", d.Path, strings.Join(d.InUse, "; "))
+	}
+	return nil
+}
+
+// blockTree describes the block devices known to the kernel.
+type blockTree struct {
+	// names maps "major:minor" device numbers to device names.
+	names map[string]string
+	// parents maps partitions to the disk they are on.
+	parents map[string]string
+}
+
+func readBlockTree() (*blockTree, error) {
+	entries, err := ioutil.ReadDir(sysClassBlock)
+	if err != nil {
+		return nil, err
+	}
+	t := &blockTree{names: map[string]string{}, parents: map[string]string{}}
+	for _, e := range entries {
+		name := e.Name()
+		dev, err := ioutil.ReadFile(filepath.Join(sysClassBlock, name, "dev"))
+		if err != nil {
+			continue
+		}
+		t.names[strings.TrimSpace(string(dev))] = name
+		// Partitions are listed beneath the disk they are on.
+		if _, err := os.Stat(filepath.Join(sysClassBlock, name, "partition")); err == nil {
+			continue
+		}
+		subs, _ := ioutil.ReadDir(filepath.Join(sysClassBlock, name))
+		for _, s := range subs {
+			if _, err := os.Stat(filepath.Join(sysClassBlock, name, s.Name(), "partition")); err == nil {
+				t.parents[s.Name()] = name
+			}
+		}
+	}
+	return t, nil
+}
+
+// disks returns the disks underlying the named device, following
+// dm & md devices to the devices they are built from.
+func (t *blockTree) disks(name string) []string {
+	if parent, ok := t.parents[name]; ok {
+		return []string{parent}
+	}
+	slaves, _ := ioutil.ReadDir(filepath.Join(sysClassBlock, name, "slaves"))
+	if len(slaves) == 0 {
+		return []string{name}
+	}
+	var out []string
+	for _, s := range slaves {
+		out = append(out, t.disks(s.Name())...)
+	}
+	return out
+}
+
+// holderName describes a device, including the name of dm devices.
+func holderName(name string) string {
+	if d, err := ioutil.ReadFile(filepath.Join(sysClassBlock, name, "dm", "name")); err == nil {
+		return fmt.Sprintf("%s (%s)", name, strings.TrimSpace(string(d)))
+	}
+	return name
+}
+
+// diskUse describes why disks are unsafe to install onto.
+type diskUse struct {
+	reasons map[string][]string
+	live    map[string]bool
+}
+
+func (u *diskUse) add(disk, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	for _, r := range u.reasons[disk] {
+		if r == msg {
+			return
+		}
+	}
+	u.reasons[disk] = append(u.reasons[disk], msg)
+}
+
+// readDiskUse finds the disks holding mounted filesystems, active swap,
+// or devices used by dm or md.
+func readDiskUse() (*diskUse, error) {
+	t, err := readBlockTree()
+	if err != nil {
+		return nil, err
+	}
+	u := &diskUse{reasons: map[string][]string{}, live: map[string]bool{}}
+
+	if err := u.readMounts(t); err != nil {
+		return nil, err
+	}
+	if err := u.readSwaps(t); err != nil {
+		return nil, err
+	}
+
+	// Devices with holders are part of a dm or md device.
+	for _, name := range t.names {
+		holders, _ := ioutil.ReadDir(filepath.Join(sysClassBlock, name, "holders"))
+		for _, h := range holders {
+			for _, disk := range t.disks(name) {
+				u.add(disk, "%s is used by %s", name, holderName(h.Name()))
+			}
+		}
+	}
+	for _, r := range u.reasons {
+		sort.Strings(r)
+	}
+	return u, nil
+}
+
+func (u *diskUse) readMounts(t *blockTree) error {
+	f, err := os.Open(procMountinfo)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Fields are: id, parent id, major:minor, root, mount point, ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		name, ok := t.names[fields[2]]
+		if !ok {
+			continue
+		}
+		mountPoint := unescapeMountinfo(fields[4])
+		isLive := false
+		for _, m := range liveMediumMounts {
+			if mountPoint == m {
+				isLive = true
+			}
+		}
+		for _, disk := range t.disks(name) {
+			if isLive {
+				u.live[disk] = true
+			}
+			u.add(disk, "%s is mounted at %s", holderName(name), mountPoint)
+		}
+	}
+	return s.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes used for whitespace in
+// /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+func (u *diskUse) readSwaps(t *blockTree) error {
+	d, err := ioutil.ReadFile(procSwaps)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := strings.Split(string(d), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue
+		}
+		// Swap on dm devices is listed by its /dev/mapper link.
+		p := fields[0]
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			p = resolved
+		}
+		name := filepath.Base(p)
+		for _, disk := range t.disks(name) {
+			u.add(disk, "%s is in use as swap", holderName(name))
+		}
+	}
+	return nil
+}
+
+// markDisksInUse sets the InUse & LiveMedium fields of disks.
+func markDisksInUse(disks []Disk) error {
+	u, err := readDiskUse()
+	if err != nil {
+		return err
+	}
+	for i := range disks {
+		disks[i].InUse = u.reasons[disks[i].Name]
+		disks[i].LiveMedium = u.live[disks[i].Name]
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// makeFakeSysfs writes a fixture of /sys/class/block, /proc/self/mountinfo
+// & /proc/swaps describing:
+//   - sda, which is unused,
+//   - sdb, the live medium, mounted at /run/live/medium,
+//   - sdc, whose partition holds dm-0 (cryptdata), mounted at /data,
+//   - sdd, whose partition is active swap.
+func makeFakeSysfs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"block/sda/dev":                 "8:0\n",
+		"block/sda/sda1/partition":      "1\n",
+		"block/sda1/dev":                "8:1\n",
+		"block/sda1/partition":          "1\n",
+		"block/sdb/dev":                 "8:16\n",
+		"block/sdb/sdb1/partition":      "1\n",
+		"block/sdb1/dev":                "8:17\n",
+		"block/sdb1/partition":          "1\n",
+		"block/sdc/dev":                 "8:32\n",
+		"block/sdc/sdc1/partition":      "1\n",
+		"block/sdc1/dev":                "8:33\n",
+		"block/sdc1/partition":          "1\n",
+		"block/sdc1/holders/dm-0/.keep": "",
+		"block/dm-0/dev":                "253:0\n",
+		"block/dm-0/dm/name":            "cryptdata\n",
+		"block/dm-0/slaves/sdc1/.keep":  "",
+		"block/sdd/dev":                 "8:48\n",
+		"block/sdd/sdd2/partition":      "2\n",
+		"block/sdd2/dev":                "8:50\n",
+		"block/sdd2/partition":          "2\n",
+		"mountinfo": "22 1 0:20 / / rw,noatime - overlay overlay rw\n" +
+			"25 22 8:17 / /run/live/medium ro,noatime - iso9660 /dev/sdb1 ro\n" +
+			"31 22 253:0 / /data rw,relatime - ext4 /dev/mapper/cryptdata rw\n" +
+			"32 22 0:5 / /dev rw - devtmpfs udev rw\n",
+		"swaps": "Filename\tType\tSize\tUsed\tPriority\n" +
+			"/dev/sdd2 partition\t2097148\t0\t-2\n" +
+			"/swapfile file\t1048572\t0\t-3\n",
+	}
+	writeFiles(t, dir, files)
+
+	oldBlock, oldMountinfo, oldSwaps := sysClassBlock, procMountinfo, procSwaps
+	sysClassBlock = filepath.Join(dir, "block")
+	procMountinfo = filepath.Join(dir, "mountinfo")
+	procSwaps = filepath.Join(dir, "swaps")
+	t.Cleanup(func() {
+		sysClassBlock, procMountinfo, procSwaps = oldBlock, oldMountinfo, oldSwaps
+	})
+}
+
+func TestMarkDisksInUse(t *testing.T) {
+	makeFakeSysfs(t)
+	disks := []Disk{
+		{Name: "sda", Path: "/dev/sda"},
+		{Name: "sdb", Path: "/dev/sdb"},
+		{Name: "sdc", Path: "/dev/sdc"},
+		{Name: "sdd", Path: "/dev/sdd"},
+	}
+	if err := markDisksInUse(disks); err != nil {
+		t.Fatalf("markDisksInUse() failed: %v", err)
+	}
+
+	want := map[string][]string{
+		"sda": nil,
+		"sdb": {"sdb1 is mounted at /run/live/medium"},
+		"sdc": {"dm-0 (cryptdata) is mounted at /data", "sdc1 is used by dm-0 (cryptdata)"},
+		"sdd": {"sdd2 is in use as swap"},
+	}
+	for _, d := range disks {
+		if !reflect.DeepEqual(d.InUse, want[d.Name]) {
+			t.Errorf("%s: InUse = %q, want %q", d.Name, d.InUse, want[d.Name])
+		}
+		if d.LiveMedium != (d.Name == "sdb") {
+			t.Errorf("%s: LiveMedium = %v", d.Name, d.LiveMedium)
+		}
+	}
+
+	tcs := []struct {
+		disk     Disk
+		override bool
+		wantErr  bool
+	}{
+		{disk: disks[0]},
+		{disk: disks[1], wantErr: true},
+		{disk: disks[1], override: true, wantErr: true},
+		{disk: disks[2], wantErr: true},
+		{disk: disks[2], override: true},
+	}
+	for _, tc := range tcs {
+		if err := tc.disk.CheckEligible(tc.override); (err != nil) != tc.wantErr {
+			t.Errorf("%s: CheckEligible(%v) = %v, want error %v", tc.disk.Name, tc.override, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package engine implements installation of TwitchyLinux onto a disk,
+// independent of any user interface.
+//
+// An installation is described by a State, and performed by Run, which
+// executes each of the Steps in turn. Progress is reported as a stream of
+// Update events, which frontends consume to display progress to the user.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// sleep is used to give the kernel & udev time to settle between
+// operations on the disk. Tests replace it to avoid waiting.
+var sleep = time.Sleep
+
+// Steps is the sequence of steps which make up an installation.
+var Steps = []InstallStep{
+	&PartitionStep{},
+	&CopyStep{},
+	&VerifyStep{},
+	&ConfigureStep{},
+	&SnapshotStep{},
+	&CleanupStep{},
+}
+
+// InstallStep is a single stage of the installation.
+type InstallStep interface {
+	// Run performs the step, stopping early if ctx is cancelled.
+	Run(context.Context, chan Update, *State) error
+	// Plan describes the actions Run would perform, without
+	// performing them.
+	Plan(*State) []Action
+	// Weight estimates how long the step takes relative to the
+	// other steps, used to compute overall progress.
+	Weight(*State) int
+	// Idempotent returns true if the step can safely be run again after
+	// it (or a later step) failed part-way, when resuming an installation.
+	Idempotent(*State) bool
+	Name() string
+}
+
+// Reopener is implemented by steps which leave mounts or mappings open
+// for later steps. When an installation is resumed, Reopen re-establishes
+// them for each step which had already completed.
+type Reopener interface {
+	Reopen(context.Context, chan Update, *State) error
+}
+
+// State describes the settings for an installation.
+type State struct {
+	InstallDevice *Disk
+	Pw, User      string
+	PwHash        string
+	Tz, Host      string
+	Scrub         bool
+	Autologin     bool
+	UEFI          bool
+	// Alongside preserves the install device's existing partitions,
+	// installing into free space so other systems can still be booted.
+	Alongside bool
+	// ShrinkPart is the number of an ext4 or NTFS partition to shrink to
+	// ShrinkToMB, making room to install alongside it, or zero.
+	ShrinkPart, ShrinkToMB int
+	// Layout, if set, is the user's layout of the new partitions, which
+	// replaces the default one.
+	Layout []CustomPartition
+	// LVM, if set, splits the encrypted root partition into LVM logical
+	// volumes for root, home & swap.
+	LVM *LVMOptions
+	// RootFS is the filesystem of the root partition (or volumes) in the
+	// default layout: ext4 if empty, or btrfs.
+	RootFS string
+	// OtherOSes are the operating systems found on the disks before
+	// installing, which are added to the boot menu unless the
+	// installation destroys them.
+	OtherOSes []OtherOS
+
+	OptionalPkgs []string
+
+	// CopyWorkers is the number of files copied concurrently, or zero to
+	// use one worker per CPU.
+	CopyWorkers int
+	// Source is the path of a squashfs, filesystem image or tarball
+	// holding the root filesystem to install, or empty to install the
+	// running live system.
+	Source string
+	// SkipVerify disables checking the installed files against the live
+	// media once they have been copied.
+	SkipVerify bool
+
+	// held records the resources created by the installation.
+	held *ledger
+}
+
+// ledger returns the ledger of resources created by the installation.
+func (s *State) ledger() *ledger {
+	if s.held == nil {
+		s.held = &ledger{}
+	}
+	return s.held
+}
+
+// UpdateKind describes the event an Update represents.
+type UpdateKind int
+
+// Kinds of update events.
+const (
+	// KindLog updates carry output from the running step.
+	KindLog UpdateKind = iota
+	// KindStepStarted updates are sent before a step begins.
+	KindStepStarted
+	// KindStepFinished updates are sent when a step completes successfully.
+	KindStepFinished
+	// KindFailed updates are sent when a step fails. No further steps are run.
+	KindFailed
+	// KindFinished is sent once all steps have completed successfully.
+	KindFinished
+	// KindProgress updates report the completion percentage of the
+	// running step & the installation overall.
+	KindProgress
+)
+
+// Update is an event describing the progress of an installation.
+type Update struct {
+	Kind UpdateKind
+	// Step is the 1-indexed step the update relates to, set on
+	// step start, finish & failure events.
+	Step int
+	// Err is the error which caused a KindFailed update.
+	Err error
+
+	// Percent is the overall completion percentage of the installation,
+	// and StepPercent that of the running step. Both are set on
+	// KindProgress updates.
+	Percent     int
+	StepPercent int
+
+	CmdMsg     string
+	InfoMsg    string
+	WarnMsg    string
+	ErrMsg     string
+	IsProgress bool
+}
+
+func progressInfo(updateChan chan Update, fmtStr string, args ...interface{}) {
+	updateChan <- Update{
+		InfoMsg: fmt.Sprintf("  "+fmtStr, args...),
+	}
+}
+
+// progressPercent reports the completion percentage of the running step.
+func progressPercent(updateChan chan Update, percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	updateChan <- Update{Kind: KindProgress, StepPercent: percent}
+}
+
+// every calls fn each interval, until the returned function is called.
+func every(interval time.Duration, fn func()) (stop func()) {
+	stopChan, stopped := make(chan bool), make(chan bool)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stopChan:
+				stopped <- true
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}()
+	return func() {
+		stopChan <- true
+		<-stopped
+	}
+}
+
+// runStep runs a step, relaying its updates to updateChan with the
+// overall progress filled in. doneWeight is the total weight of the
+// steps already completed.
+func runStep(ctx context.Context, updateChan chan Update, state *State, stepIdx, doneWeight, totalWeight int) error {
+	step := Steps[stepIdx]
+	stepChan, relayDone := make(chan Update), make(chan bool)
+	go func() {
+		for u := range stepChan {
+			if u.Kind == KindProgress {
+				u.Step = stepIdx + 1
+				u.Percent = (doneWeight*100 + step.Weight(state)*u.StepPercent) / totalWeight
+			}
+			updateChan <- u
+		}
+		relayDone <- true
+	}()
+
+	err := step.Run(ctx, stepChan, state)
+	close(stepChan)
+	<-relayDone
+	return err
+}
+
+// Run runs each of the install steps in turn, reporting progress
+// on updateChan. If a step fails or ctx is cancelled, the mounts &
+// mappings created so far are released, so the installation can be
+// retried.
+func Run(ctx context.Context, updateChan chan Update, state *State) error {
+	// Any checkpoint is for an earlier installation, which this replaces.
+	if err := removeCheckpoint(); err != nil {
+		return err
+	}
+	return runFrom(ctx, updateChan, state, 0)
+}
+
+// runFrom runs the install steps starting at Steps[from], saving a
+// checkpoint as each completes.
+func runFrom(ctx context.Context, updateChan chan Update, state *State, from int) error {
+	var totalWeight, doneWeight int
+	for i, step := range Steps {
+		totalWeight += step.Weight(state)
+		if i < from {
+			doneWeight += step.Weight(state)
+		}
+	}
+
+	for i := from; i < len(Steps); i++ {
+		step := Steps[i]
+		updateChan <- Update{
+			Kind:   KindStepStarted,
+			Step:   i + 1,
+			CmdMsg: fmt.Sprintf("Starting %s\n", step.Name()),
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = runStep(ctx, updateChan, state, i, doneWeight, totalWeight)
+		}
+		if ctx.Err() != nil {
+			updateChan <- Update{
+				Kind:   KindFailed,
+				Step:   i + 1,
+				Err:    ctx.Err(),
+				ErrMsg: "\nInstallation aborted.\n",
+			}
+			state.ledger().unwind(updateChan)
+			return ctx.Err()
+		}
+		if err != nil {
+			updateChan <- Update{
+				Kind:   KindFailed,
+				Step:   i + 1,
+				Err:    err,
+				ErrMsg: fmt.Sprintf("\nError!: %v\n", err),
+			}
+			state.ledger().unwind(updateChan)
+			return err
+		}
+		doneWeight += step.Weight(state)
+		if err := saveCheckpoint(updateChan, state, i+1); err != nil {
+			updateChan <- Update{
+				WarnMsg: fmt.Sprintf("  Failed to save checkpoint: %v\n", err),
+			}
+		}
+		updateChan <- Update{
+			Kind:   KindStepFinished,
+			Step:   i + 1,
+			CmdMsg: fmt.Sprintf("Finished %s\n", step.Name()),
+		}
+		updateChan <- Update{
+			Kind:        KindProgress,
+			Step:        i + 1,
+			Percent:     doneWeight * 100 / totalWeight,
+			StepPercent: 100,
+		}
+	}
+
+	if err := removeCheckpoint(); err != nil {
+		updateChan <- Update{
+			WarnMsg: fmt.Sprintf("  Failed to remove checkpoint: %v\n", err),
+		}
+	}
+	updateChan <- Update{
+		Kind:    KindFinished,
+		Percent: 100,
+		CmdMsg:  "\nInstallation of TwitchyLinux has finished!!\nYou may now power-cycle your computer & remove installation media.\n",
+	}
+	return nil
+}
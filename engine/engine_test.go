@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errFake = errors.New("fake failure")
+
+// useFakeRunner routes commands to a new FakeRunner, disables sleeps &
+// keeps checkpoints in a temporary directory for the duration of the test.
+func useFakeRunner(t *testing.T) *FakeRunner {
+	fake := &FakeRunner{}
+	oldRunner, oldSleep, oldCheckpoint := CmdRunner, sleep, checkpointPath
+	CmdRunner, sleep = fake, func(time.Duration) {}
+	checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+	t.Cleanup(func() {
+		CmdRunner, sleep, checkpointPath = oldRunner, oldSleep, oldCheckpoint
+	})
+	return fake
+}
+
+// discardUpdates returns a channel which discards all updates sent to it.
+func discardUpdates(t *testing.T) chan Update {
+	updateChan := make(chan Update)
+	go func() {
+		for range updateChan {
+		}
+	}()
+	t.Cleanup(func() { close(updateChan) })
+	return updateChan
+}
+
+// cmdLines returns the command lines of the recorded calls.
+func cmdLines(calls []FakeCall) []string {
+	var out []string
+	for _, c := range calls {
+		out = append(out, strings.Join(c.Argv, " "))
+	}
+	return out
+}
+
+func checkCmdLines(t *testing.T, got []FakeCall, want []string) {
+	t.Helper()
+	if g := cmdLines(got); !reflect.DeepEqual(g, want) {
+		t.Errorf("incorrect commands run:\ngot:\n  %s\nwant:\n  %s", strings.Join(g, "\n  "), strings.Join(want, "\n  "))
+	}
+}
@@ -0,0 +1,10 @@
+package engine
+
+import "os"
+
+// FirmwareIsEFI returns true if the running system was booted
+// by UEFI firmware.
+func FirmwareIsEFI() bool {
+	_, err := os.Stat("/sys/firmware/efi")
+	return err == nil
+}
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UEvent is a device event broadcast by the kernel or udev.
+type UEvent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevType   string
+	Env       map[string]string
+}
+
+// isDisk returns true if the event is for a disk or partition.
+func (e *UEvent) isDisk() bool {
+	return e.Subsystem == "block" && (e.DevType == "disk" || e.DevType == "partition")
+}
+
+// Netlink multicast groups uevents are broadcast to. Kernel events are
+// sent before udev has processed the device, so its symlinks & database
+// entry (which GetDiskInfo relies on) may not exist yet.
+const (
+	ueventKernelGroup = 1
+	ueventUdevGroup   = 2
+)
+
+// udevMagic identifies the header of events broadcast by udev, which is
+// in network byte order.
+const udevMagic = 0xfeedcafe
+
+// ParseUEvent decodes a uevent in either the kernel's format
+// ("action@devpath" followed by KEY=value strings), or udev's (a binary
+// header, followed by KEY=value strings).
+func ParseUEvent(b []byte) (*UEvent, error) {
+	var props []byte
+	switch {
+	case bytes.HasPrefix(b, []byte("libudev\x00")):
+		// The remaining header fields are in host byte order: magic,
+		// header size, properties offset & properties length.
+		if len(b) < 24 {
+			return nil, errors.New("truncated udev header")
+		}
+		if binary.BigEndian.Uint32(b[8:12]) != udevMagic {
+			return nil, errors.New("bad udev header magic")
+		}
+		off, n := binary.LittleEndian.Uint32(b[16:20]), binary.LittleEndian.Uint32(b[20:24])
+		if uint64(off)+uint64(n) > uint64(len(b)) {
+			return nil, errors.New("truncated udev properties")
+		}
+		props = b[off : off+n]
+	default:
+		i := bytes.IndexByte(b, 0)
+		if i < 0 || !bytes.Contains(b[:i], []byte("@")) {
+			return nil, errors.New("not a uevent")
+		}
+		props = b[i+1:]
+	}
+
+	e := &UEvent{Env: map[string]string{}}
+	for _, kv := range strings.Split(string(props), "\x00") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			e.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+	e.Action, e.DevPath = e.Env["ACTION"], e.Env["DEVPATH"]
+	e.Subsystem, e.DevType = e.Env["SUBSYSTEM"], e.Env["DEVTYPE"]
+	if e.Action == "" || e.DevPath == "" {
+		return nil, errors.New("uevent missing ACTION or DEVPATH")
+	}
+	return e, nil
+}
+
+// listenUEvents sends the events broadcast to the udev netlink group
+// until ctx is done.
+func listenUEvents(ctx context.Context) (<-chan *UEvent, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventUdevGroup}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Closing the socket does not interrupt a blocked read, so reads time
+	// out periodically to check whether ctx is done.
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	out := make(chan *UEvent)
+	go func() {
+		defer close(out)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*1024)
+		for ctx.Err() == nil {
+			n, from, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				return
+			}
+			// Only udev itself, as root, may broadcast to the group, but
+			// ignore anything claiming to be from the kernel.
+			if nl, ok := from.(*syscall.SockaddrNetlink); !ok || nl.Pid == 0 {
+				continue
+			}
+			e, err := ParseUEvent(buf[:n])
+			if err != nil {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// DiskUpdate is the list of disks after a disk was added, removed or
+// changed, or the error re-reading them.
+type DiskUpdate struct {
+	Disks []Disk
+	Err   error
+}
+
+// hotplugSettle is how long disk events must stop arriving for before the
+// disks are re-read. Plugging in a disk generates an event per partition,
+// & more as udev probes it.
+var hotplugSettle = 500 * time.Millisecond
+
+// WatchDisks re-reads the disks whenever one is added, removed or
+// changed, until ctx is done. It relies on udev's netlink broadcasts, so
+// needs no other daemon running.
+func WatchDisks(ctx context.Context) (<-chan DiskUpdate, error) {
+	events, err := listenUEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return watchDisks(ctx, events, hotplugSettle, GetDiskInfo), nil
+}
+
+func watchDisks(ctx context.Context, events <-chan *UEvent, settle time.Duration, read func() ([]Disk, error)) <-chan DiskUpdate {
+	out := make(chan DiskUpdate)
+	go func() {
+		defer close(out)
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if !e.isDisk() {
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(settle)
+				} else {
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(settle)
+				}
+				timeout = timer.C
+			case <-timeout:
+				timeout = nil
+				disks, err := read()
+				select {
+				case out <- DiskUpdate{Disks: disks, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestParseUEvent(t *testing.T) {
+	props := "ACTION=add\x00DEVPATH=/devices/pci0000:00/usb1/1-1/host6/target6:0:0/6:0:0:0/block/sdb\x00SUBSYSTEM=block\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SEQNUM=4242\x00"
+
+	header := make([]byte, 40)
+	copy(header, "libudev\x00")
+	binary.BigEndian.PutUint32(header[8:], udevMagic)
+	binary.LittleEndian.PutUint32(header[12:], 40)
+	binary.LittleEndian.PutUint32(header[16:], 40)
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(props)))
+
+	tcs := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+	}{
+		{name: "kernel", msg: []byte("add@/devices/pci0000:00/usb1/1-1/host6/target6:0:0/6:0:0:0/block/sdb\x00" + props)},
+		{name: "udev", msg: append(header, props...)},
+		{name: "truncated udev", msg: header[:30], wantErr: true},
+		{name: "garbage", msg: []byte("hello"), wantErr: true},
+		{name: "missing action", msg: []byte("add@/devices/x\x00SUBSYSTEM=block\x00"), wantErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := ParseUEvent(tc.msg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseUEvent() error = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if e.Action != "add" || e.Subsystem != "block" || e.DevType != "disk" || e.Env["DEVNAME"] != "sdb" {
+				t.Errorf("ParseUEvent() = %+v", e)
+			}
+			if !e.isDisk() {
+				t.Error("isDisk() = false, want true")
+			}
+		})
+	}
+}
+
+func TestWatchDisks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *UEvent)
+	var reads int
+	updates := watchDisks(ctx, events, 20*time.Millisecond, func() ([]Disk, error) {
+		reads++
+		return []Disk{{Name: "sdb"}}, nil
+	})
+
+	// A burst of disk events results in a single re-read, & events for
+	// other devices are ignored.
+	events <- &UEvent{Action: "add", Subsystem: "block", DevType: "disk"}
+	events <- &UEvent{Action: "add", Subsystem: "block", DevType: "partition"}
+	events <- &UEvent{Action: "change", Subsystem: "block", DevType: "disk"}
+	events <- &UEvent{Action: "add", Subsystem: "net"}
+	u := <-updates
+	if u.Err != nil || len(u.Disks) != 1 || u.Disks[0].Name != "sdb" {
+		t.Errorf("update = %+v", u)
+	}
+	if reads != 1 {
+		t.Errorf("disks read %d times, want 1", reads)
+	}
+
+	events <- &UEvent{Action: "add", Subsystem: "usb"}
+	select {
+	case u := <-updates:
+		t.Errorf("unexpected update for a non-disk event: %+v", u)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	events <- &UEvent{Action: "remove", Subsystem: "block", DevType: "disk"}
+	<-updates
+	if reads != 2 {
+		t.Errorf("disks read %d times, want 2", reads)
+	}
+
+	cancel()
+	if _, ok := <-updates; ok {
+		t.Error("updates not closed once the context was done")
+	}
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"context"
+	"strings"
+)
+
+type CleanupStep struct {
+}
+
+// Run releases the mounts & mappings created by the earlier steps.
+func (s *CleanupStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	return installState.ledger().unwind(updateChan)
+}
+
+// Plan describes the filesystems Run will unmount, & the volume group &
+// mappings it will close.
+func (s *CleanupStep) Plan(installState *State) []Action {
+	var out []Action
+	mounts := installMounts(installState)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		out = append(out, Action{Desc: "Unmount " + strings.ToLower(mounts[i].Desc), Argv: []string{"umount", mounts[i].Target}})
+	}
+	plan := installState.PartitionPlan()
+	if plan.VolumeGroup != "" {
+		out = append(out, Action{Desc: "Deactivate LVM volume group " + plan.VolumeGroup, Argv: []string{"vgchange", "-an", plan.VolumeGroup}})
+	}
+	for i := len(plan.Partitions) - 1; i >= 0; i-- {
+		if part := &plan.Partitions[i]; part.Encrypted {
+			out = append(out, Action{Desc: "Close " + strings.ToLower(part.Desc), Argv: []string{"cryptsetup", "luksClose", cryptMapping(part)}})
+		}
+	}
+	return out
+}
+
+// Idempotent returns true, as only the resources still held are released.
+func (s *CleanupStep) Idempotent(installState *State) bool {
+	return true
+}
+
+// Weight estimates the relative duration of the step.
+func (s *CleanupStep) Weight(installState *State) int {
+	return 1
+}
+
+func (s *CleanupStep) Name() string {
+	return "Cleanup"
+}
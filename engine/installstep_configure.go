@@ -0,0 +1,480 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type ConfigureStep struct {
+}
+
+// initramfsResumePath is the initramfs-tools configuration of the device
+// to resume from, relative to the installed system.
+const initramfsResumePath = "etc/initramfs-tools/conf.d/resume"
+
+func getUUID(updateChan chan Update, dev string) (string, error) {
+	cmd := command("lsblk", "--nodeps", "-nr", "-o", "UUID", dev)
+	out, err := cmd.Output()
+	if err != nil {
+		progressInfo(updateChan, "Failing invocation: %q\n", cmd.Args)
+		return "", err
+	}
+	return strings.Trim(string(out), " \t\r\n"), nil
+}
+
+func kernelInfo(updateChan chan Update) (string, string, error) {
+	ff, err := ioutil.ReadDir("/tmp/install_mounts/boot")
+	if err != nil {
+		return "", "", err
+	}
+	for _, f := range ff {
+		progressInfo(updateChan, "Scan file: %q\n", f.Name())
+		if !f.IsDir() && strings.HasPrefix(f.Name(), "vmlinuz-") {
+			return f.Name(), strings.Split(f.Name(), "-")[1], nil
+		}
+	}
+	return "", "", errors.New("could not determine current kernel")
+}
+
+// partitionUUIDs returns the UUIDs of the filesystems (or for encrypted
+// partitions, the LUKS volumes) of the partitions the installed system
+// uses, keyed by partition number.
+func partitionUUIDs(updateChan chan Update, installState *State, plan *PartitionPlan) (map[int]string, error) {
+	out := map[int]string{}
+	for _, part := range plan.sorted() {
+		if part.MountPoint == "" && part.Filesystem != "swap" && !part.Encrypted {
+			continue
+		}
+		uuid, err := getUUID(updateChan, installState.InstallDevice.pathForPartition(part.Num))
+		if err != nil {
+			return nil, err
+		}
+		progressInfo(updateChan, "%s UUID: %q\n", part.Desc, uuid)
+		out[part.Num] = uuid
+	}
+	return out, nil
+}
+
+// rootArgs returns the kernel parameters which mount the root filesystem,
+// given the UUIDs of the partitions' filesystems or LUKS volumes.
+func rootArgs(plan *PartitionPlan, uuids map[int]string) string {
+	var args string
+	if lv := plan.VolumeAt("/"); lv != nil {
+		pv := plan.physicalVolume()
+		args = fmt.Sprintf("cryptdevice=UUID=%s:%s root=%s", uuids[pv.Num], cryptMapping(pv), lv.device(plan.VolumeGroup))
+	} else if root := plan.MountedAt("/"); root.Encrypted {
+		args = fmt.Sprintf("cryptdevice=UUID=%s:%s root=/dev/mapper/%s", uuids[root.Num], cryptMapping(root), cryptMapping(root))
+	} else {
+		args = "root=UUID=" + uuids[root.Num]
+	}
+	if len(plan.Subvolumes) > 0 {
+		// The root subvolume is listed first.
+		args += " rootflags=subvol=" + plan.Subvolumes[0].Name
+	}
+	return args
+}
+
+// initramfsResume returns the initramfs-tools configuration naming the
+// swap volume to resume from after hibernation, which must be found
+// within the volume group as the initramfs unlocks it.
+func initramfsResume(plan *PartitionPlan) string {
+	for i := range plan.Volumes {
+		if lv := &plan.Volumes[i]; lv.Filesystem == "swap" {
+			return "RESUME=" + lv.device(plan.VolumeGroup) + "\n"
+		}
+	}
+	return "RESUME=none\n"
+}
+
+func (s *ConfigureStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	plan := installState.PartitionPlan()
+	uuids, err := partitionUUIDs(updateChan, installState, plan)
+	if err != nil {
+		return err
+	}
+	boot := plan.MountedAt("/boot")
+	if boot == nil || (plan.MountedAt("/") == nil && plan.VolumeAt("/") == nil) {
+		return errors.New("no root or boot partition in the partition plan")
+	}
+
+	// Write out /etc/{fstab,cryptab}
+	fstab := strings.Replace(fstabData, "PARTITION_MOUNTS\n", fstabEntries(plan, uuids), -1)
+	if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/root", "etc/fstab"), []byte(fstab), 0550); err != nil {
+		return err
+	}
+	progressInfo(updateChan, "/etc/fstab written to %q\n", path.Join("/tmp/install_mounts/root", "etc/fstab"))
+	sleep(time.Second)
+
+	crypttab := crypttabEntries(plan, uuids)
+	if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/root", "etc/crypttab"), []byte(crypttab), 0550); err != nil {
+		return err
+	}
+	progressInfo(updateChan, "/etc/crypttab written to %q\n", path.Join("/tmp/install_mounts/root", "etc/crypttab"))
+
+	if plan.VolumeGroup != "" {
+		if err := os.MkdirAll(path.Join("/tmp/install_mounts/root", path.Dir(initramfsResumePath)), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/root", initramfsResumePath), []byte(initramfsResume(plan)), 0644); err != nil {
+			return err
+		}
+		progressInfo(updateChan, "Resume device written to %q\n", path.Join("/tmp/install_mounts/root", initramfsResumePath))
+	}
+
+	// Write out /boot/grub/grub.cfg
+	kernPath, kernVersion, err := kernelInfo(updateChan)
+	if err != nil {
+		return err
+	}
+	progressInfo(updateChan, "Will boot kernel image at %q (%s)\n", kernPath, kernVersion)
+	grubCfg := strings.Replace(grubData, "KERN_IMG_FILENAME", kernPath, -1)
+	grubCfg = strings.Replace(grubCfg, "K_VERS", kernVersion, -1)
+	grubCfg = strings.Replace(grubCfg, "ROOT_ARGS", rootArgs(plan, uuids), -1)
+	grubCfg = strings.Replace(grubCfg, "BOOT_PART_UUID", uuids[boot.Num], -1)
+	grubCfg = strings.Replace(grubCfg, "OTHER_OS_ENTRIES\n", otherOSEntries(installState), -1)
+	if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/boot", "grub/grub.cfg"), []byte(grubCfg), 0550); err != nil {
+		return err
+	}
+	progressInfo(updateChan, "grub.cfg written to %q\n", path.Join("/tmp/install_mounts/boot", "grub/grub.cfg"))
+	sleep(time.Second)
+	progressPercent(updateChan, 5)
+
+	// Run grub-install
+	if installState.UEFI {
+		if err := s.installGrubEFI(ctx, updateChan, installState); err != nil {
+			return err
+		}
+	} else {
+		if err := s.installGrubBIOS(ctx, updateChan, installState); err != nil {
+			return err
+		}
+	}
+	progressInfo(updateChan, "Finished installing bootloader (grub2).\n\n")
+	progressPercent(updateChan, configureChrootStartPercent)
+	if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/root", "etc/hostname"), []byte(installState.Host+"\n"), 0012); err != nil {
+		return err
+	}
+
+	if err := s.runChrootSteps(ctx, updateChan, installState); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join("/tmp/install_mounts/root", "etc/timezone"), []byte(installState.Tz+"\n"), 0012); err != nil {
+		return err
+	}
+	progressInfo(updateChan, "%q written to %q\n", installState.Tz, path.Join("/tmp/install_mounts/root", "etc/timezone"))
+	if err := runCmd(ctx, updateChan, "[TIMEZONE]: Install ", "cp", "/usr/share/zoneinfo/"+installState.Tz, "/tmp/install_mounts/root/etc/localtime"); err != nil {
+		return err
+	}
+	sleep(time.Second)
+	return nil
+}
+
+// otherOSEntries returns the grub.cfg menu entries for the other
+// operating systems kept by the installation.
+func otherOSEntries(installState *State) string {
+	var b strings.Builder
+	for _, o := range installState.BootMenuOSes() {
+		b.WriteString(o.menuEntry())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (s *ConfigureStep) installGrubBIOS(ctx context.Context, updateChan chan Update, installState *State) error {
+	if err := ioutil.WriteFile("/tmp/device.map", []byte("(hd0) "+installState.InstallDevice.Path), 0550); err != nil {
+		return err
+	}
+	argv := grubInstallCmds(installState)[0]
+	return runCmd(ctx, updateChan, "[GRUB-INSTALL]: ", argv[0], argv[1:]...)
+}
+
+func (s *ConfigureStep) installGrubEFI(ctx context.Context, updateChan chan Update, installState *State) error {
+	cmds := grubInstallCmds(installState)
+	// Registering a boot entry in NVRAM fails on some firmware (or when efivars
+	// is not writable), so a failure here is not fatal as long as the
+	// removable-media path below succeeds.
+	if err := runCmd(ctx, updateChan, "[GRUB-INSTALL]: ", cmds[0][0], cmds[0][1:]...); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		updateChan <- Update{
+			WarnMsg: fmt.Sprintf("  Failed to register UEFI boot entry: %v\n", err),
+		}
+	}
+
+	// Also install to the fallback path (\EFI\BOOT\BOOTX64.EFI), which firmware
+	// boots when it has no (or ignores its) NVRAM boot entries.
+	return runCmd(ctx, updateChan, "[GRUB-INSTALL]: ", cmds[1][0], cmds[1][1:]...)
+}
+
+// grubInstallCmds returns the grub-install invocations which install
+// the bootloader.
+func grubInstallCmds(installState *State) [][]string {
+	if !installState.UEFI {
+		return [][]string{
+			{"grub-install", "--no-floppy", "--grub-mkdevicemap=/tmp/device.map",
+				"--boot-directory=/tmp/install_mounts/boot", "--root-directory=/tmp/install_mounts/root",
+				installState.InstallDevice.Path},
+		}
+	}
+	return [][]string{
+		{"grub-install", "--target=x86_64-efi",
+			"--efi-directory=/tmp/install_mounts/boot/efi", "--boot-directory=/tmp/install_mounts/boot",
+			"--bootloader-id=TwitchyLinux"},
+		{"grub-install", "--target=x86_64-efi",
+			"--efi-directory=/tmp/install_mounts/boot/efi", "--boot-directory=/tmp/install_mounts/boot",
+			"--removable", "--no-nvram"},
+	}
+}
+
+// chrootMounts are mounted in the installed system while the chroot
+// commands run, and unmounted in reverse order afterwards.
+var chrootMounts = []struct {
+	Argv   []string
+	Target string
+}{
+	{[]string{"mount", "-v", "--bind", "/dev", "/tmp/install_mounts/root/dev"}, "/tmp/install_mounts/root/dev"},
+	{[]string{"mount", "-vt", "devpts", "devpts", "/tmp/install_mounts/root/dev/pts", "-o", "gid=5,mode=620"}, "/tmp/install_mounts/root/dev/pts"},
+	{[]string{"mount", "-vt", "proc", "proc", "/tmp/install_mounts/root/proc"}, "/tmp/install_mounts/root/proc"},
+	{[]string{"mount", "-vt", "sysfs", "sysfs", "/tmp/install_mounts/root/sys"}, "/tmp/install_mounts/root/sys"},
+	{[]string{"mount", "-vt", "tmpfs", "tmpfs", "/tmp/install_mounts/root/run"}, "/tmp/install_mounts/root/run"},
+	{[]string{"mount", "-v", "--bind", "/tmp/install_mounts/boot", "/tmp/install_mounts/root/boot"}, "/tmp/install_mounts/root/boot"},
+}
+
+// The step progress at the start & end of running the chroot commands.
+const (
+	configureChrootStartPercent = 15
+	configureChrootEndPercent   = 95
+)
+
+// chrootCmd is a command run within the installed system.
+type chrootCmd struct {
+	// Weight is the relative duration of the command, if not 1.
+	Weight int
+	// Msg is logged before the command is run.
+	Msg       string
+	LogPrefix string
+	Argv      []string
+	// Stdin is passed to the command. PlanStdin describes it with any
+	// secrets redacted.
+	Stdin, PlanStdin string
+	// OnlyIf, if set, is run in the installed system first, and the
+	// command is skipped if it fails. It makes commands which cannot be
+	// repeated safe to run again when an install is resumed.
+	OnlyIf []string
+}
+
+func (c chrootCmd) weight() int {
+	if c.Weight == 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+func (s *ConfigureStep) chrootCmds(installState *State) []chrootCmd {
+	var out []chrootCmd
+	plan := installState.PartitionPlan()
+	if plan.VolumeGroup != "" {
+		// The initramfs can only activate the volume group holding the
+		// root volume with the hooks from lvm2.
+		out = append(out, chrootCmd{
+			Msg:       "\n  Checking the installed system supports LVM.\n",
+			LogPrefix: "[INITRAMFS]: ",
+			Argv:      []string{"dpkg", "-s", "lvm2"},
+		})
+	}
+	if len(plan.Subvolumes) > 0 {
+		// btrfs-progs adds the btrfs tools & module to the initramfs.
+		out = append(out, chrootCmd{
+			Msg:       "\n  Checking the installed system supports btrfs.\n",
+			LogPrefix: "[INITRAMFS]: ",
+			Argv:      []string{"dpkg", "-s", "btrfs-progs"},
+		})
+	}
+	out = append(out,
+		// Both of these generate an initramfs, which takes a while.
+		chrootCmd{LogPrefix: "[INITRAMFS]: ", Argv: []string{"dpkg-reconfigure", "--frontend=noninteractive", "cryptsetup-initramfs"}, Weight: 10},
+		chrootCmd{LogPrefix: "[INITRAMFS]: ", Argv: []string{"update-initramfs", "-u", "-v"}, Weight: 10},
+	)
+
+	// The default account is renamed before passwords are set, so that
+	// a resumed install (where the rename has already happened) sets the
+	// password of the same account.
+	if installState.User != "twl" {
+		out = append(out, chrootCmd{
+			Msg:       fmt.Sprintf("\n  Renaming %q -> %q.\n", "twl", installState.User),
+			LogPrefix: "  [SETUP-USER]: ",
+			Argv:      []string{"usermod", "--login", installState.User, "--move-home", "--home", path.Join("/home", installState.User), "twl"},
+			OnlyIf:    []string{"id", "-u", "twl"},
+		}, chrootCmd{
+			LogPrefix: "  [SETUP-USERGROUP]: ",
+			Argv:      []string{"groupmod", "--new-name", installState.User, "twl"},
+			OnlyIf:    []string{"getent", "group", "twl"},
+		})
+	}
+
+	// Account passwords are set from the pre-computed hash if one was provided,
+	// otherwise the disk encryption password is reused.
+	chpasswdArgs, accountPw := []string{"chpasswd", "-c", "SHA512"}, installState.Pw
+	if installState.PwHash != "" {
+		chpasswdArgs, accountPw = []string{"chpasswd", "-e"}, installState.PwHash
+	}
+	out = append(out, chrootCmd{
+		Msg:       "\n  Updating user account setup.\n",
+		Argv:      chpasswdArgs,
+		Stdin:     installState.User + ":" + accountPw + "\n",
+		PlanStdin: installState.User + ":" + redactedPw + "\n",
+	}, chrootCmd{
+		Argv:      chpasswdArgs,
+		Stdin:     "root:" + accountPw + "\n",
+		PlanStdin: "root:" + redactedPw + "\n",
+	})
+
+	if installState.Autologin {
+		out = append(out, chrootCmd{
+			Msg:       "\n  Switching getty@.service with autologin@.service.\n",
+			LogPrefix: "  [SETUP-AUTOLOGIN]: ",
+			Argv:      []string{"cp", "/usr/share/twlinst/autologin-template", "/lib/systemd/system/autologin@.service"},
+		}, chrootCmd{
+			LogPrefix: "  [SETUP-AUTOLOGIN]: ",
+			Argv:      []string{"ln", "-sf", "../autologin@.service", "/lib/systemd/system/getty.target.wants/autologin@tty1.service"},
+		}, chrootCmd{
+			LogPrefix: "  [SETUP-AUTOLOGIN]: ",
+			Argv:      []string{"sed", "-i", "s/USERNAME/" + installState.User + "/g", "/lib/systemd/system/autologin@.service"},
+		})
+	}
+
+	for _, pkg := range installState.OptionalPkgs {
+		out = append(out, chrootCmd{
+			Msg:       "\n",
+			Weight:    5,
+			LogPrefix: "  [INSTALL]: ",
+			Argv:      []string{"bash", "-c", "dpkg -i /deb-pkgs/" + pkg + "/*.deb"},
+		})
+	}
+	return out
+}
+
+func (s *ConfigureStep) runChrootSteps(ctx context.Context, updateChan chan Update, installState *State) error {
+	// Setup a chroot for the update-initramfs command, tearing it down
+	// once the commands have run.
+	mark := installState.ledger().mark()
+	defer installState.ledger().unwindTo(updateChan, mark)
+	for _, m := range chrootMounts {
+		if err := runCmd(ctx, updateChan, "[CHROOT-SETUP]: ", m.Argv[0], m.Argv[1:]...); err != nil {
+			return err
+		}
+		installState.ledger().mounted(m.Target)
+	}
+
+	cmds := s.chrootCmds(installState)
+	var totalWeight, doneWeight int
+	for _, c := range cmds {
+		totalWeight += c.weight()
+	}
+
+	for _, c := range cmds {
+		if c.Msg != "" {
+			progressInfo(updateChan, "%s", c.Msg)
+		}
+		if len(c.OnlyIf) > 0 {
+			check := append([]string{"/tmp/install_mounts/root"}, c.OnlyIf...)
+			if err := commandContext(ctx, "chroot", check...).Run(); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				progressInfo(updateChan, "%sSkipping %v, as %v failed.\n", c.LogPrefix, c.Argv, c.OnlyIf)
+				doneWeight += c.weight()
+				continue
+			}
+		}
+		argv := append([]string{"/tmp/install_mounts/root"}, c.Argv...)
+
+		if c.Stdin == "" {
+			if err := runCmdInteractive(ctx, updateChan, c.LogPrefix, "chroot", argv...); err != nil {
+				return err
+			}
+		} else {
+			cmd := commandContext(ctx, "chroot", argv...)
+			cmd.Stdin = bytes.NewBufferString(c.Stdin)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				progressInfo(updateChan, "  Output: %q\n", out)
+				return err
+			}
+			sleep(time.Second)
+		}
+
+		doneWeight += c.weight()
+		progressPercent(updateChan, configureChrootStartPercent+doneWeight*(configureChrootEndPercent-configureChrootStartPercent)/totalWeight)
+	}
+	return nil
+}
+
+// Plan describes the files Run will write & the commands it will execute.
+func (s *ConfigureStep) Plan(installState *State) []Action {
+	out := []Action{
+		{Desc: "Write filesystem table", Path: "/tmp/install_mounts/root/etc/fstab"},
+		{Desc: "Write encrypted volume table", Path: "/tmp/install_mounts/root/etc/crypttab"},
+	}
+	if installState.PartitionPlan().VolumeGroup != "" {
+		out = append(out, Action{Desc: "Write initramfs resume device", Path: path.Join("/tmp/install_mounts/root", initramfsResumePath)})
+	}
+	out = append(out, Action{Desc: "Write bootloader configuration", Path: "/tmp/install_mounts/boot/grub/grub.cfg"})
+	for _, o := range installState.BootMenuOSes() {
+		out = append(out, Action{Desc: "Add boot menu entry for " + o.Desc()})
+	}
+	if !installState.UEFI {
+		out = append(out, Action{Desc: "Write GRUB device map", Path: "/tmp/device.map"})
+	}
+	for _, argv := range grubInstallCmds(installState) {
+		out = append(out, Action{Desc: "Install bootloader", Argv: argv})
+	}
+	out = append(out, Action{Desc: "Write hostname " + installState.Host, Path: "/tmp/install_mounts/root/etc/hostname"})
+
+	for _, m := range chrootMounts {
+		out = append(out, Action{Desc: "Mount for chroot", Argv: m.Argv})
+	}
+	for _, c := range s.chrootCmds(installState) {
+		desc := "Run in installed system"
+		if len(c.OnlyIf) > 0 {
+			desc += ", if `" + strings.Join(c.OnlyIf, " ") + "` succeeds"
+		}
+		out = append(out, Action{
+			Desc:  desc,
+			Argv:  append([]string{"chroot", "/tmp/install_mounts/root"}, c.Argv...),
+			Stdin: c.PlanStdin,
+		})
+	}
+	for i := len(chrootMounts) - 1; i >= 0; i-- {
+		out = append(out, Action{Desc: "Unmount chroot mount", Argv: []string{"umount", chrootMounts[i].Target}})
+	}
+
+	return append(out,
+		Action{Desc: "Write timezone " + installState.Tz, Path: "/tmp/install_mounts/root/etc/timezone"},
+		Action{Desc: "Install timezone data", Argv: []string{"cp", "/usr/share/zoneinfo/" + installState.Tz, "/tmp/install_mounts/root/etc/localtime"}},
+	)
+}
+
+// Idempotent returns true, as the files are rewritten & commands which
+// cannot be repeated are guarded with OnlyIf.
+func (s *ConfigureStep) Idempotent(installState *State) bool {
+	return true
+}
+
+// Weight estimates the relative duration of the step.
+func (s *ConfigureStep) Weight(installState *State) int {
+	return 25
+}
+
+func (s *ConfigureStep) Name() string {
+	return "Configure system"
+}
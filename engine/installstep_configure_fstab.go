@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+)
+
+const fstabData = `# Begin /etc/fstab
+# file system  mount-point  type     options             dump  fsck
+#                                                              order
+PARTITION_MOUNTS
+proc           /proc        proc     nosuid,noexec,nodev 0     0
+sysfs          /sys         sysfs    nosuid,noexec,nodev 0     0
+devpts         /dev/pts     devpts   gid=5,mode=620      0     0
+tmpfs          /run         tmpfs    defaults            0     0
+devtmpfs       /dev         devtmpfs mode=0755,nosuid    0     0
+# End /etc/fstab
+`
+
+// fstabEntry is a filesystem (or swap space) of the installed system.
+type fstabEntry struct {
+	Dev, MountPoint, Filesystem string
+	// Subvol is the btrfs subvolume mounted, if not the top level.
+	Subvol string
+}
+
+// fstabEntries returns the lines of /etc/fstab which mount the partitions
+// & logical volumes of plan (& enable swap space), given the UUIDs of the
+// partitions' filesystems or LUKS volumes. A btrfs root filesystem is
+// mounted as each of its subvolumes. These are substituted for
+// PARTITION_MOUNTS in fstabData.
+func fstabEntries(plan *PartitionPlan, uuids map[int]string) string {
+	var mounts, swaps []fstabEntry
+	add := func(e fstabEntry) {
+		switch {
+		case e.Filesystem == "swap":
+			swaps = append(swaps, e)
+		case e.MountPoint == "/" && len(plan.Subvolumes) > 0:
+			for _, sv := range plan.Subvolumes {
+				e.MountPoint, e.Subvol = sv.MountPoint, sv.Name
+				mounts = append(mounts, e)
+			}
+		case e.MountPoint != "":
+			mounts = append(mounts, e)
+		}
+	}
+	for _, part := range plan.sorted() {
+		dev := "UUID=" + uuids[part.Num]
+		if part.Encrypted {
+			dev = "/dev/mapper/" + cryptMapping(part)
+		}
+		add(fstabEntry{Dev: dev, MountPoint: part.MountPoint, Filesystem: part.Filesystem})
+	}
+	for i := range plan.Volumes {
+		lv := &plan.Volumes[i]
+		add(fstabEntry{Dev: lv.device(plan.VolumeGroup), MountPoint: lv.MountPoint, Filesystem: lv.Filesystem})
+	}
+	// Parents are mounted before the filesystems beneath them.
+	sort.SliceStable(mounts, func(i, j int) bool { return mounts[i].MountPoint < mounts[j].MountPoint })
+
+	var out string
+	for _, e := range append(mounts, swaps...) {
+		mp, fsType, opts, pass := e.MountPoint, e.Filesystem, "defaults", 2
+		switch {
+		case e.Filesystem == "swap":
+			mp, opts, pass = "none", "sw", 0
+		case e.Filesystem == "fat32" || e.Filesystem == "vfat":
+			fsType, opts = "vfat", "umask=0077"
+		case e.Filesystem == "btrfs":
+			// btrfs is checked as it is mounted, rather than by fsck.
+			opts, pass = btrfsOpts+",noatime", 0
+			if e.Subvol != "" {
+				opts += ",subvol=" + e.Subvol
+			}
+		case mp == "/":
+			pass = 1
+		}
+		out += fmt.Sprintf("%s %s %s %s 0 %d\n", e.Dev, mp, fsType, opts, pass)
+	}
+	return out
+}
+
+// crypttabEntries returns /etc/crypttab, which unlocks the encrypted
+// partitions of plan given the UUIDs of their LUKS volumes. The volume
+// group's partition is unlocked in the initramfs, so the root volume can
+// be found inside it.
+func crypttabEntries(plan *PartitionPlan, uuids map[int]string) string {
+	var out string
+	for _, part := range plan.sorted() {
+		if !part.Encrypted {
+			continue
+		}
+		opts := "luks,discard"
+		if part == plan.physicalVolume() {
+			opts += ",initramfs"
+		}
+		out += fmt.Sprintf("%s UUID=%s none %s\n", cryptMapping(part), uuids[part.Num], opts)
+	}
+	return out
+}
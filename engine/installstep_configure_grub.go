@@ -1,4 +1,4 @@
-package main
+package engine
 
 const grubData = `# Set menu colors
 set menu_color_normal=white/black
@@ -31,24 +31,25 @@ set default=0
 menuentry "TwitchyLinux" {
         echo "Loading TwitchyLinux..."
         search --no-floppy --fs-uuid --set BOOT_PART_UUID
-        linux   /KERN_IMG_FILENAME cryptdevice=UUID=MAIN_PART_UUID:cryptroot root=/dev/mapper/cryptroot apparmor=1 security=apparmor
+        linux   /KERN_IMG_FILENAME ROOT_ARGS apparmor=1 security=apparmor
         initrd /initrd.img-K_VERS
 }
 
 menuentry "Linux K_VERS (rescue)" {
         echo "Loading K_VERS in rescue mode..."
         search --no-floppy --fs-uuid --set BOOT_PART_UUID
-        linux  /KERN_IMG_FILENAME cryptdevice=UUID=MAIN_PART_UUID:cryptroot root=/dev/mapper/cryptroot systemd.unit=rescue.target
+        linux  /KERN_IMG_FILENAME ROOT_ARGS systemd.unit=rescue.target
         initrd /initrd.img-K_VERS
 }
 
 menuentry "Linux K_VERS (emergency)" {
         echo "Loading K_VERS in emergency mode..."
         search --no-floppy --fs-uuid --set BOOT_PART_UUID
-        linux  /KERN_IMG_FILENAME cryptdevice=UUID=MAIN_PART_UUID:cryptroot root=/dev/mapper/cryptroot systemd.unit=emergency.target
+        linux  /KERN_IMG_FILENAME ROOT_ARGS systemd.unit=emergency.target
         initrd /initrd.img-K_VERS
 }
 
+OTHER_OS_ENTRIES
 menuentry "System shutdown" {
         echo "System shutting down..."
         halt
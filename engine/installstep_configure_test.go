@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestConfigureChrootSteps(t *testing.T) {
+	chrootSetup := []string{
+		"mount -v --bind /dev /tmp/install_mounts/root/dev",
+		"mount -vt devpts devpts /tmp/install_mounts/root/dev/pts -o gid=5,mode=620",
+		"mount -vt proc proc /tmp/install_mounts/root/proc",
+		"mount -vt sysfs sysfs /tmp/install_mounts/root/sys",
+		"mount -vt tmpfs tmpfs /tmp/install_mounts/root/run",
+		"mount -v --bind /tmp/install_mounts/boot /tmp/install_mounts/root/boot",
+		"chroot /tmp/install_mounts/root dpkg-reconfigure --frontend=noninteractive cryptsetup-initramfs",
+		"chroot /tmp/install_mounts/root update-initramfs -u -v",
+	}
+	chrootTeardown := []string{
+		"umount /tmp/install_mounts/root/boot",
+		"umount /tmp/install_mounts/root/run",
+		"umount /tmp/install_mounts/root/sys",
+		"umount /tmp/install_mounts/root/proc",
+		"umount /tmp/install_mounts/root/dev/pts",
+		"umount /tmp/install_mounts/root/dev",
+	}
+	setPasswords := []string{
+		"chroot /tmp/install_mounts/root chpasswd -c SHA512",
+		"chroot /tmp/install_mounts/root chpasswd -c SHA512",
+	}
+
+	tcs := []struct {
+		name      string
+		state     State
+		responses map[string]FakeResponse
+		want      []string
+		wantStdin []string
+	}{
+		{
+			name:      "defaults",
+			state:     State{User: "twl", Pw: "hunter2"},
+			want:      setPasswords,
+			wantStdin: []string{"twl:hunter2\n", "root:hunter2\n"},
+		},
+		{
+			name:  "password hash",
+			state: State{User: "twl", Pw: "hunter2", PwHash: "$6$salt$hash"},
+			want: []string{
+				"chroot /tmp/install_mounts/root chpasswd -e",
+				"chroot /tmp/install_mounts/root chpasswd -e",
+			},
+			wantStdin: []string{"twl:$6$salt$hash\n", "root:$6$salt$hash\n"},
+		},
+		{
+			name:  "renamed user",
+			state: State{User: "alice", Pw: "hunter2"},
+			want: append([]string{
+				"chroot /tmp/install_mounts/root id -u twl",
+				"chroot /tmp/install_mounts/root usermod --login alice --move-home --home /home/alice twl",
+				"chroot /tmp/install_mounts/root getent group twl",
+				"chroot /tmp/install_mounts/root groupmod --new-name alice twl",
+			}, setPasswords...),
+			wantStdin: []string{"alice:hunter2\n", "root:hunter2\n"},
+		},
+		{
+			name:  "user already renamed",
+			state: State{User: "alice", Pw: "hunter2"},
+			responses: map[string]FakeResponse{
+				"chroot /tmp/install_mounts/root id -u twl":        {Err: errFake},
+				"chroot /tmp/install_mounts/root getent group twl": {Err: errFake},
+			},
+			want: append([]string{
+				"chroot /tmp/install_mounts/root id -u twl",
+				"chroot /tmp/install_mounts/root getent group twl",
+			}, setPasswords...),
+			wantStdin: []string{"alice:hunter2\n", "root:hunter2\n"},
+		},
+		{
+			name:  "autologin",
+			state: State{User: "twl", Pw: "hunter2", Autologin: true},
+			want: append(setPasswords[:2:2],
+				"chroot /tmp/install_mounts/root cp /usr/share/twlinst/autologin-template /lib/systemd/system/autologin@.service",
+				"chroot /tmp/install_mounts/root ln -sf ../autologin@.service /lib/systemd/system/getty.target.wants/autologin@tty1.service",
+				"chroot /tmp/install_mounts/root sed -i s/USERNAME/twl/g /lib/systemd/system/autologin@.service",
+			),
+			wantStdin: []string{"twl:hunter2\n", "root:hunter2\n"},
+		},
+		{
+			name:  "optional packages",
+			state: State{User: "twl", Pw: "hunter2", OptionalPkgs: []string{"chrome", "vscode"}},
+			want: append(setPasswords[:2:2],
+				"chroot /tmp/install_mounts/root bash -c dpkg -i /deb-pkgs/chrome/*.deb",
+				"chroot /tmp/install_mounts/root bash -c dpkg -i /deb-pkgs/vscode/*.deb",
+			),
+			wantStdin: []string{"twl:hunter2\n", "root:hunter2\n"},
+		},
+		{
+			name:  "renamed user with autologin",
+			state: State{User: "bob", Pw: "hunter2", Autologin: true},
+			want: []string{
+				"chroot /tmp/install_mounts/root id -u twl",
+				"chroot /tmp/install_mounts/root usermod --login bob --move-home --home /home/bob twl",
+				"chroot /tmp/install_mounts/root getent group twl",
+				"chroot /tmp/install_mounts/root groupmod --new-name bob twl",
+				setPasswords[0],
+				setPasswords[1],
+				"chroot /tmp/install_mounts/root cp /usr/share/twlinst/autologin-template /lib/systemd/system/autologin@.service",
+				"chroot /tmp/install_mounts/root ln -sf ../autologin@.service /lib/systemd/system/getty.target.wants/autologin@tty1.service",
+				"chroot /tmp/install_mounts/root sed -i s/USERNAME/bob/g /lib/systemd/system/autologin@.service",
+			},
+			wantStdin: []string{"bob:hunter2\n", "root:hunter2\n"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := useFakeRunner(t)
+			fake.Responses = tc.responses
+			tc.state.InstallDevice = &Disk{Path: "/dev/sdz"}
+
+			if err := (&ConfigureStep{}).runChrootSteps(context.Background(), discardUpdates(t), &tc.state); err != nil {
+				t.Fatalf("runChrootSteps() failed: %v", err)
+			}
+
+			var want []string
+			want = append(want, chrootSetup...)
+			want = append(want, tc.want...)
+			want = append(want, chrootTeardown...)
+			calls := fake.Calls()
+			checkCmdLines(t, calls, want)
+
+			var stdins []string
+			for _, c := range calls {
+				if c.Stdin != "" {
+					stdins = append(stdins, c.Stdin)
+				}
+			}
+			if len(stdins) != len(tc.wantStdin) {
+				t.Fatalf("got stdin %q, want %q", stdins, tc.wantStdin)
+			}
+			for i := range stdins {
+				if stdins[i] != tc.wantStdin[i] {
+					t.Errorf("stdin[%d] = %q, want %q", i, stdins[i], tc.wantStdin[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureChrootStepsFailure(t *testing.T) {
+	fake := useFakeRunner(t)
+	fake.Responses = map[string]FakeResponse{
+		"chroot /tmp/install_mounts/root update-initramfs -u -v": {Stderr: "update-initramfs: failed", Err: errFake},
+	}
+	state := State{User: "twl", Pw: "hunter2", InstallDevice: &Disk{Path: "/dev/sdz"}}
+
+	if err := (&ConfigureStep{}).runChrootSteps(context.Background(), discardUpdates(t), &state); err != errFake {
+		t.Fatalf("runChrootSteps() returned %v, want %v", err, errFake)
+	}
+	// The chroot mounts should still be torn down.
+	checkCmdLines(t, fake.Calls(), []string{
+		"mount -v --bind /dev /tmp/install_mounts/root/dev",
+		"mount -vt devpts devpts /tmp/install_mounts/root/dev/pts -o gid=5,mode=620",
+		"mount -vt proc proc /tmp/install_mounts/root/proc",
+		"mount -vt sysfs sysfs /tmp/install_mounts/root/sys",
+		"mount -vt tmpfs tmpfs /tmp/install_mounts/root/run",
+		"mount -v --bind /tmp/install_mounts/boot /tmp/install_mounts/root/boot",
+		"chroot /tmp/install_mounts/root dpkg-reconfigure --frontend=noninteractive cryptsetup-initramfs",
+		"chroot /tmp/install_mounts/root update-initramfs -u -v",
+		"umount /tmp/install_mounts/root/boot",
+		"umount /tmp/install_mounts/root/run",
+		"umount /tmp/install_mounts/root/sys",
+		"umount /tmp/install_mounts/root/proc",
+		"umount /tmp/install_mounts/root/dev/pts",
+		"umount /tmp/install_mounts/root/dev",
+	})
+}
+
+func TestFstabEntries(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+	plan := NewPartitionPlan(disk, PartitionOptions{UEFI: true, Layout: customLayout()})
+	uuids := map[int]string{1: "b00t", 2: "r00t", 3: "5wap", 4: "h0me", 5: "1A2B-3C4D"}
+
+	want := "UUID=r00t / ext4 defaults 0 1\n" +
+		"UUID=b00t /boot ext4 defaults 0 2\n" +
+		"UUID=1A2B-3C4D /boot/efi vfat umask=0077 0 2\n" +
+		"/dev/mapper/crypt4 /home xfs defaults 0 2\n" +
+		"UUID=5wap none swap sw 0 0\n"
+	if got := fstabEntries(plan, uuids); got != want {
+		t.Errorf("fstabEntries() =\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := crypttabEntries(plan, uuids), "crypt4 UUID=h0me none luks,discard\n"; got != want {
+		t.Errorf("crypttabEntries() = %q, want %q", got, want)
+	}
+	if got, want := rootArgs(plan, uuids), "root=UUID=r00t"; got != want {
+		t.Errorf("rootArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestFstabEntriesLVM(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	plan := NewPartitionPlan(disk, PartitionOptions{LVM: &LVMOptions{RootMB: 20 * 1024, SwapMB: 2048}})
+	uuids := map[int]string{1: "b00t", 2: "1u75"}
+
+	want := "/dev/mapper/twl-root / ext4 defaults 0 1\n" +
+		"UUID=b00t /boot ext4 defaults 0 2\n" +
+		"/dev/mapper/twl-home /home ext4 defaults 0 2\n" +
+		"/dev/mapper/twl-swap none swap sw 0 0\n"
+	if got := fstabEntries(plan, uuids); got != want {
+		t.Errorf("fstabEntries() =\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := crypttabEntries(plan, uuids), "cryptlvm UUID=1u75 none luks,discard,initramfs\n"; got != want {
+		t.Errorf("crypttabEntries() = %q, want %q", got, want)
+	}
+	if got, want := rootArgs(plan, uuids), "cryptdevice=UUID=1u75:cryptlvm root=/dev/mapper/twl-root"; got != want {
+		t.Errorf("rootArgs() = %q, want %q", got, want)
+	}
+	if got, want := initramfsResume(plan), "RESUME=/dev/mapper/twl-swap\n"; got != want {
+		t.Errorf("initramfsResume() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,358 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	ext4Opts  = "journal_checksum,journal_ioprio=0,data=writeback,barrier=0,errors=remount-ro"
+	ext4Flags = syscall.MS_DIRSYNC | syscall.MS_NOSUID | syscall.MS_NOATIME
+)
+
+// sourceRoot is the root of the filesystem tree which is installed. The
+// integration tests point it at a small fake tree.
+var sourceRoot = "/"
+
+type CopyStep struct {
+}
+
+func (s *CopyStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	if err := os.Mkdir("/tmp/install_mounts", 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Mkdir("/tmp/install_mounts/root", 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Mkdir("/tmp/install_mounts/boot", 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	sleep(1 * time.Second)
+
+	for _, m := range installMounts(installState) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.mount(updateChan, installState, m); err != nil {
+			return err
+		}
+	}
+
+	if err := s.CreateSysPaths(ctx, updateChan, installState); err != nil {
+		return err
+	}
+
+	// Tarballs are unpacked onto the root filesystem, so the source is
+	// opened once it is mounted.
+	root, err := openSource(ctx, updateChan, installState)
+	if err != nil {
+		return err
+	}
+
+	progressInfo(updateChan, "[BOOT]: Install %s -> %s\n", path.Join(root, "boot/boot"), "/tmp/install_mounts/boot")
+	bootCopier := copier{Workers: copyWorkers(installState)}
+	if err := bootCopier.Copy(ctx, path.Join(root, "boot/boot"), "/tmp/install_mounts/boot"); err != nil {
+		return err
+	}
+
+	progressPercent(updateChan, copyMountsPercent)
+	return s.copyRootFS(ctx, updateChan, installState, root)
+}
+
+// copyMountsPercent is the step progress once the filesystems are mounted
+// & the boot files copied.
+const copyMountsPercent = 5
+
+// copyWorkers returns the number of files to copy concurrently.
+func copyWorkers(installState *State) int {
+	if installState.CopyWorkers > 0 {
+		return installState.CopyWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// copyRootFS copies the root filesystem from the source tree at root,
+// reporting the files & bytes copied as it goes.
+func (s *CopyStep) copyRootFS(ctx context.Context, updateChan chan Update, installState *State, root string) error {
+	m, err := loadCopyManifest(root)
+	if err != nil {
+		return err
+	}
+	var entries []CopyEntry
+	var totalBytes, totalFiles int64
+	for _, e := range m.Entries {
+		if _, err := os.Lstat(path.Join(root, e.From)); err != nil {
+			if os.IsNotExist(err) && e.Optional {
+				progressInfo(updateChan, "[ROOT]: Skipping %s, which is not present\n", e.From)
+				continue
+			}
+			return err
+		}
+		entries = append(entries, e)
+		b, f := treeSize(path.Join(root, e.From), m.excluder(e))
+		totalBytes += b
+		totalFiles += f
+	}
+	progressInfo(updateChan, "Copying %d files (%s) using %d workers.\n", totalFiles, ByteCountDecimal(totalBytes), copyWorkers(installState))
+
+	c := copier{Workers: copyWorkers(installState)}
+	report := func() {
+		files, copied := atomic.LoadInt64(&c.Files), atomic.LoadInt64(&c.Bytes)
+		updateChan <- Update{
+			InfoMsg:    fmt.Sprintf("  [ROOT]: Copied %d/%d files, %s/%s\n", files, totalFiles, ByteCountDecimal(copied), ByteCountDecimal(totalBytes)),
+			IsProgress: true,
+		}
+		if totalBytes > 0 {
+			// Hold back the last percent until the copy has finished.
+			progressPercent(updateChan, copyMountsPercent+int(copied*(99-copyMountsPercent)/totalBytes))
+		}
+	}
+
+	defer every(time.Second, report)()
+
+	for _, e := range entries {
+		src, dst := path.Join(root, e.From), path.Join("/tmp/install_mounts/root", e.target())
+		progressInfo(updateChan, "[ROOT]: Install %s -> %s\n", src, dst)
+		// The progress line is replaced by later updates.
+		report()
+		m.configure(&c, e)
+		if err := c.Copy(ctx, src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeSize returns the total size & number of the files under p,
+// counting hardlinked files once. If exclude is set, files for which it
+// returns true (given their path relative to p) are not counted.
+func treeSize(p string, exclude func(rel string) bool) (int64, int64) {
+	var size, files int64
+	seen := map[fileID]bool{}
+	filepath.Walk(p, func(f string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if exclude != nil {
+			if rel, err := filepath.Rel(p, f); err == nil && exclude(filepath.ToSlash(rel)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		files++
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			id := fileID{Dev: uint64(st.Dev), Ino: st.Ino}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, files
+}
+
+// installMount is a filesystem of the installed system, on a partition
+// or logical volume, & where it is mounted while installing.
+type installMount struct {
+	Dev, MountPoint, Filesystem, Desc string
+	Target                            string
+	// Subvol is the btrfs subvolume mounted, if not the top level.
+	Subvol string
+}
+
+// installMounts returns the filesystems mounted while installing, in the
+// order they are mounted: the boot partition & the EFI system partition
+// within it, then the root filesystem & the filesystems mounted beneath
+// it, parents first. A btrfs root filesystem is mounted as each of its
+// subvolumes.
+func installMounts(installState *State) []installMount {
+	plan := installState.PartitionPlan()
+	var out []installMount
+	add := func(m installMount) {
+		if m.MountPoint != "/" || len(plan.Subvolumes) == 0 {
+			out = append(out, m)
+			return
+		}
+		for _, sv := range plan.Subvolumes {
+			svm := m
+			svm.MountPoint, svm.Subvol = sv.MountPoint, sv.Name
+			if sv.MountPoint != "/" {
+				svm.Desc = sv.Name + " subvolume"
+			}
+			out = append(out, svm)
+		}
+	}
+	for i := range plan.Partitions {
+		if part := &plan.Partitions[i]; part.MountPoint != "" {
+			add(installMount{Dev: fsDevice(installState, part), MountPoint: part.MountPoint, Filesystem: part.Filesystem, Desc: part.Desc})
+		}
+	}
+	for i := range plan.Volumes {
+		if lv := &plan.Volumes[i]; lv.MountPoint != "" {
+			add(installMount{Dev: lv.device(plan.VolumeGroup), MountPoint: lv.MountPoint, Filesystem: lv.Filesystem, Desc: lv.Desc})
+		}
+	}
+
+	// The boot filesystems are mounted outside the root filesystem, which
+	// comes next. A mount point sorts after those of its parents.
+	rank := func(m installMount) int {
+		switch m.MountPoint {
+		case "/boot":
+			return 0
+		case "/boot/efi":
+			return 1
+		case "/":
+			return 2
+		}
+		return 3
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if ri, rj := rank(out[i]), rank(out[j]); ri != rj {
+			return ri < rj
+		}
+		return out[i].MountPoint < out[j].MountPoint
+	})
+	for i := range out {
+		switch out[i].MountPoint {
+		case "/boot":
+			out[i].Target = "/tmp/install_mounts/boot"
+		case "/boot/efi":
+			out[i].Target = "/tmp/install_mounts/boot/efi"
+		default:
+			out[i].Target = path.Join("/tmp/install_mounts/root", out[i].MountPoint)
+		}
+	}
+	return out
+}
+
+// mountOpts returns the filesystem type, flags & options a filesystem is
+// mounted with while installing.
+func mountOpts(fs string) (string, uintptr, string) {
+	switch fs {
+	case "ext4":
+		return "ext4", ext4Flags, ext4Opts
+	case "fat32", "vfat":
+		return "vfat", syscall.MS_NOSUID | syscall.MS_NOATIME, "umask=0077"
+	case "btrfs":
+		return "btrfs", syscall.MS_NOSUID | syscall.MS_NOATIME, btrfsOpts
+	}
+	return fs, syscall.MS_NOSUID | syscall.MS_NOATIME, ""
+}
+
+func (s *CopyStep) mount(updateChan chan Update, installState *State, m installMount) error {
+	if err := os.MkdirAll(m.Target, 0755); err != nil {
+		return err
+	}
+	fsType, flags, opts := mountOpts(m.Filesystem)
+	if m.Subvol != "" {
+		opts += ",subvol=" + m.Subvol
+	}
+	progressInfo(updateChan, "\n  Mounting %s -> %s\n    Opts: %q\n", m.Dev, m.Target, opts)
+	if err := syscall.Mount(m.Dev, m.Target, fsType, flags, opts); err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %v", m.Desc, m.MountPoint, err)
+	}
+	installState.ledger().mounted(m.Target)
+	progressInfo(updateChan, "Mounted %s.\n", m.MountPoint)
+	sleep(1 * time.Second)
+	return nil
+}
+
+// Reopen remounts the filesystems Run mounted, when resuming an
+// installation after the step has completed.
+func (s *CopyStep) Reopen(ctx context.Context, updateChan chan Update, installState *State) error {
+	for _, m := range installMounts(installState) {
+		if err := s.mount(updateChan, installState, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Idempotent returns true, as the copy overwrites any files copied by an
+// earlier run.
+func (s *CopyStep) Idempotent(installState *State) bool {
+	return true
+}
+
+// sysPathCmds create the mount points & device nodes needed to boot
+// the installed system.
+var sysPathCmds = []struct {
+	LogPrefix string
+	Argv      []string
+}{
+	{"[ROOT]: Create ", []string{"mkdir", "-p", "/tmp/install_mounts/root/dev", "/tmp/install_mounts/root/proc"}},
+	{"[ROOT]: Create ", []string{"mkdir", "-p", "/tmp/install_mounts/root/sys", "/tmp/install_mounts/root/run"}},
+	{"[ROOT]: Create ", []string{"mkdir", "-p", "/tmp/install_mounts/root/media", "/tmp/install_mounts/root/mnt"}},
+	{"[ROOT]: Create ", []string{"mkdir", "-p", "/tmp/install_mounts/root/tmp", "/tmp/install_mounts/root/boot"}},
+	{"[ROOT]: Mknod ", []string{"mknod", "-m", "600", "/tmp/install_mounts/root/dev/console", "c", "5", "1"}},
+	{"[ROOT]: Mknod ", []string{"mknod", "-m", "600", "/tmp/install_mounts/root/dev/null", "c", "1", "3"}},
+}
+
+func (s *CopyStep) CreateSysPaths(ctx context.Context, updateChan chan Update, installState *State) error {
+	for _, c := range sysPathCmds {
+		if err := runCmd(ctx, updateChan, c.LogPrefix, c.Argv[0], c.Argv[1:]...); err != nil {
+			return err
+		}
+	}
+
+	sleep(1 * time.Second)
+	return nil
+}
+
+// Plan describes the mounts & copies Run will perform.
+func (s *CopyStep) Plan(installState *State) []Action {
+	var out []Action
+	for _, m := range installMounts(installState) {
+		out = append(out, Action{Desc: fmt.Sprintf("Mount %s (%s) from %s", m.MountPoint, strings.ToLower(m.Desc), m.Dev), Path: m.Target})
+	}
+	for _, c := range sysPathCmds {
+		out = append(out, Action{Desc: "Create system paths", Argv: c.Argv})
+	}
+
+	src := sourceFor(installState.Source)
+	out = append(out, src.Plan()...)
+	out = append(out, Action{Desc: "Install boot files from " + src.Desc(), Path: "/tmp/install_mounts/boot"})
+	if _, ok := src.(liveSource); !ok {
+		// The image's copy manifest can't be read until it is opened.
+		return append(out, Action{Desc: "Install the files listed in " + copyManifestPath + " from " + src.Desc(), Path: "/tmp/install_mounts/root"})
+	}
+	m, err := loadCopyManifest(sourceRoot)
+	if err != nil {
+		return append(out, Action{Desc: "Invalid copy manifest: " + err.Error()})
+	}
+	for _, e := range m.Entries {
+		desc := "Install " + e.From + " from " + src.Desc()
+		if e.Optional {
+			desc += " (if present)"
+		}
+		out = append(out, Action{Desc: desc, Path: path.Join("/tmp/install_mounts/root", e.target())})
+	}
+	return out
+}
+
+// Weight estimates the relative duration of the step.
+func (s *CopyStep) Weight(installState *State) int {
+	return 60
+}
+
+func (s *CopyStep) Name() string {
+	return "Copy files"
+}
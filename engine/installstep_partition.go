@@ -0,0 +1,428 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// blockSize is the unit sysfs reports device sizes in, whatever the
+	// sector size of the device.
+	blockSize = 512
+
+	bootPartSizeMB     = 256
+	metadataPartSizeMB = 64
+	espPartSizeMB      = 128
+
+	// espPartNum is the partition number of the EFI system partition,
+	// which is only present in the UEFI layout.
+	espPartNum = 4
+)
+
+// diskOp is a command run against the install device by PartitionStep.
+type diskOp struct {
+	Desc string
+	Argv []string
+	// NeedsPw is set if the password is provided on stdin.
+	NeedsPw bool
+	// Stdin is the input to the command, if not the password.
+	Stdin string
+	// Progress is set if the command's output is a progress display, of
+	// the bytes written out of ProgressBytes.
+	Progress      bool
+	ProgressBytes int64
+	// Settle is how long to wait after the command, for the kernel & udev
+	// to catch up.
+	Settle time.Duration
+	// Opens is the name of the dm-crypt mapping the command opens, if any.
+	Opens string
+	// Activates is the name of the LVM volume group the command creates &
+	// activates, if any.
+	Activates string
+	// Mounts is where the command mounts a filesystem, if it does.
+	Mounts string
+	// Unmounts is where the command unmounts a filesystem, if it does.
+	Unmounts string
+	// Weight is the relative duration of the command, if not 1.
+	Weight int
+}
+
+func (op diskOp) weight() int {
+	if op.Weight == 0 {
+		return 1
+	}
+	return op.Weight
+}
+
+// PartitionPlan returns the partition table to be created on the install
+// device.
+func (s *State) PartitionPlan() *PartitionPlan {
+	return NewPartitionPlan(s.InstallDevice, PartitionOptions{
+		UEFI:       s.UEFI,
+		Alongside:  s.Alongside,
+		Shrink:     s.ShrinkPart,
+		ShrinkToMB: s.ShrinkToMB,
+		Layout:     s.Layout,
+		LVM:        s.LVM,
+		RootFS:     s.RootFS,
+	})
+}
+
+// fsDevice returns the device holding the partition's filesystem: its
+// dm-crypt mapping if it is encrypted.
+func fsDevice(installState *State, part *PlannedPartition) string {
+	if part.Encrypted {
+		return "/dev/mapper/" + cryptMapping(part)
+	}
+	return installState.InstallDevice.pathForPartition(part.Num)
+}
+
+// cryptMapping returns the name of the dm-crypt mapping an encrypted
+// partition is opened as.
+func cryptMapping(part *PlannedPartition) string {
+	switch {
+	case part.MountPoint == "/":
+		return "cryptroot"
+	case part.Filesystem == "lvm":
+		return "cryptlvm"
+	}
+	return fmt.Sprintf("crypt%d", part.Num)
+}
+
+// mkfsArgv returns the command which creates a filesystem of type fs
+// with label (if set) on dev.
+func mkfsArgv(fs, label, dev string) []string {
+	switch fs {
+	case "fat32":
+		argv := []string{"mkfs.vfat", "-F", "32"}
+		if label != "" {
+			argv = append(argv, "-n", label)
+		}
+		return append(argv, dev)
+	case "swap":
+		argv := []string{"mkswap"}
+		if label != "" {
+			argv = append(argv, "-L", label)
+		}
+		return append(argv, dev)
+	case "xfs", "btrfs":
+		argv := []string{"mkfs." + fs, "-f"}
+		if label != "" {
+			argv = append(argv, "-L", label)
+		}
+		return append(argv, dev)
+	default:
+		argv := []string{"mkfs." + fs, "-qF"}
+		if label != "" {
+			argv = append(argv, "-L", label)
+		}
+		return append(argv, dev)
+	}
+}
+
+// shrinkOps returns the commands which shrink part's filesystem, then
+// the partition itself.
+func shrinkOps(plan *PartitionPlan, part *PlannedPartition, dev *Disk) []diskOp {
+	partDev := dev.pathForPartition(part.Num)
+	size := plan.Bytes(part.Sectors())
+	var ops []diskOp
+	switch part.Filesystem {
+	case "ext4":
+		// resize2fs refuses to shrink a filesystem not checked since it
+		// was last mounted. e2fsck fails if it had to repair anything,
+		// stopping the installation before the disk is changed further.
+		ops = append(ops, diskOp{
+			Desc:   "Checking filesystem on " + partDev,
+			Argv:   []string{"e2fsck", "-f", "-p", partDev},
+			Weight: 5,
+		}, diskOp{
+			Desc:   fmt.Sprintf("Shrinking filesystem on %s to %s", partDev, ByteCountDecimal(size)),
+			Argv:   []string{"resize2fs", partDev, fmt.Sprintf("%dK", size/1024)},
+			Weight: 10,
+		})
+	case "ntfs":
+		ops = append(ops, diskOp{
+			Desc:   fmt.Sprintf("Shrinking filesystem on %s to %s", partDev, ByteCountDecimal(size)),
+			Argv:   []string{"ntfsresize", "--size", strconv.FormatInt(size, 10), partDev},
+			Stdin:  "y\n", // Confirms the resize.
+			Weight: 10,
+		})
+	}
+	return append(ops, diskOp{
+		Desc:   fmt.Sprintf("Shrinking partition %d", part.Num),
+		Argv:   []string{"sfdisk", "-N", strconv.Itoa(part.Num), dev.Path},
+		Stdin:  fmt.Sprintf("start=%d, size=%d\n", part.StartSector, part.Sectors()),
+		Settle: time.Second,
+	})
+}
+
+// ops returns the commands which apply the partition plan: writing the
+// table (or shrinking a partition & appending to the existing table),
+// then creating each new partition's filesystem (inside a LUKS volume if
+// encrypted), or for an LVM partition, its logical volumes. Last, the
+// subvolumes of a btrfs root filesystem are created.
+func (s *PartitionStep) ops(installState *State) []diskOp {
+	dev := installState.InstallDevice
+	plan := installState.PartitionPlan()
+	var ops []diskOp
+	if plan.Alongside {
+		for i := range plan.Partitions {
+			if part := &plan.Partitions[i]; part.OldEndSector != 0 {
+				ops = append(ops, shrinkOps(plan, part, dev)...)
+			}
+		}
+		ops = append(ops, diskOp{
+			Desc:   "Adding partitions to the partition table",
+			Argv:   []string{"sfdisk", "--append", "--wipe-partitions", "always", dev.Path},
+			Stdin:  plan.sfdiskScript(),
+			Settle: time.Second,
+		})
+	} else {
+		ops = append(ops, diskOp{
+			Desc:   "Writing partition table",
+			Argv:   []string{"sfdisk", "--wipe", "always", "--wipe-partitions", "always", dev.Path},
+			Stdin:  plan.sfdiskScript(),
+			Settle: time.Second,
+		})
+	}
+	ops = append(ops, diskOp{
+		Desc:   "Probing " + dev.Path,
+		Argv:   []string{"partprobe", dev.Path},
+		Settle: 3 * time.Second,
+	})
+
+	for i := range plan.Partitions {
+		part := &plan.Partitions[i]
+		if part.Existing {
+			continue
+		}
+		partDev := dev.pathForPartition(part.Num)
+		if part.Encrypted {
+			mapping := cryptMapping(part)
+			ops = append(ops, diskOp{
+				Desc: "Creating encrypted filesystem on " + partDev,
+				Argv: []string{"cryptsetup", "luksFormat", "--type", "luks2", partDev, "--key-file", "-",
+					"--hash", "sha256", "--cipher", "aes-xts-plain64", "--key-size", "512", "--iter-time", "2600", "--use-random"},
+				NeedsPw: true,
+				Settle:  time.Second,
+			}, diskOp{
+				Desc:    fmt.Sprintf("Unlocking %s filesystem", part.Name),
+				Argv:    []string{"cryptsetup", "luksOpen", "--key-file", "-", partDev, mapping},
+				NeedsPw: true,
+				Opens:   mapping,
+				Settle:  time.Second,
+			})
+			partDev = "/dev/mapper/" + mapping
+			if installState.Scrub {
+				ops = append(ops, diskOp{
+					Desc:          "Scrubbing encrypted partition",
+					Argv:          []string{"dd", "if=/dev/zero", "of=" + partDev, "bs=1M", "status=progress"},
+					Progress:      true,
+					ProgressBytes: plan.Bytes(part.Sectors()) - luksHeaderMB*mib,
+					Weight:        50,
+				})
+			}
+		}
+		if part.Filesystem == "lvm" {
+			ops = append(ops, lvmOps(plan, partDev)...)
+			continue
+		}
+		ops = append(ops, diskOp{
+			Desc:   fmt.Sprintf("Creating %s filesystem on %s", strings.ToUpper(part.Filesystem), partDev),
+			Argv:   mkfsArgv(part.Filesystem, part.Label, partDev),
+			Settle: time.Second,
+		})
+	}
+	if len(plan.Subvolumes) > 0 {
+		ops = append(ops, subvolumeOps(plan, rootDevice(installState, plan))...)
+	}
+	return ops
+}
+
+type PartitionStep struct {
+}
+
+func (s *PartitionStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	progressInfo(updateChan, "Partitioning %q\n", installState.InstallDevice.Path)
+	dev := installState.InstallDevice
+	progressInfo(updateChan, "Device has a capacity of %s, with %d-byte logical & %d-byte physical sectors\n", ByteCountDecimal(dev.SizeBytes()), dev.logicalBlockSize(), dev.physicalBlockSize())
+	plan := installState.PartitionPlan()
+	if err := plan.Validate(); err != nil {
+		return fmt.Errorf("cannot install to %s: %v", dev.Path, err)
+	}
+	if plan.Alongside {
+		progressInfo(updateChan, "\n  Installing alongside the existing partitions:\n")
+	} else {
+		progressInfo(updateChan, "\n  New %s partition table:\n", plan.Table)
+	}
+	for _, p := range plan.Partitions {
+		progressInfo(updateChan, "    %-7s %s (%s, %s)\n", "["+strings.ToUpper(p.Filesystem)+"]", p.Desc, ByteCountDecimal(plan.Bytes(p.Sectors())), strings.ToLower(p.Change()))
+	}
+	for _, lv := range plan.Volumes {
+		progressInfo(updateChan, "      %-7s %s (%s)\n", "["+strings.ToUpper(lv.Filesystem)+"]", lv.Desc, ByteCountDecimal(lv.Bytes))
+	}
+	for _, sv := range plan.Subvolumes {
+		progressInfo(updateChan, "      %-7s Subvolume %s, mounted at %s\n", "[BTRFS]", sv.Name, sv.MountPoint)
+	}
+
+	ops := s.ops(installState)
+	var totalWeight, doneWeight int
+	for _, op := range ops {
+		totalWeight += op.weight()
+	}
+
+	for _, op := range ops {
+		progressInfo(updateChan, "\n  %s\n", op.Desc)
+		progressInfo(updateChan, "  Invocation: %v\n", op.Argv)
+		cmd := commandContext(ctx, op.Argv[0], op.Argv[1:]...)
+		if op.NeedsPw {
+			cmd.Stdin = bytes.NewReader([]byte(installState.Pw))
+		} else if op.Stdin != "" {
+			cmd.Stdin = strings.NewReader(op.Stdin)
+		}
+
+		if op.Progress {
+			startWeight, opWeight := doneWeight, op.weight()
+			scrubBytes := op.ProgressBytes
+			var full bool
+			cmd.Stdout = &cmdInteractiveWriter{
+				updateChan: updateChan,
+				logPrefix:  "  ",
+				IsProgress: true,
+				ParsePercent: func(line string) (int, bool) {
+					if strings.Contains(line, ddFullMsg) {
+						full = true
+					}
+					n, ok := parseDDBytes(line)
+					if !ok || scrubBytes <= 0 {
+						return 0, false
+					}
+					return int((int64(startWeight)*scrubBytes + int64(opWeight)*n) * 100 / (int64(totalWeight) * scrubBytes)), true
+				},
+			}
+			cmd.Stderr = cmd.Stdout
+			// dd fails once it has filled the device, which is intended;
+			// any other failure (including failing to start) is not.
+			if err := cmd.Run(); err != nil && !full {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		} else {
+			out, err := cmd.CombinedOutput()
+			progressInfo(updateChan, "  Output: %q\n", string(out))
+			if err != nil {
+				return err
+			}
+			if op.Opens != "" {
+				installState.ledger().mapped(op.Opens)
+			}
+			if op.Activates != "" {
+				installState.ledger().activated(op.Activates)
+			}
+			if op.Mounts != "" {
+				installState.ledger().mounted(op.Mounts)
+			}
+			if op.Unmounts != "" {
+				installState.ledger().unmounted(op.Unmounts)
+			}
+		}
+		sleep(op.Settle)
+
+		doneWeight += op.weight()
+		progressPercent(updateChan, doneWeight*100/totalWeight)
+	}
+	return nil
+}
+
+// ddFullMsg is the error dd reports once it has filled the device.
+const ddFullMsg = "No space left on device"
+
+// parseDDBytes parses the number of bytes written from a line of
+// dd status=progress output, such as:
+//
+//	1073741824 bytes (1.1 GB, 1.0 GiB) copied, 5 s, 215 MB/s
+func parseDDBytes(line string) (int64, bool) {
+	// Progress updates are separated by carriage returns; use the latest.
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	f := strings.Fields(line)
+	if len(f) < 2 || f[1] != "bytes" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(f[0], 10, 64)
+	return n, err == nil
+}
+
+// Reopen re-opens the encrypted partitions & activates the volume group
+// in them, when resuming an installation after the step has completed.
+func (s *PartitionStep) Reopen(ctx context.Context, updateChan chan Update, installState *State) error {
+	for _, op := range s.ops(installState) {
+		if op.Opens == "" && op.Activates == "" {
+			continue
+		}
+		var cmd *Cmd
+		if op.Opens != "" {
+			progressInfo(updateChan, "\n  Re-opening %s\n", op.Opens)
+			cmd = commandContext(ctx, op.Argv[0], op.Argv[1:]...)
+			cmd.Stdin = bytes.NewReader([]byte(installState.Pw))
+		} else {
+			progressInfo(updateChan, "\n  Activating %s\n", op.Activates)
+			cmd = commandContext(ctx, "vgchange", "-ay", op.Activates)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			progressInfo(updateChan, "  Output: %q\n", string(out))
+			return err
+		}
+		if op.Opens != "" {
+			installState.ledger().mapped(op.Opens)
+		} else {
+			installState.ledger().activated(op.Activates)
+		}
+		sleep(op.Settle)
+	}
+	return nil
+}
+
+// Idempotent returns false: partitioning destroys the data written by
+// any later step.
+func (s *PartitionStep) Idempotent(installState *State) bool {
+	return false
+}
+
+// Weight estimates the relative duration of the step; scrubbing writes
+// to the whole disk, so dominates the install time.
+func (s *PartitionStep) Weight(installState *State) int {
+	if installState.Scrub {
+		return 60
+	}
+	return 5
+}
+
+// Plan describes the partition table & commands Run will execute.
+func (s *PartitionStep) Plan(installState *State) []Action {
+	plan := installState.PartitionPlan()
+	desc := fmt.Sprintf("Create %s partition table on %s", plan.Table, installState.InstallDevice.Path)
+	if plan.Alongside {
+		desc = fmt.Sprintf("Add partitions to the %s partition table on %s", plan.Table, installState.InstallDevice.Path)
+	}
+	out := []Action{{Desc: desc, PartitionPlan: plan}}
+	for _, op := range s.ops(installState) {
+		a := Action{Desc: op.Desc, Argv: op.Argv, Stdin: op.Stdin}
+		if op.NeedsPw {
+			a.Stdin = redactedPw
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func (s *PartitionStep) Name() string {
+	return "Format disk"
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPartitionStep(t *testing.T) {
+	tcs := []struct {
+		name  string
+		state State
+		want  []string
+	}{
+		{
+			name:  "no scrub",
+			state: State{Pw: "hunter2"},
+			want: []string{
+				"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+				"partprobe /dev/sdz",
+				"mkfs.ext4 -qF /dev/sdz1",
+				"cryptsetup luksFormat --type luks2 /dev/sdz2 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+				"cryptsetup luksOpen --key-file - /dev/sdz2 cryptroot",
+				"mkfs.ext4 -qF /dev/mapper/cryptroot",
+				"mkfs.ext4 -qF /dev/sdz3",
+			},
+		},
+		{
+			name:  "scrub",
+			state: State{Pw: "hunter2", Scrub: true},
+			want: []string{
+				"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+				"partprobe /dev/sdz",
+				"mkfs.ext4 -qF /dev/sdz1",
+				"cryptsetup luksFormat --type luks2 /dev/sdz2 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+				"cryptsetup luksOpen --key-file - /dev/sdz2 cryptroot",
+				"dd if=/dev/zero of=/dev/mapper/cryptroot bs=1M status=progress",
+				"mkfs.ext4 -qF /dev/mapper/cryptroot",
+				"mkfs.ext4 -qF /dev/sdz3",
+			},
+		},
+		{
+			name:  "uefi",
+			state: State{Pw: "hunter2", UEFI: true},
+			want: []string{
+				"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+				"partprobe /dev/sdz",
+				"mkfs.ext4 -qF /dev/sdz1",
+				"cryptsetup luksFormat --type luks2 /dev/sdz2 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+				"cryptsetup luksOpen --key-file - /dev/sdz2 cryptroot",
+				"mkfs.ext4 -qF /dev/mapper/cryptroot",
+				"mkfs.ext4 -qF /dev/sdz3",
+				"mkfs.vfat -F 32 -n EFI /dev/sdz4",
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := useFakeRunner(t)
+			tc.state.InstallDevice = &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+
+			if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &tc.state); err != nil {
+				t.Fatalf("Run() failed: %v", err)
+			}
+			calls := fake.Calls()
+			checkCmdLines(t, calls, tc.want)
+
+			for _, c := range calls {
+				if c.Argv[0] == "cryptsetup" && c.Stdin != "hunter2" {
+					t.Errorf("%v was given stdin %q, want the password", c.Argv, c.Stdin)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionStepScrubFailure(t *testing.T) {
+	scrub := "dd if=/dev/zero of=/dev/mapper/cryptroot bs=1M status=progress"
+	tcs := []struct {
+		name    string
+		resp    FakeResponse
+		wantErr bool
+	}{
+		{name: "device full", resp: FakeResponse{Stderr: "dd: error writing '/dev/mapper/cryptroot': " + ddFullMsg + "\n", Err: errors.New("exit status 1")}},
+		{name: "not started", resp: FakeResponse{Err: errors.New(`exec: "dd": executable file not found in $PATH`)}, wantErr: true},
+		{name: "I/O error", resp: FakeResponse{Stderr: "dd: error writing '/dev/mapper/cryptroot': Input/output error\n", Err: errors.New("exit status 1")}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := useFakeRunner(t)
+			fake.Responses = map[string]FakeResponse{scrub: tc.resp}
+			state := State{Pw: "hunter2", Scrub: true, InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}}
+			if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); (err != nil) != tc.wantErr {
+				t.Errorf("Run() = %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPartitionStepAlongside(t *testing.T) {
+	fake := useFakeRunner(t)
+	state := State{Pw: "hunter2", UEFI: true, Alongside: true, ShrinkPart: 3, ShrinkToMB: 20 * 1024, InstallDevice: dualBootDisk()}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	calls := fake.Calls()
+	checkCmdLines(t, calls, []string{
+		"ntfsresize --size 21474836480 /dev/sdz3",
+		"sfdisk -N 3 /dev/sdz",
+		"sfdisk --append --wipe-partitions always /dev/sdz",
+		"partprobe /dev/sdz",
+		"mkfs.ext4 -qF /dev/sdz4",
+		"cryptsetup luksFormat --type luks2 /dev/sdz5 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+		"cryptsetup luksOpen --key-file - /dev/sdz5 cryptroot",
+		"mkfs.ext4 -qF /dev/mapper/cryptroot",
+		"mkfs.ext4 -qF /dev/sdz6",
+	})
+	if want := "start=239616, size=41943040\n"; calls[1].Stdin != want {
+		t.Errorf("sfdisk -N was given %q, want %q", calls[1].Stdin, want)
+	}
+}
+
+func TestPartitionStepTooSmall(t *testing.T) {
+	fake := useFakeRunner(t)
+	state := State{InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 256 * 1024 * 1024 / blockSize}}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err == nil {
+		t.Error("Run() on a 256MiB disk succeeded")
+	}
+	if calls := fake.Calls(); len(calls) > 0 {
+		t.Errorf("Run() ran %q, want nothing", cmdLines(calls))
+	}
+}
+
+func TestPartitionStepCustom(t *testing.T) {
+	fake := useFakeRunner(t)
+	state := State{Pw: "hunter2", UEFI: true, Layout: customLayout(), InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+		"partprobe /dev/sdz",
+		"mkfs.ext4 -qF /dev/sdz1",
+		"mkfs.ext4 -qF /dev/sdz2",
+		"mkswap /dev/sdz3",
+		"cryptsetup luksFormat --type luks2 /dev/sdz4 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+		"cryptsetup luksOpen --key-file - /dev/sdz4 crypt4",
+		"mkfs.xfs -f -L home /dev/mapper/crypt4",
+		"mkfs.vfat -F 32 -n EFI /dev/sdz5",
+	})
+}
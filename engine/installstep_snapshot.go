@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path"
+)
+
+// freshInstallSnapshot is the read-only snapshot of the root subvolume
+// taken once the installed system is configured, as it is mounted while
+// installing.
+const freshInstallSnapshot = "/tmp/install_mounts/root/.snapshots/fresh-install"
+
+// SnapshotStep snapshots a btrfs root filesystem once it is configured,
+// so the fresh install can be restored or compared against later. It
+// does nothing for other root filesystems.
+type SnapshotStep struct {
+}
+
+func (s *SnapshotStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	if len(installState.PartitionPlan().Subvolumes) == 0 {
+		progressInfo(updateChan, "The root filesystem is not btrfs, so is not snapshotted.\n")
+		return nil
+	}
+	if _, err := os.Stat(freshInstallSnapshot); err == nil {
+		progressInfo(updateChan, "Snapshot %q already exists.\n", freshInstallSnapshot)
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(freshInstallSnapshot), 0750); err != nil {
+		return err
+	}
+	argv := snapshotArgv()
+	return runCmd(ctx, updateChan, "[SNAPSHOT]: ", argv[0], argv[1:]...)
+}
+
+// snapshotArgv returns the command which snapshots the root subvolume.
+func snapshotArgv() []string {
+	return []string{"btrfs", "subvolume", "snapshot", "-r", "/tmp/install_mounts/root", freshInstallSnapshot}
+}
+
+// Plan describes the snapshot Run will take.
+func (s *SnapshotStep) Plan(installState *State) []Action {
+	if len(installState.PartitionPlan().Subvolumes) == 0 {
+		return nil
+	}
+	return []Action{{Desc: "Snapshot the fresh install", Argv: snapshotArgv()}}
+}
+
+// Weight estimates the relative duration of the step.
+func (s *SnapshotStep) Weight(installState *State) int {
+	if len(installState.PartitionPlan().Subvolumes) == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Idempotent returns true, as an existing snapshot is kept.
+func (s *SnapshotStep) Idempotent(installState *State) bool {
+	return true
+}
+
+func (s *SnapshotStep) Name() string {
+	return "Snapshot fresh install"
+}
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// verifyManifest is a sha256sum-format listing of the files in the
+// source, relative to its root. If present, installed files are checked
+// against it rather than against the source itself.
+var verifyManifest = "/usr/share/twlinst/manifest.sha256"
+
+// VerifyStep checks the files installed by CopyStep match the source.
+type VerifyStep struct {
+}
+
+// verifyFile is an installed file & its expected contents.
+type verifyFile struct {
+	// Path is the path of the file relative to the installed root.
+	Path string
+	// Src is the file it was copied from, if hashing the source.
+	Src string
+	// Hash is the expected SHA-256 digest, if known from the manifest.
+	Hash string
+	Size int64
+}
+
+// verifyTarget returns where a source path is installed, or false if it
+// is not part of the installed tree.
+func verifyTarget(m *CopyManifest, rel string) (string, bool) {
+	if m.excluded(rel) {
+		return "", false
+	}
+	for _, e := range m.Entries {
+		if rel == e.From || strings.HasPrefix(rel, e.From+"/") {
+			return path.Join(e.target(), strings.TrimPrefix(rel, e.From)), true
+		}
+	}
+	return "", false
+}
+
+// readVerifyManifest parses the manifest at p, returning the files
+// installed according to the copy manifest m.
+func readVerifyManifest(p string, m *CopyManifest) ([]verifyFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []verifyFile
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", p, line)
+		}
+		// sha256sum marks binary-mode entries with '*'.
+		rel := path.Clean("/" + strings.TrimLeft(fields[1], " *"))
+		target, ok := verifyTarget(m, rel)
+		if !ok {
+			continue
+		}
+		out = append(out, verifyFile{Path: target, Hash: strings.ToLower(fields[0])})
+	}
+	return out, s.Err()
+}
+
+// sourceFiles lists the regular files installed from the source tree at
+// root according to the copy manifest m.
+func sourceFiles(root string, m *CopyManifest) []verifyFile {
+	var out []verifyFile
+	for _, e := range m.Entries {
+		from, exclude := path.Join(root, e.From), m.excluder(e)
+		filepath.Walk(from, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(from, p)
+			if err != nil {
+				return nil
+			}
+			if exclude(filepath.ToSlash(rel)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				out = append(out, verifyFile{Path: path.Join(e.target(), rel), Src: p, Size: info.Size()})
+			}
+			return nil
+		})
+	}
+	return out
+}
+
+// hashFile returns the hex SHA-256 digest of the file at p, counting the
+// bytes read in *progress.
+func hashFile(p string, progress *int64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := make([]byte, copyChunk)
+	for {
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		atomic.AddInt64(progress, int64(n))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyFiles checks each installed file (beneath root) against its
+// source, returning a description of each mismatch.
+func verifyFiles(ctx context.Context, root string, files []verifyFile, workers int, progress *int64) []string {
+	var (
+		mu         sync.Mutex
+		mismatches []string
+		wg         sync.WaitGroup
+	)
+	mismatch := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		mismatches = append(mismatches, fmt.Sprintf(format, args...))
+	}
+
+	jobs := make(chan verifyFile)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				want := f.Hash
+				if f.Src != "" {
+					var err error
+					if want, err = hashFile(f.Src, progress); err != nil {
+						mismatch("%s: reading source: %v", f.Path, err)
+						continue
+					}
+				}
+				got, err := hashFile(path.Join(root, f.Path), progress)
+				switch {
+				case os.IsNotExist(err):
+					mismatch("%s: missing", f.Path)
+				case err != nil:
+					mismatch("%s: %v", f.Path, err)
+				case got != want:
+					mismatch("%s: has SHA-256 %s, want %s", f.Path, got, want)
+				}
+			}
+		}()
+	}
+
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Strings(mismatches)
+	return mismatches
+}
+
+func (s *VerifyStep) Run(ctx context.Context, updateChan chan Update, installState *State) error {
+	if installState.SkipVerify {
+		progressInfo(updateChan, "Verification skipped.\n")
+		return nil
+	}
+
+	root, err := openSource(ctx, updateChan, installState)
+	if err != nil {
+		return err
+	}
+	m, err := loadCopyManifest(root)
+	if err != nil {
+		return err
+	}
+	manifest := path.Join(root, verifyManifest)
+	var files []verifyFile
+	var total int64
+	if _, err := os.Stat(manifest); err == nil {
+		progressInfo(updateChan, "Verifying installed files against %s\n", manifest)
+		if files, err = readVerifyManifest(manifest, m); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if st, err := os.Stat(path.Join("/tmp/install_mounts/root", f.Path)); err == nil {
+				total += st.Size()
+			}
+		}
+	} else {
+		progressInfo(updateChan, "Verifying installed files against %s\n", sourceFor(installState.Source).Desc())
+		files = sourceFiles(root, m)
+		for _, f := range files {
+			// Both the source & installed copy are read.
+			total += 2 * f.Size
+		}
+	}
+	progressInfo(updateChan, "Checking %d files (%s).\n", len(files), ByteCountDecimal(total))
+
+	var hashed int64
+	report := func() {
+		if total > 0 {
+			progressPercent(updateChan, int(atomic.LoadInt64(&hashed)*99/total))
+		}
+	}
+	stop := every(time.Second, report)
+	mismatches := verifyFiles(ctx, "/tmp/install_mounts/root", files, copyWorkers(installState), &hashed)
+	stop()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		updateChan <- Update{ErrMsg: "  [VERIFY]: " + m + "\n"}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d installed files do not match the source", len(mismatches))
+	}
+	progressInfo(updateChan, "All %d files verified.\n", len(files))
+	return nil
+}
+
+// Plan describes the verification Run will perform.
+func (s *VerifyStep) Plan(installState *State) []Action {
+	if installState.SkipVerify {
+		return nil
+	}
+	src := sourceFor(installState.Source)
+	if _, ok := src.(liveSource); ok {
+		manifest := path.Join(sourceRoot, verifyManifest)
+		if _, err := os.Stat(manifest); err == nil {
+			return []Action{{Desc: "Verify installed files against manifest", Path: manifest}}
+		}
+	}
+	return []Action{{Desc: "Verify installed files against " + src.Desc(), Path: "/tmp/install_mounts/root"}}
+}
+
+// Weight estimates the relative duration of the step.
+func (s *VerifyStep) Weight(installState *State) int {
+	if installState.SkipVerify {
+		return 0
+	}
+	return 30
+}
+
+// Idempotent returns true, as the step only reads files.
+func (s *VerifyStep) Idempotent(installState *State) bool {
+	return true
+}
+
+func (s *VerifyStep) Name() string {
+	return "Verify files"
+}
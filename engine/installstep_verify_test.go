@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeVerifyTrees writes files to a fake live media tree, and copies of
+// them to a fake installed root.
+func makeVerifyTrees(t *testing.T, files map[string]string) (src, dst string) {
+	src, dst = t.TempDir(), t.TempDir()
+	for p, contents := range files {
+		for _, root := range []string{src, dst} {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, p), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	oldSource := sourceRoot
+	sourceRoot = src
+	t.Cleanup(func() { sourceRoot = oldSource })
+	return src, dst
+}
+
+func TestVerifyFiles(t *testing.T) {
+	_, dst := makeVerifyTrees(t, map[string]string{
+		"etc/hostname":   "twl\n",
+		"etc/passwd":     "root:x:0:0::/root:/bin/bash\n",
+		"usr/bin/tool":   "#!/bin/sh\n",
+		"var/lib/status": "ok\n",
+	})
+	if err := ioutil.WriteFile(filepath.Join(dst, "etc/passwd"), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dst, "usr/bin/tool")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := sourceFiles(sourceRoot, &defaultCopyManifest)
+	if len(files) != 4 {
+		t.Fatalf("sourceFiles() returned %d files, want 4", len(files))
+	}
+	var hashed int64
+	got := verifyFiles(context.Background(), dst, files, 2, &hashed)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "/etc/passwd: has SHA-256") || got[1] != "/usr/bin/tool: missing" {
+		t.Errorf("verifyFiles() = %q, want /etc/passwd to differ & /usr/bin/tool missing", got)
+	}
+	if hashed == 0 {
+		t.Error("verifyFiles() reported no progress")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	src, _ := makeVerifyTrees(t, nil)
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	manifest := filepath.Join(src, verifyManifest)
+	if err := os.MkdirAll(filepath.Dir(manifest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	contents := "# generated at image build time\n" +
+		sum("twl\n") + "  etc/hostname\n" +
+		sum("x") + " */./usr/bin/tool\n" +
+		sum("y") + "  proc/cpuinfo\n"
+	if err := ioutil.WriteFile(manifest, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readVerifyManifest(manifest, &defaultCopyManifest)
+	if err != nil {
+		t.Fatalf("readVerifyManifest() failed: %v", err)
+	}
+	// proc is not installed, so isn't checked.
+	want := []verifyFile{
+		{Path: "/etc/hostname", Hash: sum("twl\n")},
+		{Path: "/usr/bin/tool", Hash: sum("x")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readVerifyManifest() = %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(manifest, []byte("deadbeef  etc/hostname\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readVerifyManifest(manifest, &defaultCopyManifest); err == nil {
+		t.Error("readVerifyManifest() accepted a malformed entry")
+	}
+}
+
+func TestVerifySkipped(t *testing.T) {
+	fake := useFakeRunner(t)
+	s := VerifyStep{}
+	state := State{SkipVerify: true}
+	if err := s.Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Errorf("Run() failed: %v", err)
+	}
+	if calls := fake.Calls(); len(calls) > 0 {
+		t.Errorf("Run() ran %q, want nothing", cmdLines(calls))
+	}
+	if plan := s.Plan(&state); len(plan) != 0 {
+		t.Errorf("Plan() = %+v, want no actions", plan)
+	}
+}
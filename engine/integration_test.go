@@ -0,0 +1,244 @@
+//go:build integration
+// +build integration
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run with: go test -tags integration -run TestInstallLoopDevice
+//
+// The test must be run as root, and needs losetup, sfdisk, parted, partprobe,
+// cryptsetup, mkfs.ext4 & blkid on the host. Commands which need a real
+// TwitchyLinux root filesystem (chroot & grub-install) are faked.
+
+// loopRunner runs commands on the host, except those which cannot
+// work against the fake source tree, which are recorded by fake.
+type loopRunner struct {
+	fake *FakeRunner
+}
+
+func (r loopRunner) Run(c *Cmd) error {
+	switch c.Args[0] {
+	case "chroot", "grub-install":
+		return r.fake.Run(c)
+	}
+	return HostRunner{}.Run(c)
+}
+
+func hostCmd(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %v failed: %v\nOutput: %s", name, args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// makeFakeSourceTree creates a minimal tree with each of the
+// directories installed by CopyStep.
+func makeFakeSourceTree(t *testing.T) string {
+	dir := t.TempDir()
+	for _, e := range defaultCopyManifest.Entries {
+		if err := os.MkdirAll(filepath.Join(dir, e.From), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"etc/os-release":                  "NAME=TwitchyLinux\n",
+		"bin/placeholder":                 "#!/bin/sh\n",
+		"home/twl/.profile":               "# profile\n",
+		"boot/boot/vmlinuz-5.4.0-test":    "not a kernel",
+		"boot/boot/initrd.img-5.4.0-test": "not an initrd",
+		"boot/boot/grub/.keep":            "",
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// attachLoopImage creates a sparse image file & attaches it to a
+// loop device, returning the path to the loop device.
+func attachLoopImage(t *testing.T, size int64) string {
+	img := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dev := hostCmd(t, "losetup", "-P", "-f", "--show", img)
+	t.Cleanup(func() { exec.Command("losetup", "-d", dev).Run() })
+	return dev
+}
+
+// mountReadOnly mounts dev at a temporary directory, returning its path.
+func mountReadOnly(t *testing.T, dev string) string {
+	dir := t.TempDir()
+	hostCmd(t, "mount", "-o", "ro", dev, dir)
+	t.Cleanup(func() { exec.Command("umount", dir).Run() })
+	return dir
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	d, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(d)
+}
+
+func TestInstallLoopDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	for _, tool := range []string{"losetup", "sfdisk", "parted", "partprobe", "cryptsetup", "mkfs.ext4", "blkid"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available: %v", tool, err)
+		}
+	}
+	if _, err := os.Stat("/usr/share/zoneinfo/UTC"); err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+
+	tcs := []struct {
+		name      string
+		uefi      bool
+		wantLabel string
+		wantParts int
+	}{
+		{name: "bios", wantLabel: "msdos", wantParts: 3},
+		{name: "uefi", uefi: true, wantLabel: "gpt", wantParts: 4},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := exec.LookPath("mkfs.vfat"); tc.uefi && err != nil {
+				t.Skipf("mkfs.vfat not available: %v", err)
+			}
+
+			fake := &FakeRunner{}
+			oldRunner, oldSource := CmdRunner, sourceRoot
+			CmdRunner, sourceRoot = loopRunner{fake: fake}, makeFakeSourceTree(t)
+			defer func() { CmdRunner, sourceRoot = oldRunner, oldSource }()
+
+			dev := attachLoopImage(t, 1024*1024*1024)
+			numBlocks, err := DevNumBlocks(filepath.Base(dev))
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := State{
+				InstallDevice: &Disk{Path: dev, NumBlocks: numBlocks},
+				Pw:            "integration-test",
+				User:          "twl",
+				Host:          "loopy",
+				Tz:            "UTC",
+				UEFI:          tc.uefi,
+			}
+			t.Cleanup(func() {
+				exec.Command("umount", "/tmp/install_mounts/boot/efi").Run()
+				exec.Command("umount", "/tmp/install_mounts/boot").Run()
+				exec.Command("umount", "/tmp/install_mounts/root").Run()
+				exec.Command("cryptsetup", "luksClose", "cryptroot").Run()
+			})
+
+			updateChan := discardUpdates(t)
+			for _, step := range Steps {
+				if err := step.Run(context.Background(), updateChan, &state); err != nil {
+					t.Fatalf("%s failed: %v", step.Name(), err)
+				}
+			}
+
+			// Partition table.
+			table := strings.Split(hostCmd(t, "parted", "-m", "-s", dev, "print"), "\n")
+			if len(table) < 2 {
+				t.Fatalf("unexpected parted output: %q", table)
+			}
+			if label := strings.Split(table[1], ":")[5]; label != tc.wantLabel {
+				t.Errorf("partition table type = %q, want %q", label, tc.wantLabel)
+			}
+			if n := len(table) - 2; n != tc.wantParts {
+				t.Errorf("got %d partitions, want %d", n, tc.wantParts)
+			}
+
+			// LUKS header.
+			rootPart := state.InstallDevice.pathForPartition(2)
+			if err := exec.Command("cryptsetup", "isLuks", "--type", "luks2", rootPart).Run(); err != nil {
+				t.Errorf("%s is not a LUKS2 volume: %v", rootPart, err)
+			}
+
+			bootUUID := hostCmd(t, "blkid", "-s", "UUID", "-o", "value", state.InstallDevice.pathForPartition(1))
+			luksUUID := hostCmd(t, "blkid", "-s", "UUID", "-o", "value", rootPart)
+			if tc.uefi {
+				if fs := hostCmd(t, "blkid", "-s", "TYPE", "-o", "value", state.InstallDevice.pathForPartition(espPartNum)); fs != "vfat" {
+					t.Errorf("ESP has filesystem %q, want vfat", fs)
+				}
+			}
+
+			// Everything should have been released by the cleanup step.
+			if _, err := os.Stat("/dev/mapper/cryptroot"); err == nil {
+				t.Fatal("cryptroot mapping still open after install")
+			}
+			open := exec.Command("cryptsetup", "luksOpen", "--key-file", "-", rootPart, "cryptroot")
+			open.Stdin = strings.NewReader(state.Pw)
+			if out, err := open.CombinedOutput(); err != nil {
+				t.Fatalf("luksOpen failed: %v\n%s", err, out)
+			}
+
+			// fstab & crypttab.
+			root := mountReadOnly(t, "/dev/mapper/cryptroot")
+			if fstab := readFile(t, filepath.Join(root, "etc/fstab")); !strings.Contains(fstab, "UUID="+bootUUID+" /boot") {
+				t.Errorf("fstab does not mount boot partition %s:\n%s", bootUUID, fstab)
+			}
+			if want, crypttab := "cryptroot UUID="+luksUUID+" none luks,discard\n", readFile(t, filepath.Join(root, "etc/crypttab")); crypttab != want {
+				t.Errorf("crypttab = %q, want %q", crypttab, want)
+			}
+			if host := readFile(t, filepath.Join(root, "etc/hostname")); host != "loopy\n" {
+				t.Errorf("hostname = %q, want %q", host, "loopy\n")
+			}
+			if _, err := os.Stat(filepath.Join(root, "home/twl/.profile")); err != nil {
+				t.Errorf("source tree was not copied: %v", err)
+			}
+
+			// grub.cfg.
+			boot := mountReadOnly(t, state.InstallDevice.pathForPartition(1))
+			grubCfg := readFile(t, filepath.Join(boot, "grub/grub.cfg"))
+			for _, want := range []string{
+				"search --no-floppy --fs-uuid --set " + bootUUID,
+				"linux   /vmlinuz-5.4.0-test cryptdevice=UUID=" + luksUUID + ":cryptroot",
+				"initrd /initrd.img-5.4.0-test",
+			} {
+				if !strings.Contains(grubCfg, want) {
+					t.Errorf("grub.cfg missing %q:\n%s", want, grubCfg)
+				}
+			}
+
+			var grubInstalls int
+			for _, c := range fake.Calls() {
+				if c.Argv[0] == "grub-install" {
+					grubInstalls++
+				}
+			}
+			if grubInstalls == 0 {
+				t.Error("grub-install was not run")
+			}
+		})
+	}
+}
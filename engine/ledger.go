@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// resourceKind describes a type of resource held by an installation.
+type resourceKind int
+
+const (
+	// resMount is a mounted filesystem (including bind mounts), named
+	// by its mount point.
+	resMount resourceKind = iota
+	// resMapping is an open dm-crypt mapping, named by its mapping name.
+	resMapping
+	// resDir is a scratch directory, removed along with its contents.
+	resDir
+	// resVolumeGroup is an active LVM volume group, named by its name.
+	resVolumeGroup
+)
+
+type resource struct {
+	Kind resourceKind
+	Name string
+}
+
+func (r resource) String() string {
+	switch r.Kind {
+	case resMapping:
+		return "mapping " + r.Name
+	case resDir:
+		return "directory " + r.Name
+	case resVolumeGroup:
+		return "volume group " + r.Name
+	}
+	return "mount " + r.Name
+}
+
+var (
+	// unwindRetries is the number of times releasing a busy resource
+	// is attempted before giving up (or lazily unmounting).
+	unwindRetries = 5
+	// unwindRetryDelay is how long to wait between attempts.
+	unwindRetryDelay = time.Second
+)
+
+// ledger records the mounts, dm-crypt mappings, LVM volume groups &
+// scratch directories created during an installation, so they can be
+// released in reverse order once the installation completes or fails.
+type ledger struct {
+	mu        sync.Mutex
+	resources []resource
+}
+
+func (l *ledger) add(r resource) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resources = append(l.resources, r)
+}
+
+// mounted records that a filesystem was mounted at target.
+func (l *ledger) mounted(target string) {
+	l.add(resource{Kind: resMount, Name: target})
+}
+
+// mapped records that the dm-crypt mapping name was opened.
+func (l *ledger) mapped(name string) {
+	l.add(resource{Kind: resMapping, Name: name})
+}
+
+// activated records that the LVM volume group name was activated.
+func (l *ledger) activated(name string) {
+	l.add(resource{Kind: resVolumeGroup, Name: name})
+}
+
+// created records that the scratch directory dir was created.
+func (l *ledger) created(dir string) {
+	l.add(resource{Kind: resDir, Name: dir})
+}
+
+// unmounted records that the filesystem at target was unmounted, so need
+// not be released; the most recent mount there is removed.
+func (l *ledger) unmounted(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.resources) - 1; i >= 0; i-- {
+		if l.resources[i] == (resource{Kind: resMount, Name: target}) {
+			l.resources = append(l.resources[:i], l.resources[i+1:]...)
+			return
+		}
+	}
+}
+
+// holds returns true if the resource is recorded in the ledger.
+func (l *ledger) holds(r resource) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, held := range l.resources {
+		if held == r {
+			return true
+		}
+	}
+	return false
+}
+
+// mark returns a position in the ledger, which can later be passed to
+// unwindTo to release only the resources recorded since.
+func (l *ledger) mark() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.resources)
+}
+
+// unwind releases all recorded resources, most recent first.
+func (l *ledger) unwind(updateChan chan Update) error {
+	return l.unwindTo(updateChan, 0)
+}
+
+// unwindTo releases the resources recorded after mark, most recent first.
+// It continues past failures, returning the first error; resources which
+// could not be released remain in the ledger.
+func (l *ledger) unwindTo(updateChan chan Update, mark int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	var kept []resource
+	for i := len(l.resources) - 1; i >= mark; i-- {
+		r := l.resources[i]
+		if err := release(updateChan, r); err != nil {
+			updateChan <- Update{
+				WarnMsg: fmt.Sprintf("  Failed to release %s: %v\n", r, err),
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			kept = append([]resource{r}, kept...)
+		}
+	}
+	l.resources = append(l.resources[:mark], kept...)
+	return firstErr
+}
+
+// release frees a single resource, retrying while it is busy. Mounts
+// which remain busy are lazily unmounted.
+func release(updateChan chan Update, r resource) error {
+	if r.Kind == resDir {
+		progressInfo(updateChan, "[UNWIND]: Remove %s\n", r.Name)
+		return os.RemoveAll(r.Name)
+	}
+
+	argv := []string{"umount", r.Name}
+	switch r.Kind {
+	case resMapping:
+		argv = []string{"cryptsetup", "luksClose", r.Name}
+	case resVolumeGroup:
+		argv = []string{"vgchange", "-an", r.Name}
+	}
+
+	for attempt := 1; ; attempt++ {
+		progressInfo(updateChan, "[UNWIND]: %s\n", argv)
+		out, err := command(argv[0], argv[1:]...).CombinedOutput()
+		switch {
+		case err == nil:
+			return nil
+		case r.Kind == resMount && bytes.Contains(out, []byte("not mounted")):
+			return nil
+		case !isBusy(out):
+			progressInfo(updateChan, "  Output: %q\n", string(out))
+			return err
+		case attempt < unwindRetries:
+			progressInfo(updateChan, "  %s is busy, retrying (%d/%d)\n", r.Name, attempt, unwindRetries)
+			sleep(unwindRetryDelay)
+			continue
+		}
+
+		if r.Kind != resMount {
+			return err
+		}
+		progressInfo(updateChan, "[UNWIND]: %s is still busy, unmounting lazily\n", r.Name)
+		out, err = command("umount", "-l", r.Name).CombinedOutput()
+		if err != nil {
+			progressInfo(updateChan, "  Output: %q\n", string(out))
+		}
+		return err
+	}
+}
+
+// isBusy returns true if command output reports the device is in use.
+func isBusy(out []byte) bool {
+	return bytes.Contains(out, []byte("busy")) || bytes.Contains(out, []byte("in use"))
+}
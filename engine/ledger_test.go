@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLedgerUnwind(t *testing.T) {
+	fake := useFakeRunner(t)
+	var l ledger
+	l.mapped("cryptroot")
+	l.mounted("/tmp/install_mounts/boot")
+	l.mounted("/tmp/install_mounts/root")
+	mark := l.mark()
+	l.mounted("/tmp/install_mounts/root/proc")
+	l.mounted("/tmp/install_mounts/root/dev")
+
+	updateChan := discardUpdates(t)
+	if err := l.unwindTo(updateChan, mark); err != nil {
+		t.Fatalf("unwindTo() failed: %v", err)
+	}
+	if err := l.unwind(updateChan); err != nil {
+		t.Fatalf("unwind() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"umount /tmp/install_mounts/root/dev",
+		"umount /tmp/install_mounts/root/proc",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/boot",
+		"cryptsetup luksClose cryptroot",
+	})
+	if len(l.resources) != 0 {
+		t.Errorf("resources remain after unwind: %v", l.resources)
+	}
+}
+
+func TestLedgerUnwindBusy(t *testing.T) {
+	fake := useFakeRunner(t)
+	fake.Responses = map[string]FakeResponse{
+		"umount /tmp/install_mounts/root": {Stderr: "umount: /tmp/install_mounts/root: target is busy.", Err: errFake},
+		"cryptsetup luksClose cryptroot":  {Stderr: "Device cryptroot is still in use.", Err: errFake},
+		"umount /tmp/install_mounts/boot": {Stderr: "umount: /tmp/install_mounts/boot: not mounted.", Err: errFake},
+	}
+	var l ledger
+	l.mapped("cryptroot")
+	l.mounted("/tmp/install_mounts/boot")
+	l.mounted("/tmp/install_mounts/root")
+
+	if err := l.unwind(discardUpdates(t)); err != errFake {
+		t.Fatalf("unwind() returned %v, want %v", err, errFake)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/root",
+		"umount -l /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/boot",
+		"cryptsetup luksClose cryptroot",
+		"cryptsetup luksClose cryptroot",
+		"cryptsetup luksClose cryptroot",
+		"cryptsetup luksClose cryptroot",
+		"cryptsetup luksClose cryptroot",
+	})
+	// The mapping could not be closed, so should be retried next time.
+	if want := []resource{{Kind: resMapping, Name: "cryptroot"}}; len(l.resources) != 1 || l.resources[0] != want[0] {
+		t.Errorf("resources = %v, want %v", l.resources, want)
+	}
+}
+
+func TestRunUnwindsOnFailure(t *testing.T) {
+	for _, cancel := range []bool{false, true} {
+		fake := useFakeRunner(t)
+		ctx, cancelFn := context.WithCancel(context.Background())
+		defer cancelFn()
+		fake.Responses = map[string]FakeResponse{}
+		if cancel {
+			fake.OnRun = func(c FakeCall) {
+				if c.Argv[0] == "mkfs.ext4" && c.Argv[2] == "/dev/mapper/cryptroot" {
+					cancelFn()
+				}
+			}
+		} else {
+			fake.Responses["mkfs.ext4 -qF /dev/mapper/cryptroot"] = FakeResponse{Err: errFake}
+		}
+
+		state := State{Pw: "hunter2", InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}}
+		wantErr := errFake
+		if cancel {
+			wantErr = context.Canceled
+		}
+		if err := Run(ctx, discardUpdates(t), &state); err != wantErr {
+			t.Fatalf("Run(cancel=%v) returned %v, want %v", cancel, err, wantErr)
+		}
+		calls := cmdLines(fake.Calls())
+		if last := calls[len(calls)-1]; last != "cryptsetup luksClose cryptroot" {
+			t.Errorf("Run(cancel=%v) last command = %q, want the mapping to be closed", cancel, last)
+		}
+	}
+}
+
+func TestLedgerRemovesDirs(t *testing.T) {
+	fake := useFakeRunner(t)
+	dir := filepath.Join(t.TempDir(), "stage")
+	if err := os.MkdirAll(filepath.Join(dir, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var l ledger
+	l.mounted("/tmp/install_mounts/root")
+	l.created(dir)
+	if !l.holds(resource{Kind: resDir, Name: dir}) {
+		t.Errorf("holds(%s) = false, want true", dir)
+	}
+
+	if err := l.unwind(discardUpdates(t)); err != nil {
+		t.Fatalf("unwind() failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s remains after unwind: %v", dir, err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{"umount /tmp/install_mounts/root"})
+}
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// volumeGroup is the name of the LVM volume group created inside the
+	// encrypted root partition.
+	volumeGroup = "twl"
+	// lvmExtentMB is the unit logical volumes are allocated in.
+	lvmExtentMB = 4
+	// lvmMetadataMB is the space at the start of the physical volume
+	// taken by the LVM metadata.
+	lvmMetadataMB = 1
+)
+
+// lvmTools are the commands run to create & activate the volume group.
+var lvmTools = []string{"pvcreate", "vgcreate", "lvcreate", "vgchange"}
+
+// LVMOptions are the sizes of the logical volumes the encrypted root
+// partition is split into, so /home & swap share a single LUKS volume
+// (and password) with the root filesystem.
+type LVMOptions struct {
+	RootMB int `json:"root_mb"`
+	// HomeMB is the size of the volume mounted at /home, or zero for it
+	// to take the space left by the others.
+	HomeMB int `json:"home_mb"`
+	// SwapMB is the size of the swap volume, or zero for none.
+	SwapMB int `json:"swap_mb"`
+}
+
+// LogicalVolume is an LVM logical volume in the plan's volume group.
+type LogicalVolume struct {
+	Name       string `json:"name"`
+	Filesystem string `json:"filesystem"`
+	MountPoint string `json:"mount_point,omitempty"`
+	Desc       string `json:"desc"`
+	Bytes      int64  `json:"bytes"`
+	// Fill is set if the volume is created with the space left in the
+	// volume group, which Bytes estimates.
+	Fill bool `json:"fill,omitempty"`
+}
+
+// device returns the device node of the volume, once the volume group
+// vg is active.
+func (lv *LogicalVolume) device(vg string) string {
+	return "/dev/mapper/" + vg + "-" + lv.Name
+}
+
+// lvmBytes rounds a volume size up to a whole number of extents.
+func lvmBytes(sizeMB int) int64 {
+	return (int64(sizeMB) + lvmExtentMB - 1) / lvmExtentMB * lvmExtentMB * mib
+}
+
+// addVolumes turns the new, encrypted partition mounted at / into an LVM
+// physical volume, holding volumes for root & /home (with the root
+// partition's filesystem) & swap.
+func (p *PartitionPlan) addVolumes(o LVMOptions) {
+	pv := p.MountedAt("/")
+	if pv == nil || pv.Existing || !pv.Encrypted {
+		p.err = errors.New("LVM needs a new, encrypted root partition to hold the volume group")
+		return
+	}
+	if o.RootMB <= 0 {
+		p.err = errors.New("the root volume needs a size")
+		return
+	}
+	fs := pv.Filesystem
+	pv.Filesystem, pv.MountPoint, pv.Desc = "lvm", "", "Encrypted LVM partition"
+	p.VolumeGroup = volumeGroup
+
+	// The volume which takes the remaining space is created last.
+	p.Volumes = []LogicalVolume{{Name: "root", Filesystem: fs, MountPoint: "/", Desc: "Root volume", Bytes: lvmBytes(o.RootMB)}}
+	if o.SwapMB > 0 {
+		p.Volumes = append(p.Volumes, LogicalVolume{Name: "swap", Filesystem: "swap", Desc: "Swap volume", Bytes: lvmBytes(o.SwapMB)})
+	}
+	home := LogicalVolume{Name: "home", Filesystem: fs, MountPoint: "/home", Desc: "Home volume", Bytes: lvmBytes(o.HomeMB), Fill: o.HomeMB <= 0}
+
+	size := p.volumeGroupBytes(pv)
+	free := size
+	for _, lv := range p.Volumes {
+		free -= lv.Bytes
+	}
+	if home.Fill {
+		home.Bytes = free
+	}
+	free -= home.Bytes
+	p.Volumes = append(p.Volumes, home)
+	if free < 0 {
+		p.err = fmt.Errorf("the logical volumes do not fit in the %s volume group", ByteCountDecimal(size))
+		return
+	}
+	for _, lv := range p.Volumes {
+		if min := minPartitionBytes(&PlannedPartition{Filesystem: lv.Filesystem}, p.SectorSize); lv.Bytes < min {
+			p.err = fmt.Errorf("the %s is %s, smaller than the minimum of %s for %s", strings.ToLower(lv.Desc), ByteCountDecimal(lv.Bytes), ByteCountDecimal(min), lv.Filesystem)
+			return
+		}
+	}
+}
+
+// volumeGroupBytes returns the space for logical volumes in the physical
+// volume on part.
+func (p *PartitionPlan) volumeGroupBytes(part *PlannedPartition) int64 {
+	b := p.Bytes(part.Sectors()) - (luksHeaderMB+lvmMetadataMB)*mib
+	return b / (lvmExtentMB * mib) * lvmExtentMB * mib
+}
+
+// VolumeAt returns the logical volume mounted at mountPoint in the
+// installed system, or nil.
+func (p *PartitionPlan) VolumeAt(mountPoint string) *LogicalVolume {
+	for i := range p.Volumes {
+		if p.Volumes[i].MountPoint == mountPoint {
+			return &p.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// physicalVolume returns the partition holding the volume group, or nil.
+func (p *PartitionPlan) physicalVolume() *PlannedPartition {
+	for i := range p.Partitions {
+		if p.Partitions[i].Filesystem == "lvm" && !p.Partitions[i].Existing {
+			return &p.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// lvmOps returns the commands which create the volume group on dev, an
+// opened LUKS volume, then each logical volume & its filesystem.
+func lvmOps(plan *PartitionPlan, dev string) []diskOp {
+	vg := plan.VolumeGroup
+	ops := []diskOp{{
+		Desc: "Creating LVM physical volume on " + dev,
+		Argv: []string{"pvcreate", "--yes", dev},
+	}, {
+		Desc:      "Creating LVM volume group " + vg,
+		Argv:      []string{"vgcreate", vg, dev},
+		Activates: vg,
+		Settle:    time.Second,
+	}}
+	for i := range plan.Volumes {
+		lv := &plan.Volumes[i]
+		size := []string{"-L", fmt.Sprintf("%dm", lv.Bytes/mib)}
+		if lv.Fill {
+			size = []string{"-l", "100%FREE"}
+		}
+		ops = append(ops, diskOp{
+			Desc:   fmt.Sprintf("Creating %s (%s)", strings.ToLower(lv.Desc), ByteCountDecimal(lv.Bytes)),
+			Argv:   append(append([]string{"lvcreate", "--yes", "-n", lv.Name}, size...), vg),
+			Settle: time.Second,
+		}, diskOp{
+			Desc:   fmt.Sprintf("Creating %s filesystem on %s", strings.ToUpper(lv.Filesystem), lv.device(vg)),
+			Argv:   mkfsArgv(lv.Filesystem, "", lv.device(vg)),
+			Settle: time.Second,
+		})
+	}
+	return ops
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNewPartitionPlanLVM(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	plan := NewPartitionPlan(disk, PartitionOptions{UEFI: true, LVM: &LVMOptions{RootMB: 20 * 1024, SwapMB: 4095}})
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	pv := plan.Partition(2)
+	if pv.Filesystem != "lvm" || pv.MountPoint != "" || !pv.Encrypted || plan.MountedAt("/") != nil {
+		t.Errorf("root partition = %+v, want an encrypted LVM physical volume", pv)
+	}
+	if plan.VolumeGroup != volumeGroup || len(plan.Volumes) != 3 {
+		t.Fatalf("volumes = %+v", plan.Volumes)
+	}
+	for i, want := range []LogicalVolume{
+		{Name: "root", Filesystem: "ext4", MountPoint: "/", Desc: "Root volume", Bytes: 20 * 1024 * mib},
+		{Name: "swap", Filesystem: "swap", Desc: "Swap volume", Bytes: 4096 * mib},
+		{Name: "home", Filesystem: "ext4", MountPoint: "/home", Desc: "Home volume", Fill: true},
+	} {
+		got := plan.Volumes[i]
+		if want.Fill {
+			want.Bytes = plan.volumeGroupBytes(pv) - 24*1024*mib
+		}
+		if got != want {
+			t.Errorf("volume %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	tcs := []struct {
+		name string
+		opts PartitionOptions
+	}{
+		{name: "no root size", opts: PartitionOptions{LVM: &LVMOptions{HomeMB: 1024}}},
+		{name: "too big", opts: PartitionOptions{LVM: &LVMOptions{RootMB: 40 * 1024, HomeMB: 24 * 1024}}},
+		{name: "no space for home", opts: PartitionOptions{LVM: &LVMOptions{RootMB: 60 * 1024, SwapMB: 4096}}},
+		{
+			name: "xfs home too small",
+			opts: PartitionOptions{LVM: &LVMOptions{RootMB: 1024, HomeMB: 100}, Layout: []CustomPartition{
+				{SizeMB: 512, Filesystem: "ext4", MountPoint: "/boot"},
+				{Filesystem: "xfs", MountPoint: "/", Encrypted: true},
+			}},
+		},
+		{
+			name: "btrfs root too small",
+			opts: PartitionOptions{RootFS: "btrfs", LVM: &LVMOptions{RootMB: 100}},
+		},
+		{
+			name: "unencrypted root",
+			opts: PartitionOptions{LVM: &LVMOptions{RootMB: 1024}, Layout: []CustomPartition{
+				{SizeMB: 512, Filesystem: "ext4", MountPoint: "/boot"},
+				{Filesystem: "ext4", MountPoint: "/"},
+			}},
+		},
+		{
+			name: "home partition",
+			opts: PartitionOptions{LVM: &LVMOptions{RootMB: 1024}, Layout: []CustomPartition{
+				{SizeMB: 512, Filesystem: "ext4", MountPoint: "/boot"},
+				{SizeMB: 8192, Filesystem: "ext4", MountPoint: "/", Encrypted: true},
+				{Filesystem: "ext4", MountPoint: "/home"},
+			}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := NewPartitionPlan(disk, tc.opts).Validate(); err == nil {
+				t.Error("Validate() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestPartitionStepLVM(t *testing.T) {
+	fake := useFakeRunner(t)
+	state := State{Pw: "hunter2", LVM: &LVMOptions{RootMB: 20 * 1024, HomeMB: 8 * 1024, SwapMB: 2048}, InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}}
+	if err := (&PartitionStep{}).Run(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"sfdisk --wipe always --wipe-partitions always /dev/sdz",
+		"partprobe /dev/sdz",
+		"mkfs.ext4 -qF /dev/sdz1",
+		"cryptsetup luksFormat --type luks2 /dev/sdz2 --key-file - --hash sha256 --cipher aes-xts-plain64 --key-size 512 --iter-time 2600 --use-random",
+		"cryptsetup luksOpen --key-file - /dev/sdz2 cryptlvm",
+		"pvcreate --yes /dev/mapper/cryptlvm",
+		"vgcreate twl /dev/mapper/cryptlvm",
+		"lvcreate --yes -n root -L 20480m twl",
+		"mkfs.ext4 -qF /dev/mapper/twl-root",
+		"lvcreate --yes -n swap -L 2048m twl",
+		"mkswap /dev/mapper/twl-swap",
+		"lvcreate --yes -n home -L 8192m twl",
+		"mkfs.ext4 -qF /dev/mapper/twl-home",
+		"mkfs.ext4 -qF /dev/sdz3",
+	})
+	if !state.ledger().holds(resource{Kind: resVolumeGroup, Name: "twl"}) {
+		t.Error("the volume group was not recorded in the ledger")
+	}
+
+	// Resuming re-opens the LUKS volume & activates the volume group.
+	fake = useFakeRunner(t)
+	state = State{Pw: "hunter2", LVM: state.LVM, InstallDevice: state.InstallDevice}
+	if err := (&PartitionStep{}).Reopen(context.Background(), discardUpdates(t), &state); err != nil {
+		t.Fatalf("Reopen() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"cryptsetup luksOpen --key-file - /dev/sdz2 cryptlvm",
+		"vgchange -ay twl",
+	})
+
+	// Cleanup deactivates the volume group before closing the LUKS volume.
+	var cleanup []string
+	for _, a := range (&CleanupStep{}).Plan(&state) {
+		cleanup = append(cleanup, strings.Join(a.Argv, " "))
+	}
+	if got, want := strings.Join(cleanup, "\n"), strings.Join([]string{
+		"umount /tmp/install_mounts/root/home",
+		"umount /tmp/install_mounts/root",
+		"umount /tmp/install_mounts/boot",
+		"vgchange -an twl",
+		"cryptsetup luksClose cryptlvm",
+	}, "\n"); got != want {
+		t.Errorf("cleanup plan =\n%s\nwant:\n%s", got, want)
+	}
+}
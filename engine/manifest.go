@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// copyManifestPath is where image builders may provide a copy manifest,
+// relative to the root of the source. If absent, defaultCopyManifest is
+// used.
+var copyManifestPath = "/usr/share/twlinst/copy.json"
+
+// CopyManifest describes which parts of the source are installed.
+type CopyManifest struct {
+	Entries []CopyEntry `json:"entries"`
+	// Exclude lists glob patterns (as for path.Match) of absolute paths
+	// in the source which are not installed. A pattern which matches a
+	// directory excludes everything beneath it.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// CopyEntry is a file or directory in the source which is installed.
+type CopyEntry struct {
+	From string `json:"from"`
+	// To is where the entry is installed, defaulting to From.
+	To string `json:"to,omitempty"`
+	// Optional entries are skipped if missing from the source, rather
+	// than failing the installation.
+	Optional bool `json:"optional,omitempty"`
+	// Owner overrides the ownership of everything installed from the
+	// entry, as numeric "uid:gid".
+	Owner string `json:"owner,omitempty"`
+	// Mode overrides the permissions of the installed entry itself (but
+	// not its contents), in octal.
+	Mode string `json:"mode,omitempty"`
+}
+
+var defaultCopyManifest = CopyManifest{
+	Entries: []CopyEntry{
+		{From: "/bin"},
+		{From: "/etc"},
+		{From: "/home"},
+		{From: "/lib"},
+		{From: "/lib32", Optional: true},
+		{From: "/lib64"},
+		{From: "/libx32", Optional: true},
+		{From: "/opt"},
+		{From: "/root"},
+		{From: "/sbin"},
+		{From: "/srv"},
+		{From: "/usr"},
+		{From: "/var"},
+		{From: "/deb-pkgs", Optional: true},
+	},
+}
+
+// loadCopyManifest returns the copy manifest of the source tree at root.
+func loadCopyManifest(root string) (*CopyManifest, error) {
+	p := path.Join(root, copyManifestPath)
+	d, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			m := defaultCopyManifest
+			return &m, nil
+		}
+		return nil, err
+	}
+	var m CopyManifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return &m, nil
+}
+
+func (m *CopyManifest) validate() error {
+	if len(m.Entries) == 0 {
+		return fmt.Errorf("no entries")
+	}
+	for i, e := range m.Entries {
+		if !path.IsAbs(e.From) || (e.To != "" && !path.IsAbs(e.To)) {
+			return fmt.Errorf("entry %d: paths must be absolute", i)
+		}
+		if _, _, _, err := e.owner(); err != nil {
+			return fmt.Errorf("entry %d: %v", i, err)
+		}
+		if _, _, err := e.mode(); err != nil {
+			return fmt.Errorf("entry %d: %v", i, err)
+		}
+	}
+	for _, pattern := range m.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("exclude %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns true if the source path p is excluded.
+func (m *CopyManifest) excluded(p string) bool {
+	for _, pattern := range m.Exclude {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns where the entry is installed.
+func (e CopyEntry) target() string {
+	if e.To == "" {
+		return e.From
+	}
+	return e.To
+}
+
+// owner returns the ownership override of the entry, if any.
+func (e CopyEntry) owner() (uid, gid int, ok bool, err error) {
+	if e.Owner == "" {
+		return 0, 0, false, nil
+	}
+	ids := strings.SplitN(e.Owner, ":", 2)
+	if len(ids) != 2 {
+		return 0, 0, false, fmt.Errorf("invalid owner %q (want uid:gid)", e.Owner)
+	}
+	if uid, err = strconv.Atoi(ids[0]); err != nil || uid < 0 {
+		return 0, 0, false, fmt.Errorf("invalid owner %q (want uid:gid)", e.Owner)
+	}
+	if gid, err = strconv.Atoi(ids[1]); err != nil || gid < 0 {
+		return 0, 0, false, fmt.Errorf("invalid owner %q (want uid:gid)", e.Owner)
+	}
+	return uid, gid, true, nil
+}
+
+// mode returns the permissions override of the entry, if any.
+func (e CopyEntry) mode() (uint32, bool, error) {
+	if e.Mode == "" {
+		return 0, false, nil
+	}
+	m, err := strconv.ParseUint(e.Mode, 8, 32)
+	if err != nil || m&^07777 != 0 {
+		return 0, false, fmt.Errorf("invalid mode %q", e.Mode)
+	}
+	return uint32(m), true, nil
+}
+
+// excluder returns a function reporting whether a path relative to the
+// entry is excluded.
+func (m *CopyManifest) excluder(e CopyEntry) func(rel string) bool {
+	return func(rel string) bool {
+		return m.excluded(path.Join(e.From, rel))
+	}
+}
+
+// configure sets up c to install the entry, applying the manifest's
+// excludes & the entry's overrides.
+func (m *CopyManifest) configure(c *copier, e CopyEntry) {
+	uid, gid, hasOwner, _ := e.owner()
+	mode, hasMode, _ := e.mode()
+	c.Exclude = m.excluder(e)
+	c.Adjust = func(rel string, st *syscall.Stat_t) {
+		if hasOwner {
+			st.Uid, st.Gid = uint32(uid), uint32(gid)
+		}
+		if hasMode && rel == "." {
+			st.Mode = st.Mode&^07777 | mode
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeCopyManifest(t *testing.T, root, contents string) {
+	t.Helper()
+	p := filepath.Join(root, copyManifestPath)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCopyManifest(t *testing.T) {
+	root := t.TempDir()
+	m, err := loadCopyManifest(root)
+	if err != nil || !reflect.DeepEqual(*m, defaultCopyManifest) {
+		t.Errorf("loadCopyManifest() without a manifest = %+v, %v, want the default", m, err)
+	}
+
+	writeCopyManifest(t, root, `{
+		"entries": [
+			{"from": "/usr"},
+			{"from": "/skel", "to": "/home/twl", "owner": "1000:1000", "mode": "0750"},
+			{"from": "/lib32", "optional": true}
+		],
+		"exclude": ["/var/cache/apt/archives/*.deb", "/home/*/.cache"]
+	}`)
+	m, err = loadCopyManifest(root)
+	if err != nil {
+		t.Fatalf("loadCopyManifest() failed: %v", err)
+	}
+	want := CopyManifest{
+		Entries: []CopyEntry{
+			{From: "/usr"},
+			{From: "/skel", To: "/home/twl", Owner: "1000:1000", Mode: "0750"},
+			{From: "/lib32", Optional: true},
+		},
+		Exclude: []string{"/var/cache/apt/archives/*.deb", "/home/*/.cache"},
+	}
+	if !reflect.DeepEqual(*m, want) {
+		t.Errorf("loadCopyManifest() = %+v, want %+v", *m, want)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/var/cache/apt/archives/vim_8.2_amd64.deb", true},
+		{"/var/cache/apt/archives/lock", false},
+		{"/home/twl/.cache", true},
+		{"/home/twl/.config", false},
+	} {
+		if got := m.excluded(tc.path); got != tc.want {
+			t.Errorf("excluded(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"entries": []}`,
+		`{"entries": [{"from": "usr"}]}`,
+		`{"entries": [{"from": "/usr", "owner": "root"}]}`,
+		`{"entries": [{"from": "/usr", "mode": "0999"}]}`,
+		`{"entries": [{"from": "/usr"}], "exclude": ["/var/["]}`,
+	} {
+		writeCopyManifest(t, root, bad)
+		if _, err := loadCopyManifest(root); err == nil {
+			t.Errorf("loadCopyManifest() accepted %s", bad)
+		}
+	}
+}
+
+func TestCopyManifestConfigure(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "twl")
+	for p, contents := range map[string]string{
+		".profile":         "# profile\n",
+		".cache/thumbnail": "cached",
+		"notes.txt":        "hello",
+	} {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, p), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := CopyManifest{Exclude: []string{"/home/*/.cache"}}
+	e := CopyEntry{From: "/home/twl", Mode: "0750"}
+	if os.Geteuid() == 0 {
+		e.Owner = "1000:1001"
+	}
+	var c copier
+	m.configure(&c, e)
+	if err := c.Copy(context.Background(), src, dst); err != nil {
+		t.Fatalf("Copy() failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, ".cache")); !os.IsNotExist(err) {
+		t.Errorf("excluded directory was copied: %v", err)
+	}
+	if st := lstat(t, dst); st.Mode&07777 != 0750 {
+		t.Errorf("mode of entry = %o, want %o", st.Mode&07777, 0750)
+	}
+	// The mode override only applies to the entry itself.
+	if st := lstat(t, filepath.Join(dst, "notes.txt")); st.Mode&07777 != 0644 {
+		t.Errorf("mode of notes.txt = %o, want %o", st.Mode&07777, 0644)
+	}
+	if os.Geteuid() == 0 {
+		for _, p := range []string{"", ".profile", "notes.txt"} {
+			if st := lstat(t, filepath.Join(dst, p)); st.Uid != 1000 || st.Gid != 1001 {
+				t.Errorf("%s: owner = %d:%d, want 1000:1001", p, st.Uid, st.Gid)
+			}
+		}
+	}
+	if size, files := treeSize(src, m.excluder(e)); files != 2 || size != int64(len("# profile\n")+len("hello")) {
+		t.Errorf("treeSize() = %d, %d, want the excluded files uncounted", size, files)
+	}
+}
@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// probeMountDir is where partitions are mounted while looking for other
+// operating systems.
+var probeMountDir = "/tmp/twlinst_probe"
+
+// How an OtherOS is booted from the GRUB menu.
+const (
+	// bootEFI chainloads an EFI executable.
+	bootEFI = "efi"
+	// bootChainload chainloads the partition's boot sector, on BIOS.
+	bootChainload = "chainload"
+	// bootConfigFile shows the menu of another GRUB installation.
+	bootConfigFile = "configfile"
+	// bootLinux loads a kernel & initrd directly.
+	bootLinux = "linux"
+)
+
+// OtherOS is an operating system found on a partition, which is added to
+// the boot menu of the installed system.
+type OtherOS struct {
+	Name string `json:"name"`
+	// Disk & PartN identify the partition, so systems on partitions the
+	// installation destroys can be left out.
+	Device string `json:"device"`
+	Disk   string `json:"disk"`
+	PartN  int    `json:"part_num"`
+	FS     string `json:"filesystem"`
+	FsUUID string `json:"fs_uuid"`
+
+	// Boot is how the system is booted: bootEFI, bootChainload,
+	// bootConfigFile or bootLinux.
+	Boot string `json:"boot"`
+	// Path is the EFI executable, GRUB configuration or kernel to load,
+	// relative to the root of the partition.
+	Path   string `json:"path,omitempty"`
+	Initrd string `json:"initrd,omitempty"`
+	Args   string `json:"args,omitempty"`
+}
+
+// Desc names the system & the partition it is on.
+func (o *OtherOS) Desc() string {
+	return fmt.Sprintf("%s (on %s)", o.Name, o.Device)
+}
+
+// probeFS lists how each filesystem type (as named by udev) is mounted
+// while probing. The options stop journals being replayed, so the
+// filesystems of other systems are never modified.
+var probeFS = map[string]struct {
+	Type, Opts string
+}{
+	"vfat":  {"vfat", ""},
+	"ntfs":  {"ntfs", ""},
+	"ext2":  {"ext2", ""},
+	"ext3":  {"ext4", "noload"},
+	"ext4":  {"ext4", "noload"},
+	"xfs":   {"xfs", "norecovery"},
+	"btrfs": {"btrfs", "rescue=nologreplay"},
+}
+
+// grubFSModules are the GRUB modules which read each filesystem type.
+var grubFSModules = map[string]string{
+	"vfat":  "fat",
+	"ntfs":  "ntfs",
+	"ext2":  "ext2",
+	"ext3":  "ext2",
+	"ext4":  "ext2",
+	"xfs":   "xfs",
+	"btrfs": "btrfs",
+}
+
+// FindOtherOSes looks for operating systems on the partitions of disks,
+// mounting each read-only in turn. Partitions which cannot be mounted
+// (such as those of a hibernated Windows) are skipped, as is the live
+// medium.
+func FindOtherOSes(disks []Disk) ([]OtherOS, error) {
+	var out []OtherOS
+	for i := range disks {
+		d := &disks[i]
+		if d.LiveMedium {
+			continue
+		}
+		for _, part := range d.Partitions {
+			fs, ok := probeFS[part.FS]
+			if !ok {
+				continue
+			}
+			dir := filepath.Join(probeMountDir, part.Name)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, err
+			}
+			opts := "ro,nosuid,nodev,noexec"
+			if fs.Opts != "" {
+				opts += "," + fs.Opts
+			}
+			if err := command("mount", "-t", fs.Type, "-o", opts, part.Path, dir).Run(); err != nil {
+				os.Remove(dir)
+				continue
+			}
+			out = append(out, inspectFS(dir, d, part)...)
+			if out, err := command("umount", dir).CombinedOutput(); err != nil {
+				return nil, fmt.Errorf("unmounting %s: %v (%q)", part.Path, err, string(out))
+			}
+			os.Remove(dir)
+		}
+	}
+	return out, nil
+}
+
+// inspectFS returns the operating systems which boot from part, whose
+// filesystem is mounted at dir.
+func inspectFS(dir string, d, part *Disk) []OtherOS {
+	base := OtherOS{Device: part.Path, Disk: d.Path, PartN: part.PartN, FS: part.FS, FsUUID: part.FsUUID}
+	var out []OtherOS
+
+	// Windows boots from its EFI boot manager on the ESP, or on BIOS
+	// systems from bootmgr on its system partition.
+	if exists(dir, "EFI/Microsoft/Boot/bootmgfw.efi") {
+		o := base
+		o.Name, o.Boot, o.Path = "Windows Boot Manager", bootEFI, "/EFI/Microsoft/Boot/bootmgfw.efi"
+		out = append(out, o)
+	}
+	if exists(dir, "bootmgr") {
+		o := base
+		o.Name, o.Boot = "Windows", bootChainload
+		out = append(out, o)
+	}
+
+	// Linux systems are booted using their own GRUB menu if they have one,
+	// so their kernel parameters are used, & otherwise their newest
+	// kernel. A separate /boot partition is recognized by its GRUB menu.
+	if name := osReleaseName(dir); name != "" {
+		o := base
+		o.Name = name
+		if cfg := firstExisting(dir, "boot/grub/grub.cfg", "boot/grub2/grub.cfg"); cfg != "" {
+			o.Boot, o.Path = bootConfigFile, "/"+cfg
+			out = append(out, o)
+		} else if kern, initrd := newestKernel(filepath.Join(dir, "boot")); kern != "" {
+			o.Boot, o.Path, o.Args = bootLinux, "/boot/"+kern, "root=UUID="+part.FsUUID+" ro"
+			if initrd != "" {
+				o.Initrd = "/boot/" + initrd
+			}
+			out = append(out, o)
+		}
+	} else if cfg := firstExisting(dir, "grub/grub.cfg", "grub2/grub.cfg"); cfg != "" {
+		o := base
+		o.Name, o.Boot, o.Path = "Linux bootloader", bootConfigFile, "/"+cfg
+		out = append(out, o)
+	}
+	return out
+}
+
+func exists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+// firstExisting returns the first of names which exists beneath dir, or
+// the empty string.
+func firstExisting(dir string, names ...string) string {
+	for _, n := range names {
+		if exists(dir, n) {
+			return n
+		}
+	}
+	return ""
+}
+
+// osReleaseName returns the name of the system whose root filesystem is
+// mounted at dir, from its os-release file, or the empty string.
+func osReleaseName(dir string) string {
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		p := filepath.Join(dir, name)
+		// /etc/os-release is usually a link, which must be resolved
+		// within dir rather than the live system.
+		if target, err := os.Readlink(p); err == nil {
+			if path.IsAbs(target) {
+				p = filepath.Join(dir, target)
+			} else {
+				p = filepath.Join(dir, path.Dir(name), target)
+			}
+		}
+		if !strings.HasPrefix(p, filepath.Clean(dir)+"/") {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			continue
+		}
+		vals := map[string]string{}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if i := strings.IndexByte(s.Text(), '='); i > 0 {
+				vals[s.Text()[:i]] = strings.Trim(s.Text()[i+1:], `"'`)
+			}
+		}
+		f.Close()
+		if vals["PRETTY_NAME"] != "" {
+			return vals["PRETTY_NAME"]
+		}
+		if vals["NAME"] != "" {
+			return vals["NAME"]
+		}
+	}
+	return ""
+}
+
+// newestKernel returns the file names of the last kernel in bootDir (by
+// name) & its initrd, if it has one.
+func newestKernel(bootDir string) (string, string) {
+	ff, err := ioutil.ReadDir(bootDir)
+	if err != nil {
+		return "", ""
+	}
+	var kernels []string
+	for _, f := range ff {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), "vmlinuz-") {
+			kernels = append(kernels, f.Name())
+		}
+	}
+	if len(kernels) == 0 {
+		return "", ""
+	}
+	sort.Strings(kernels)
+	kern := kernels[len(kernels)-1]
+	vers := strings.TrimPrefix(kern, "vmlinuz-")
+	return kern, firstExisting(bootDir, "initrd.img-"+vers, "initramfs-"+vers+".img", "initrd-"+vers)
+}
+
+// grubQuote quotes s for use as a word in grub.cfg.
+func grubQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// menuEntry returns the grub.cfg menu entry which boots the system.
+func (o *OtherOS) menuEntry() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "menuentry %s {\n", grubQuote(o.Desc()))
+	if m := grubFSModules[o.FS]; m != "" {
+		fmt.Fprintf(&b, "        insmod %s\n", m)
+	}
+	fmt.Fprintf(&b, "        search --no-floppy --fs-uuid --set=root %s\n", o.FsUUID)
+	switch o.Boot {
+	case bootEFI:
+		fmt.Fprintf(&b, "        chainloader %s\n", o.Path)
+	case bootChainload:
+		b.WriteString("        insmod chain\n")
+		b.WriteString("        chainloader +1\n")
+	case bootConfigFile:
+		fmt.Fprintf(&b, "        configfile %s\n", o.Path)
+	case bootLinux:
+		fmt.Fprintf(&b, "        linux %s %s\n", o.Path, o.Args)
+		if o.Initrd != "" {
+			fmt.Fprintf(&b, "        initrd %s\n", o.Initrd)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// BootMenuOSes returns the other operating systems added to the boot
+// menu: those which can be booted in the firmware mode being installed
+// for, & which are not on partitions the installation destroys.
+func (s *State) BootMenuOSes() []OtherOS {
+	plan := s.PartitionPlan()
+	var out []OtherOS
+	for _, o := range s.OtherOSes {
+		if (o.Boot == bootEFI && !s.UEFI) || (o.Boot == bootChainload && s.UEFI) {
+			continue
+		}
+		if o.Disk == s.InstallDevice.Path {
+			if part := plan.Partition(o.PartN); !plan.Alongside || part == nil || !part.Existing {
+				continue
+			}
+		}
+		out = append(out, o)
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInspectFS(t *testing.T) {
+	d := &Disk{Path: "/dev/sdz"}
+	tcs := []struct {
+		name  string
+		files map[string]string
+		links map[string]string
+		want  []OtherOS
+	}{
+		{
+			name:  "windows ESP",
+			files: map[string]string{"EFI/Microsoft/Boot/bootmgfw.efi": "", "EFI/Boot/bootx64.efi": ""},
+			want:  []OtherOS{{Name: "Windows Boot Manager", Boot: bootEFI, Path: "/EFI/Microsoft/Boot/bootmgfw.efi"}},
+		},
+		{
+			name:  "windows BIOS",
+			files: map[string]string{"bootmgr": "", "Boot/BCD": ""},
+			want:  []OtherOS{{Name: "Windows", Boot: bootChainload}},
+		},
+		{
+			name: "debian",
+			files: map[string]string{
+				"usr/lib/os-release":          "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nNAME=\"Debian GNU/Linux\"\n",
+				"boot/grub/grub.cfg":          "",
+				"boot/vmlinuz-6.1.0-18-amd64": "",
+			},
+			links: map[string]string{"etc/os-release": "../usr/lib/os-release"},
+			want:  []OtherOS{{Name: "Debian GNU/Linux 12 (bookworm)", Boot: bootConfigFile, Path: "/boot/grub/grub.cfg"}},
+		},
+		{
+			name: "absolute os-release link",
+			files: map[string]string{
+				"usr/lib/os-release":  "NAME=Fedora\n",
+				"boot/grub2/grub.cfg": "",
+			},
+			links: map[string]string{"etc/os-release": "/usr/lib/os-release"},
+			want:  []OtherOS{{Name: "Fedora", Boot: bootConfigFile, Path: "/boot/grub2/grub.cfg"}},
+		},
+		{
+			name: "kernels only",
+			files: map[string]string{
+				"etc/os-release":                    "NAME=\"Arch Linux\"\n",
+				"boot/vmlinuz-linux":                "",
+				"boot/initramfs-linux.img":          "",
+				"boot/initramfs-linux-fallback.img": "",
+			},
+			want: []OtherOS{{Name: "Arch Linux", Boot: bootLinux, Path: "/boot/vmlinuz-linux", Initrd: "/boot/initramfs-linux.img", Args: "root=UUID=0123-4567 ro"}},
+		},
+		{
+			name:  "boot partition",
+			files: map[string]string{"grub/grub.cfg": "", "vmlinuz-6.1.0": ""},
+			want:  []OtherOS{{Name: "Linux bootloader", Boot: bootConfigFile, Path: "/grub/grub.cfg"}},
+		},
+		{
+			name:  "unbootable root",
+			files: map[string]string{"etc/os-release": "NAME=Gentoo\n"},
+		},
+		{
+			name:  "data",
+			files: map[string]string{"photos/cat.jpg": ""},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			for p, target := range tc.links {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, filepath.Join(dir, p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			part := &Disk{Path: "/dev/sdz1", PartN: 1, FS: "ext4", FsUUID: "0123-4567"}
+			for i := range tc.want {
+				tc.want[i].Device, tc.want[i].Disk, tc.want[i].PartN = "/dev/sdz1", "/dev/sdz", 1
+				tc.want[i].FS, tc.want[i].FsUUID = "ext4", "0123-4567"
+			}
+			if got := inspectFS(dir, d, part); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("inspectFS() = %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindOtherOSes(t *testing.T) {
+	fake := useFakeRunner(t)
+	oldDir := probeMountDir
+	probeMountDir = t.TempDir()
+	t.Cleanup(func() { probeMountDir = oldDir })
+
+	// Mounting a partition fills its mount point with the fixture.
+	fixtures := map[string]map[string]string{
+		"/dev/sda1": {"EFI/Microsoft/Boot/bootmgfw.efi": ""},
+		"/dev/sdb1": {"etc/os-release": "NAME=Debian\n", "boot/grub/grub.cfg": ""},
+	}
+	fake.OnRun = func(c FakeCall) {
+		if c.Argv[0] == "mount" {
+			writeFiles(t, c.Argv[len(c.Argv)-1], fixtures[c.Argv[len(c.Argv)-2]])
+		}
+		if c.Argv[0] == "umount" {
+			os.RemoveAll(c.Argv[1])
+		}
+	}
+	fake.Responses = map[string]FakeResponse{
+		"mount -t ntfs -o ro,nosuid,nodev,noexec /dev/sda3 " + filepath.Join(probeMountDir, "sda3"): {Err: errors.New("hibernated")},
+	}
+
+	disks := []Disk{
+		{Path: "/dev/sda", Partitions: []*Disk{
+			{Name: "sda1", Path: "/dev/sda1", PartN: 1, FS: "vfat", FsUUID: "1A2B-3C4D"},
+			{Name: "sda2", Path: "/dev/sda2", PartN: 2},
+			{Name: "sda3", Path: "/dev/sda3", PartN: 3, FS: "ntfs"},
+		}},
+		{Path: "/dev/sdb", Partitions: []*Disk{
+			{Name: "sdb1", Path: "/dev/sdb1", PartN: 1, FS: "ext4", FsUUID: "0c4a1b3e"},
+			{Name: "sdb2", Path: "/dev/sdb2", PartN: 2, FS: "crypto_LUKS"},
+		}},
+		{Path: "/dev/sdc", LiveMedium: true, Partitions: []*Disk{
+			{Name: "sdc1", Path: "/dev/sdc1", PartN: 1, FS: "ext4"},
+		}},
+	}
+	got, err := FindOtherOSes(disks)
+	if err != nil {
+		t.Fatalf("FindOtherOSes() failed: %v", err)
+	}
+	want := []OtherOS{
+		{Name: "Windows Boot Manager", Device: "/dev/sda1", Disk: "/dev/sda", PartN: 1, FS: "vfat", FsUUID: "1A2B-3C4D", Boot: bootEFI, Path: "/EFI/Microsoft/Boot/bootmgfw.efi"},
+		{Name: "Debian", Device: "/dev/sdb1", Disk: "/dev/sdb", PartN: 1, FS: "ext4", FsUUID: "0c4a1b3e", Boot: bootConfigFile, Path: "/boot/grub/grub.cfg"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindOtherOSes() = %+v\nwant %+v", got, want)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"mount -t vfat -o ro,nosuid,nodev,noexec /dev/sda1 " + filepath.Join(probeMountDir, "sda1"),
+		"umount " + filepath.Join(probeMountDir, "sda1"),
+		"mount -t ntfs -o ro,nosuid,nodev,noexec /dev/sda3 " + filepath.Join(probeMountDir, "sda3"),
+		"mount -t ext4 -o ro,nosuid,nodev,noexec,noload /dev/sdb1 " + filepath.Join(probeMountDir, "sdb1"),
+		"umount " + filepath.Join(probeMountDir, "sdb1"),
+	})
+}
+
+func TestBootMenuOSes(t *testing.T) {
+	windowsESP := OtherOS{Name: "Windows Boot Manager", Disk: "/dev/sdz", PartN: 1, Boot: bootEFI}
+	windowsBIOS := OtherOS{Name: "Windows", Disk: "/dev/sdz", PartN: 3, Boot: bootChainload}
+	debian := OtherOS{Name: "Debian", Disk: "/dev/sdy", PartN: 1, Boot: bootConfigFile}
+	all := []OtherOS{windowsESP, windowsBIOS, debian}
+
+	tcs := []struct {
+		name  string
+		state State
+		want  []OtherOS
+	}{
+		{name: "whole disk", state: State{UEFI: true}, want: []OtherOS{debian}},
+		{name: "alongside", state: State{UEFI: true, Alongside: true}, want: []OtherOS{windowsESP, debian}},
+		{name: "alongside BIOS", state: State{Alongside: true}, want: []OtherOS{windowsBIOS, debian}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.state.InstallDevice, tc.state.OtherOSes = dualBootDisk(), all
+			if !tc.state.UEFI {
+				tc.state.InstallDevice.PartTabType = "dos"
+				tc.state.InstallDevice.Partitions = tc.state.InstallDevice.Partitions[2:]
+			}
+			if got := tc.state.BootMenuOSes(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("BootMenuOSes() = %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOtherOSMenuEntry(t *testing.T) {
+	tcs := []struct {
+		os   OtherOS
+		want string
+	}{
+		{
+			os: OtherOS{Name: "Windows Boot Manager", Device: "/dev/sda1", FS: "vfat", FsUUID: "1A2B-3C4D", Boot: bootEFI, Path: "/EFI/Microsoft/Boot/bootmgfw.efi"},
+			want: "menuentry 'Windows Boot Manager (on /dev/sda1)' {\n" +
+				"        insmod fat\n" +
+				"        search --no-floppy --fs-uuid --set=root 1A2B-3C4D\n" +
+				"        chainloader /EFI/Microsoft/Boot/bootmgfw.efi\n" +
+				"}\n",
+		},
+		{
+			os: OtherOS{Name: "Bob's Linux", Device: "/dev/sdb1", FS: "ext4", FsUUID: "0c4a1b3e", Boot: bootLinux, Path: "/boot/vmlinuz-linux", Initrd: "/boot/initramfs-linux.img", Args: "root=UUID=0c4a1b3e ro"},
+			want: "menuentry 'Bob'\\''s Linux (on /dev/sdb1)' {\n" +
+				"        insmod ext2\n" +
+				"        search --no-floppy --fs-uuid --set=root 0c4a1b3e\n" +
+				"        linux /boot/vmlinuz-linux root=UUID=0c4a1b3e ro\n" +
+				"        initrd /boot/initramfs-linux.img\n" +
+				"}\n",
+		},
+	}
+	for _, tc := range tcs {
+		if got := tc.os.menuEntry(); got != tc.want {
+			t.Errorf("menuEntry() =\n%s\nwant:\n%s", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,792 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// mib is the smallest boundary partitions are aligned to.
+	mib = 1024 * 1024
+	// maxAlignMB bounds the alignment derived from a disk's optimal I/O
+	// size, as some USB bridges report nonsensical values.
+	maxAlignMB = 16
+
+	// reservedMB is left unallocated at the start & end of the disk,
+	// for the partition table (and the backup GPT header).
+	reservedMB = 1
+
+	// minExt4MB is the smallest ext4 filesystem worth creating.
+	minExt4MB = 8
+	// minXFSMB & minBtrfsMB are the smallest filesystems mkfs.xfs &
+	// mkfs.btrfs will create.
+	minXFSMB   = 300
+	minBtrfsMB = 128
+	// fat32MinClusters is the fewest clusters a FAT32 filesystem may
+	// have. Clusters are at least a sector, so the ESP must be larger on
+	// 4Kn disks.
+	fat32MinClusters = 65525
+)
+
+// Partition type GUIDs, for GPT partition tables.
+const (
+	linuxFSTypeGUID = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	luksTypeGUID    = "CA7D7CCB-63ED-4C53-861C-1742536059CC"
+	espTypeGUID     = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	swapTypeGUID    = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+)
+
+// Partition type codes, for msdos partition tables.
+const (
+	linuxTypeCode = "83"
+	espTypeCode   = "ef"
+	swapTypeCode  = "82"
+)
+
+// Filesystems are the filesystem types new partitions may be formatted
+// with.
+var Filesystems = []string{"ext4", "xfs", "btrfs", "fat32", "swap"}
+
+// extendedTypeCodes are the msdos partition types which hold logical
+// partitions.
+var extendedTypeCodes = map[string]bool{"0x5": true, "0xf": true, "0x85": true}
+
+// PlannedPartition describes a partition in a PartitionPlan. Offsets are
+// in logical sectors from the start of the disk; End is exclusive.
+type PlannedPartition struct {
+	Num int `json:"num"`
+	// Name is the GPT partition name.
+	Name string `json:"name"`
+	// Type is the partition type GUID on GPT tables, or the type code on
+	// msdos tables.
+	Type       string `json:"type"`
+	Filesystem string `json:"filesystem"`
+	// Label is the filesystem label, if any.
+	Label string `json:"label,omitempty"`
+	// Encrypted is set if the filesystem is inside a LUKS volume.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// MountPoint is where the filesystem is mounted in the installed
+	// system, if it is.
+	MountPoint string `json:"mount_point,omitempty"`
+	// Bootable sets the boot flag on msdos tables.
+	Bootable    bool   `json:"bootable,omitempty"`
+	Desc        string `json:"desc"`
+	StartSector int64  `json:"start_sector"`
+	EndSector   int64  `json:"end_sector"`
+
+	// Existing is set for partitions already on the disk, which are
+	// preserved when installing alongside them.
+	Existing bool `json:"existing,omitempty"`
+	// OldEndSector is the end of an existing partition which is shrunk
+	// to make room for the installation, or zero.
+	OldEndSector int64 `json:"old_end_sector,omitempty"`
+}
+
+// Sectors returns the size of the partition, in logical sectors.
+func (p *PlannedPartition) Sectors() int64 {
+	return p.EndSector - p.StartSector
+}
+
+// Change describes what the installation does to the partition.
+func (p *PlannedPartition) Change() string {
+	switch {
+	case p.OldEndSector != 0:
+		return "Shrunk"
+	case p.Existing:
+		return "Preserved"
+	}
+	return "New"
+}
+
+// PartitionPlan is the partition table to be written to a disk.
+type PartitionPlan struct {
+	Device string `json:"device"`
+	// Table is the partition table type, gpt or msdos.
+	Table string `json:"table"`
+	// SectorSize is the logical sector size of the disk, & Sectors its
+	// capacity in logical sectors.
+	SectorSize int64 `json:"sector_size"`
+	Sectors    int64 `json:"sectors"`
+	// Partition boundaries are multiples of Align bytes, plus AlignOffset.
+	Align       int64 `json:"align"`
+	AlignOffset int64 `json:"align_offset,omitempty"`
+	// Alongside is set if the existing partitions are preserved, & the
+	// new partitions added to the table in free space.
+	Alongside bool `json:"alongside,omitempty"`
+	// Custom is set if the new partitions were laid out by the user,
+	// rather than being the default layout.
+	Custom bool `json:"custom,omitempty"`
+	// UEFI is set if the installation boots using UEFI, so needs an EFI
+	// system partition.
+	UEFI bool `json:"uefi,omitempty"`
+
+	Partitions []PlannedPartition `json:"partitions"`
+	// VolumeGroup is the LVM volume group created inside the encrypted
+	// root partition, which holds Volumes, if LVM is used.
+	VolumeGroup string          `json:"volume_group,omitempty"`
+	Volumes     []LogicalVolume `json:"volumes,omitempty"`
+	// Subvolumes are created in the root filesystem & mounted in place of
+	// its top level, if it is btrfs.
+	Subvolumes []Subvolume `json:"subvolumes,omitempty"`
+
+	// err is why the plan could not be made, which Validate returns.
+	err error
+}
+
+// PartitionOptions are the choices which affect the partition layout.
+type PartitionOptions struct {
+	// UEFI selects a GPT table with an EFI system partition, rather than
+	// an msdos table for BIOS booting.
+	UEFI bool
+	// Alongside preserves the disk's existing partitions, installing
+	// into its largest free space.
+	Alongside bool
+	// Shrink is the number of an existing ext4 or NTFS partition to
+	// shrink to ShrinkToMB before installing alongside, or zero.
+	Shrink, ShrinkToMB int
+	// Layout, if set, replaces the default layout of the new partitions.
+	Layout []CustomPartition
+	// LVM, if set, splits the encrypted root partition into logical
+	// volumes.
+	LVM *LVMOptions
+	// RootFS is the filesystem of the root partition in the default
+	// layout (& so of the root & home volumes with LVM): ext4 if empty,
+	// or btrfs.
+	RootFS string
+}
+
+// rootFS returns the filesystem of the root partition in the default
+// layout.
+func (o PartitionOptions) rootFS() string {
+	if o.RootFS == "" {
+		return "ext4"
+	}
+	return o.RootFS
+}
+
+// CustomPartition is a partition in a layout chosen by the user.
+// Partitions are allocated in order from the start of the space being
+// installed into: the whole disk, or the largest free space when
+// installing alongside other systems.
+type CustomPartition struct {
+	// SizeMB is the size of the partition in MiB, or zero for the
+	// partition which takes the space left by the others.
+	SizeMB     int    `json:"size_mb"`
+	Filesystem string `json:"filesystem"`
+	MountPoint string `json:"mount_point,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	// Name is the GPT partition name & Desc describes the partition. They
+	// are derived from the mount point if empty.
+	Name string `json:"name,omitempty"`
+	Desc string `json:"desc,omitempty"`
+}
+
+// NewPartitionPlan computes the default layout for d: a boot partition,
+// the encrypted root partition, the metadata partition & for UEFI, the
+// EFI system partition. The EFI system partition is created last so the
+// other partitions keep the same numbering as the msdos layout.
+//
+// Partitions are aligned to 1MiB, or to a multiple of the optimal I/O
+// size (such as a RAID stripe) if larger. The plan is not validated, as
+// the disk may be too small.
+//
+// With opts.Alongside, the boot, root & metadata partitions are instead
+// added to the existing partition table: see planAlongside. With
+// opts.Layout, the user's partitions replace them: see addLayout. With
+// opts.LVM, the encrypted root partition holds logical volumes for root,
+// home & swap instead: see addVolumes. A btrfs root filesystem is split
+// into subvolumes: see addSubvolumes.
+func NewPartitionPlan(d *Disk, opts PartitionOptions) *PartitionPlan {
+	p := &PartitionPlan{
+		Device:      d.Path,
+		Table:       "msdos",
+		SectorSize:  int64(d.logicalBlockSize()),
+		Align:       mib,
+		AlignOffset: int64(d.AlignmentOffset),
+		UEFI:        opts.UEFI,
+	}
+	p.Sectors = d.SizeBytes() / p.SectorSize
+	if opts.UEFI {
+		p.Table = "gpt"
+	}
+	for _, n := range []int64{int64(d.physicalBlockSize()), int64(d.OptimalIOSize)} {
+		if n <= 0 || n%p.SectorSize != 0 {
+			continue
+		}
+		if a := lcm(p.Align, n); a <= maxAlignMB*mib {
+			p.Align = a
+		}
+	}
+
+	switch {
+	case opts.RootFS != "" && opts.RootFS != "ext4" && opts.RootFS != "btrfs":
+		p.err = fmt.Errorf("the root filesystem must be ext4 or btrfs, not %q", opts.RootFS)
+	case opts.Alongside:
+		p.planAlongside(d, opts)
+	case opts.Layout != nil:
+		start, end := p.freeSpace()
+		p.addLayout(opts, start, end)
+	default:
+		p.planDefault(opts)
+	}
+	if opts.LVM != nil && p.err == nil {
+		p.addVolumes(*opts.LVM)
+	}
+	if p.err == nil {
+		p.addSubvolumes()
+	}
+	return p
+}
+
+// planDefault lays out the default partitions across the whole disk.
+func (p *PartitionPlan) planDefault(opts PartitionOptions) {
+	bootStart := p.alignUp(reservedMB * mib)
+	bootEnd := bootStart + p.roundUp(bootPartSizeMB*mib)
+	espEnd := p.alignDown(p.Sectors*p.SectorSize - reservedMB*mib)
+	espStart := espEnd
+	if opts.UEFI {
+		espBytes := int64(espPartSizeMB * mib)
+		if min := fat32MinBytes(p.SectorSize); min > espBytes {
+			espBytes = min
+		}
+		espStart -= p.roundUp(espBytes)
+	}
+	metadataStart := espStart - p.roundUp(metadataPartSizeMB*mib)
+
+	p.add(PlannedPartition{Num: 1, Name: "boot", Type: linuxFSTypeGUID, Filesystem: "ext4", MountPoint: "/boot", Bootable: !opts.UEFI, Desc: "Boot partition"}, bootStart, bootEnd)
+	p.add(PlannedPartition{Num: 2, Name: "root", Type: luksTypeGUID, Filesystem: opts.rootFS(), Encrypted: true, MountPoint: "/", Desc: "Encrypted root partition"}, bootEnd, metadataStart)
+	p.add(PlannedPartition{Num: 3, Name: "metadata", Type: linuxFSTypeGUID, Filesystem: "ext4", Desc: "TwitchyLinux metadata partition"}, metadataStart, espStart)
+	if opts.UEFI {
+		p.add(PlannedPartition{Num: espPartNum, Name: "EFI", Type: espTypeGUID, Filesystem: "fat32", Label: "EFI", MountPoint: "/boot/efi", Desc: "EFI system partition"}, espStart, espEnd)
+	}
+}
+
+// planAlongside plans the installation into the largest free space on d,
+// after shrinking the partition opts.Shrink if set. The existing
+// partitions are kept, so the table type is d's rather than the one
+// opts.UEFI implies, & an existing EFI system partition is shared rather
+// than creating another.
+func (p *PartitionPlan) planAlongside(d *Disk, opts PartitionOptions) {
+	p.Alongside = true
+	switch d.PartTabType {
+	case "gpt":
+		p.Table = "gpt"
+		if !opts.UEFI {
+			p.err = fmt.Errorf("%s has a GPT partition table, which BIOS installs cannot boot from alongside other systems", d.Path)
+			return
+		}
+	case "dos":
+		p.Table = "msdos"
+	default:
+		p.err = fmt.Errorf("%s has no partition table to install alongside", d.Path)
+		return
+	}
+
+	esp := -1
+	for _, e := range d.Partitions {
+		if p.Table == "msdos" && extendedTypeCodes[e.PartType] {
+			p.err = fmt.Errorf("%s has an extended partition, which is not supported when installing alongside", d.Path)
+			return
+		}
+		part := PlannedPartition{
+			Num:         e.PartN,
+			Type:        e.PartType,
+			Filesystem:  e.FS,
+			Label:       e.Label,
+			Desc:        "Existing partition",
+			StartSector: int64(e.Start) * blockSize / p.SectorSize,
+			EndSector:   int64(e.Start+e.NumBlocks) * blockSize / p.SectorSize,
+			Existing:    true,
+		}
+		if e.Label != "" {
+			part.Desc = fmt.Sprintf("Existing partition %q", e.Label)
+		}
+		p.Partitions = append(p.Partitions, part)
+		if opts.UEFI && esp < 0 && isESPType(e.PartType) {
+			esp = len(p.Partitions) - 1
+		}
+	}
+	if esp >= 0 {
+		p.Partitions[esp].MountPoint, p.Partitions[esp].Desc = "/boot/efi", "Existing EFI system partition"
+	}
+
+	if opts.Shrink != 0 {
+		part := p.Partition(opts.Shrink)
+		switch {
+		case part == nil:
+			p.err = fmt.Errorf("%s has no partition %d to shrink", d.Path, opts.Shrink)
+			return
+		case part.Filesystem != "ext4" && part.Filesystem != "ntfs":
+			p.err = fmt.Errorf("partition %d holds %q, but only ext4 & NTFS filesystems can be shrunk", part.Num, part.Filesystem)
+			return
+		}
+		end := p.alignDown(p.Bytes(part.StartSector)+int64(opts.ShrinkToMB)*mib) / p.SectorSize
+		if end <= part.StartSector || end >= part.EndSector {
+			p.err = fmt.Errorf("partition %d (%s) cannot be shrunk to %dMB", part.Num, ByteCountDecimal(p.Bytes(part.Sectors())), opts.ShrinkToMB)
+			return
+		}
+		part.OldEndSector, part.EndSector = part.EndSector, end
+	}
+
+	start, end := p.freeSpace()
+	if opts.Layout != nil {
+		p.addLayout(opts, start, end)
+		return
+	}
+	espBytes := int64(0)
+	if opts.UEFI && esp < 0 {
+		espBytes = p.roundUp(espPartSizeMB * mib)
+		if min := fat32MinBytes(p.SectorSize); min > espBytes {
+			espBytes = p.roundUp(min)
+		}
+	}
+	bootEnd := start + p.roundUp(bootPartSizeMB*mib)
+	espStart := end - espBytes
+	metadataStart := espStart - p.roundUp(metadataPartSizeMB*mib)
+	if metadataStart-bootEnd < (minExt4MB+luksHeaderMB)*mib {
+		p.err = fmt.Errorf("the largest free space on %s is %s, too small to install into", d.Path, ByteCountDecimal(end-start))
+		return
+	}
+
+	p.add(PlannedPartition{Num: p.freeNum(), Name: "boot", Type: linuxFSTypeGUID, Filesystem: "ext4", MountPoint: "/boot", Bootable: !opts.UEFI, Desc: "Boot partition"}, start, bootEnd)
+	p.add(PlannedPartition{Num: p.freeNum(), Name: "root", Type: luksTypeGUID, Filesystem: opts.rootFS(), Encrypted: true, MountPoint: "/", Desc: "Encrypted root partition"}, bootEnd, metadataStart)
+	p.add(PlannedPartition{Num: p.freeNum(), Name: "metadata", Type: linuxFSTypeGUID, Filesystem: "ext4", Desc: "TwitchyLinux metadata partition"}, metadataStart, espStart)
+	if espBytes > 0 {
+		p.add(PlannedPartition{Num: p.freeNum(), Name: "EFI", Type: espTypeGUID, Filesystem: "fat32", Label: "EFI", MountPoint: "/boot/efi", Desc: "EFI system partition"}, espStart, end)
+	}
+}
+
+// addLayout allocates the partitions of opts.Layout in order between the
+// start & end byte offsets.
+func (p *PartitionPlan) addLayout(opts PartitionOptions, start, end int64) {
+	p.Custom = true
+	rest, filling := end-start, 0
+	for _, c := range opts.Layout {
+		if c.SizeMB <= 0 {
+			filling++
+		} else {
+			rest -= p.roundUp(int64(c.SizeMB) * mib)
+		}
+	}
+	if filling > 1 {
+		p.err = errors.New("only one partition can take the remaining space")
+		return
+	}
+	if rest < 0 || (filling > 0 && rest == 0) {
+		p.err = fmt.Errorf("the partitions do not fit in the %s available", ByteCountDecimal(end-start))
+		return
+	}
+
+	for _, c := range opts.Layout {
+		size := rest
+		if c.SizeMB > 0 {
+			size = p.roundUp(int64(c.SizeMB) * mib)
+		}
+		part := PlannedPartition{
+			Num:        p.freeNum(),
+			Name:       c.Name,
+			Type:       linuxFSTypeGUID,
+			Filesystem: c.Filesystem,
+			Label:      c.Label,
+			Encrypted:  c.Encrypted,
+			MountPoint: c.MountPoint,
+			Bootable:   !opts.UEFI && c.MountPoint == "/boot",
+			Desc:       c.Desc,
+		}
+		switch {
+		case c.MountPoint == "/boot/efi":
+			part.Type = espTypeGUID
+		case c.Encrypted:
+			part.Type = luksTypeGUID
+		case c.Filesystem == "swap":
+			part.Type = swapTypeGUID
+		}
+		if part.Name == "" {
+			part.Name = defaultPartName(&part)
+		}
+		if part.Desc == "" {
+			part.Desc = defaultPartDesc(&part)
+		}
+		p.add(part, start, start+size)
+		start += size
+	}
+}
+
+// defaultPartName returns the GPT partition name of a custom partition
+// without one: the last element of its mount point.
+func defaultPartName(part *PlannedPartition) string {
+	switch {
+	case part.Filesystem == "swap":
+		return "swap"
+	case part.MountPoint == "/":
+		return "root"
+	case part.MountPoint == "/boot/efi":
+		return "EFI"
+	case part.MountPoint != "":
+		return path.Base(part.MountPoint)
+	}
+	return part.Label
+}
+
+// defaultPartDesc describes a custom partition without a description.
+func defaultPartDesc(part *PlannedPartition) string {
+	var desc string
+	switch part.MountPoint {
+	case "":
+		desc = "Unmounted partition"
+		if part.Filesystem == "swap" {
+			desc = "Swap partition"
+		}
+	case "/":
+		desc = "Root partition"
+	case "/boot":
+		desc = "Boot partition"
+	case "/boot/efi":
+		desc = "EFI system partition"
+	default:
+		desc = "Partition for " + part.MountPoint
+	}
+	if part.Encrypted {
+		desc = "Encrypted " + strings.ToLower(desc[:1]) + desc[1:]
+	}
+	return desc
+}
+
+// DefaultLayout returns the partitions NewPartitionPlan creates on d
+// without a custom layout, as a starting point for one. The root
+// partition takes the remaining space.
+func DefaultLayout(d *Disk, opts PartitionOptions) []CustomPartition {
+	opts.Layout, opts.LVM = nil, nil
+	p := NewPartitionPlan(d, opts)
+	var out []CustomPartition
+	for _, part := range p.sorted() {
+		if part.Existing {
+			continue
+		}
+		c := CustomPartition{
+			SizeMB:     int(p.Bytes(part.Sectors()) / mib),
+			Filesystem: part.Filesystem,
+			MountPoint: part.MountPoint,
+			Label:      part.Label,
+			Encrypted:  part.Encrypted,
+			Name:       part.Name,
+			Desc:       part.Desc,
+		}
+		if part.MountPoint == "/" {
+			c.SizeMB = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// isESPType returns true if t is the partition type of an EFI system
+// partition, on either table type.
+func isESPType(t string) bool {
+	return strings.EqualFold(t, espTypeGUID) || t == "0x"+espTypeCode
+}
+
+// freeSpace returns the aligned byte offsets of the largest region of the
+// disk not allocated to a partition.
+func (p *PartitionPlan) freeSpace() (int64, int64) {
+	parts := p.sorted()
+	diskEnd := p.Bytes(p.Sectors) - reservedMB*mib
+	if p.Table == "msdos" && diskEnd > p.Bytes(1<<32) {
+		diskEnd = p.Bytes(1 << 32)
+	}
+
+	var bestStart, bestEnd int64
+	prev := int64(reservedMB * mib)
+	for i := 0; i <= len(parts); i++ {
+		next := diskEnd
+		if i < len(parts) {
+			next = p.Bytes(parts[i].StartSector)
+		}
+		if start, end := p.alignUp(prev), p.alignDown(next); end-start > bestEnd-bestStart {
+			bestStart, bestEnd = start, end
+		}
+		if i < len(parts) && p.Bytes(parts[i].EndSector) > prev {
+			prev = p.Bytes(parts[i].EndSector)
+		}
+	}
+	return bestStart, bestEnd
+}
+
+// freeNum returns the lowest partition number not in use.
+func (p *PartitionPlan) freeNum() int {
+	n := 1
+	for p.Partition(n) != nil {
+		n++
+	}
+	return n
+}
+
+// add appends a partition between the start & end byte offsets.
+func (p *PartitionPlan) add(part PlannedPartition, start, end int64) {
+	if p.Table == "msdos" {
+		part.Name = ""
+		switch part.Type {
+		case espTypeGUID:
+			part.Type = espTypeCode
+		case swapTypeGUID:
+			part.Type = swapTypeCode
+		default:
+			part.Type = linuxTypeCode
+		}
+	}
+	part.StartSector, part.EndSector = start/p.SectorSize, end/p.SectorSize
+	p.Partitions = append(p.Partitions, part)
+}
+
+// Partition returns the partition numbered num, or nil.
+func (p *PartitionPlan) Partition(num int) *PlannedPartition {
+	for i := range p.Partitions {
+		if p.Partitions[i].Num == num {
+			return &p.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// MountedAt returns the partition mounted at mountPoint in the installed
+// system, or nil.
+func (p *PartitionPlan) MountedAt(mountPoint string) *PlannedPartition {
+	for i := range p.Partitions {
+		if p.Partitions[i].MountPoint == mountPoint {
+			return &p.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// NewBytes returns the total size of the partitions to be created.
+func (p *PartitionPlan) NewBytes() int64 {
+	var n int64
+	for _, part := range p.Partitions {
+		if !part.Existing {
+			n += p.Bytes(part.Sectors())
+		}
+	}
+	return n
+}
+
+// sorted returns the partitions in the order they appear on the disk.
+func (p *PartitionPlan) sorted() []*PlannedPartition {
+	parts := make([]*PlannedPartition, len(p.Partitions))
+	for i := range p.Partitions {
+		parts[i] = &p.Partitions[i]
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].StartSector < parts[j].StartSector })
+	return parts
+}
+
+// Bytes converts a number of logical sectors to bytes.
+func (p *PartitionPlan) Bytes(sectors int64) int64 {
+	return sectors * p.SectorSize
+}
+
+func lcm(a, b int64) int64 {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// alignUp & alignDown round b to the nearest partition boundary.
+func (p *PartitionPlan) alignUp(b int64) int64 {
+	return p.alignDown(b + p.Align - 1)
+}
+
+func (p *PartitionPlan) alignDown(b int64) int64 {
+	return (b-p.AlignOffset)/p.Align*p.Align + p.AlignOffset
+}
+
+// roundUp rounds a partition size up to a multiple of the alignment.
+func (p *PartitionPlan) roundUp(b int64) int64 {
+	return (b + p.Align - 1) / p.Align * p.Align
+}
+
+func (p *PartitionPlan) aligned(sector int64) bool {
+	return (p.Bytes(sector)-p.AlignOffset)%p.Align == 0
+}
+
+// fat32MinBytes returns the size of the smallest FAT32 filesystem, with
+// room for the FATs.
+func fat32MinBytes(sectorSize int64) int64 {
+	return fat32MinClusters*sectorSize + mib
+}
+
+// minPartitionBytes returns the smallest size the partition may be.
+func minPartitionBytes(part *PlannedPartition, sectorSize int64) int64 {
+	var min int64
+	switch part.Filesystem {
+	case "ext4":
+		min = minExt4MB * mib
+	case "xfs":
+		min = minXFSMB * mib
+	case "btrfs":
+		min = minBtrfsMB * mib
+	case "fat32":
+		min = fat32MinBytes(sectorSize)
+	}
+	if part.Encrypted {
+		min += luksHeaderMB * mib
+	}
+	return min
+}
+
+// Validate returns an error if the partitions overlap, are misaligned,
+// too small or don't fit on the disk, or if the installed system could
+// not be mounted from them (see validateMounts). Existing partitions are
+// only checked for overlaps, as they were laid out by other tools.
+func (p *PartitionPlan) Validate() error {
+	if p.err != nil {
+		return p.err
+	}
+	switch p.Table {
+	case "gpt", "msdos":
+	default:
+		return fmt.Errorf("unknown partition table type %q", p.Table)
+	}
+	if p.SectorSize <= 0 || p.Align <= 0 || p.Align%p.SectorSize != 0 {
+		return fmt.Errorf("invalid geometry: %d-byte sectors, aligned to %d bytes", p.SectorSize, p.Align)
+	}
+
+	reserved := (reservedMB*mib + p.SectorSize - 1) / p.SectorSize
+	first, last := reserved, p.Sectors-reserved
+	if p.Table == "msdos" && last > 1<<32 {
+		last = 1 << 32
+	}
+
+	parts := p.sorted()
+	nums := map[int]bool{}
+	for i, part := range parts {
+		var problem string
+		switch min := minPartitionBytes(part, p.SectorSize); {
+		case part.Num < 1 || nums[part.Num]:
+			problem = "has an invalid or duplicate number"
+		case part.EndSector <= part.StartSector:
+			problem = "ends before it starts"
+		case part.Existing:
+			// Existing partitions were laid out by other tools.
+		case p.Table == "msdos" && part.Num > 4:
+			problem = "is not one of the 4 primary partitions msdos partition tables are limited to"
+		case part.StartSector < first || part.EndSector > last:
+			problem = fmt.Sprintf("extends outside sectors %d-%d", first, last)
+		case !p.aligned(part.StartSector) || !p.aligned(part.EndSector):
+			problem = fmt.Sprintf("is not aligned to %d bytes", p.Align)
+		case p.Bytes(part.Sectors()) < min:
+			problem = fmt.Sprintf("is %s, smaller than the minimum of %s", ByteCountDecimal(p.Bytes(part.Sectors())), ByteCountDecimal(min))
+		}
+		if problem == "" && i > 0 && part.StartSector < parts[i-1].EndSector {
+			problem = fmt.Sprintf("overlaps partition %d", parts[i-1].Num)
+		}
+		if problem != "" {
+			return fmt.Errorf("partition %d (%s) %s", part.Num, part.Desc, problem)
+		}
+		nums[part.Num] = true
+	}
+	return p.validateMounts()
+}
+
+// validateMounts returns an error unless the new partitions have known
+// filesystems, & there are partitions (or logical volumes) to mount at /
+// & /boot (and for UEFI, /boot/efi) which GRUB can boot from.
+func (p *PartitionPlan) validateMounts() error {
+	mounts := map[string]bool{}
+	for _, part := range p.sorted() {
+		if !part.Existing && !isFilesystem(part.Filesystem) && part != p.physicalVolume() {
+			return fmt.Errorf("partition %d (%s) has unknown filesystem %q", part.Num, part.Desc, part.Filesystem)
+		}
+		mp := part.MountPoint
+		if mp == "" {
+			continue
+		}
+		var problem string
+		switch {
+		case part.Filesystem == "swap":
+			problem = "is swap space, so cannot be mounted"
+		case !path.IsAbs(mp) || path.Clean(mp) != mp:
+			problem = fmt.Sprintf("has invalid mount point %q", mp)
+		case mounts[mp]:
+			problem = fmt.Sprintf("is mounted at %s, as is another partition", mp)
+		case strings.HasPrefix(mp, "/boot/") && mp != "/boot/efi":
+			problem = "is mounted beneath /boot, which is for the boot partition"
+		case (mp == "/boot" || mp == "/boot/efi") && part.Encrypted:
+			problem = "is read by the bootloader, so cannot be encrypted"
+		case mp == "/boot/efi" && part.Filesystem != "fat32" && part.Filesystem != "vfat":
+			problem = "is the EFI system partition, which must be FAT32"
+		}
+		if problem != "" {
+			return fmt.Errorf("partition %d (%s) %s", part.Num, part.Desc, problem)
+		}
+		mounts[mp] = true
+	}
+	for _, lv := range p.Volumes {
+		if lv.MountPoint == "" {
+			continue
+		}
+		if mounts[lv.MountPoint] {
+			return fmt.Errorf("the %s is mounted at %s, as is a partition", strings.ToLower(lv.Desc), lv.MountPoint)
+		}
+		mounts[lv.MountPoint] = true
+	}
+
+	required := []string{"/", "/boot"}
+	if p.UEFI {
+		required = append(required, "/boot/efi")
+	}
+	for _, mp := range required {
+		if !mounts[mp] {
+			return fmt.Errorf("no partition is mounted at %s", mp)
+		}
+	}
+	return nil
+}
+
+func isFilesystem(fs string) bool {
+	for _, f := range Filesystems {
+		if f == fs {
+			return true
+		}
+	}
+	return false
+}
+
+// sfdiskScript returns the input to sfdisk which creates the partition
+// table, or when installing alongside, the new partitions to append to it.
+func (p *PartitionPlan) sfdiskScript() string {
+	var b strings.Builder
+	if p.Alongside {
+		b.WriteString("unit: sectors\n\n")
+	} else {
+		label := p.Table
+		if label == "msdos" {
+			label = "dos"
+		}
+		fmt.Fprintf(&b, "label: %s\nunit: sectors\n\n", label)
+	}
+
+	parts := append([]PlannedPartition{}, p.Partitions...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Num < parts[j].Num })
+	d := Disk{Path: p.Device}
+	for _, part := range parts {
+		if part.Existing {
+			continue
+		}
+		fmt.Fprintf(&b, "%s : start=%d, size=%d, type=%s", d.pathForPartition(part.Num), part.StartSector, part.Sectors(), part.Type)
+		if part.Name != "" {
+			fmt.Fprintf(&b, ", name=%q", part.Name)
+		}
+		if part.Bootable {
+			b.WriteString(", bootable")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,357 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewPartitionPlanGeometry(t *testing.T) {
+	makeFakeDisks(t)
+	disks, err := readDisks()
+	if err != nil {
+		t.Fatalf("readDisks() failed: %v", err)
+	}
+	nvme, sda := disks[0], disks[1]
+	const numBlocks = 16 * 1024 * 1024 * 1024 / blockSize
+
+	tcs := []struct {
+		name                  string
+		disk                  Disk
+		wantSector            int64
+		wantAlign, wantOffset int64
+		wantBootStart         int64
+	}{
+		{name: "512e", disk: sda, wantSector: 512, wantAlign: mib, wantBootStart: 2048},
+		{name: "4Kn", disk: nvme, wantSector: 4096, wantAlign: mib, wantBootStart: 256},
+		{
+			name:       "raid stripe",
+			disk:       Disk{NumBlocks: numBlocks, OptimalIOSize: 384 * 1024},
+			wantSector: 512, wantAlign: 3 * mib, wantBootStart: 6144,
+		},
+		{
+			name:       "bogus optimal io size",
+			disk:       Disk{NumBlocks: numBlocks, OptimalIOSize: 33553920},
+			wantSector: 512, wantAlign: mib, wantBootStart: 2048,
+		},
+		{
+			name:       "alignment offset",
+			disk:       Disk{NumBlocks: numBlocks, LogicalBlockSize: 512, PhysicalBlockSize: 4096, AlignmentOffset: 3584},
+			wantSector: 512, wantAlign: mib, wantOffset: 3584, wantBootStart: 2055,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := NewPartitionPlan(&tc.disk, PartitionOptions{UEFI: true})
+			if err := plan.Validate(); err != nil {
+				t.Errorf("Validate() failed: %v", err)
+			}
+			layout := plan.Partitions
+			if got := layout[0].StartSector; got != tc.wantBootStart {
+				t.Errorf("boot partition starts at sector %d, want %d", got, tc.wantBootStart)
+			}
+
+			var prevEnd int64
+			for _, p := range layout {
+				start, end := p.StartSector*tc.wantSector, p.EndSector*tc.wantSector
+				if (start-tc.wantOffset)%tc.wantAlign != 0 || (end-tc.wantOffset)%tc.wantAlign != 0 {
+					t.Errorf("partition %d (%d-%d) is not aligned to %d+%d", p.Num, start, end, tc.wantAlign, tc.wantOffset)
+				}
+				if prevEnd != 0 && start != prevEnd {
+					t.Errorf("partition %d starts at %d, want %d", p.Num, start, prevEnd)
+				}
+				prevEnd = end
+			}
+			if boot := layout[0]; (boot.EndSector-boot.StartSector)*tc.wantSector < bootPartSizeMB*mib {
+				t.Errorf("boot partition is smaller than %dMiB", bootPartSizeMB)
+			}
+			if max := tc.disk.SizeBytes() - reservedMB*mib; prevEnd > max {
+				t.Errorf("partitions end at %d, past %d", prevEnd, max)
+			}
+		})
+	}
+}
+
+func TestPartitionPlanSfdiskScript(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+	tcs := []struct {
+		name string
+		uefi bool
+		want string
+	}{
+		{
+			name: "gpt",
+			uefi: true,
+			want: "label: gpt\nunit: sectors\n\n" +
+				"/dev/sdz1 : start=2048, size=524288, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name=\"boot\"\n" +
+				"/dev/sdz2 : start=526336, size=32632832, type=CA7D7CCB-63ED-4C53-861C-1742536059CC, name=\"root\"\n" +
+				"/dev/sdz3 : start=33159168, size=131072, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name=\"metadata\"\n" +
+				"/dev/sdz4 : start=33290240, size=262144, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, name=\"EFI\"\n",
+		},
+		{
+			name: "msdos",
+			want: "label: dos\nunit: sectors\n\n" +
+				"/dev/sdz1 : start=2048, size=524288, type=83, bootable\n" +
+				"/dev/sdz2 : start=526336, size=32894976, type=83\n" +
+				"/dev/sdz3 : start=33421312, size=131072, type=83\n",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewPartitionPlan(disk, PartitionOptions{UEFI: tc.uefi}).sfdiskScript(); got != tc.want {
+				t.Errorf("sfdiskScript() =\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPartitionPlanValidate(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+	tcs := []struct {
+		name   string
+		modify func(p *PartitionPlan)
+		ok     bool
+	}{
+		{name: "default", modify: func(p *PartitionPlan) {}, ok: true},
+		{name: "overlap", modify: func(p *PartitionPlan) { p.Partitions[1].StartSector -= 2048 }},
+		{name: "misaligned", modify: func(p *PartitionPlan) { p.Partitions[0].EndSector -= 8 }},
+		{name: "past the end", modify: func(p *PartitionPlan) { p.Partitions[3].EndSector = p.Sectors }},
+		{name: "before the start", modify: func(p *PartitionPlan) { p.Partitions[0].StartSector = 0 }},
+		{name: "duplicate number", modify: func(p *PartitionPlan) { p.Partitions[3].Num = 1 }},
+		{name: "unknown table", modify: func(p *PartitionPlan) { p.Table = "apm" }},
+		{
+			name: "ESP too small",
+			modify: func(p *PartitionPlan) {
+				p.Partitions[2].EndSector += 96 * 2048
+				p.Partitions[3].StartSector += 96 * 2048
+			},
+		},
+		{
+			name: "too many msdos partitions",
+			modify: func(p *PartitionPlan) {
+				p.Table = "msdos"
+				p.Partitions = append(p.Partitions, PlannedPartition{Num: 5, Filesystem: "ext4", StartSector: p.Partitions[3].EndSector, EndSector: p.Partitions[3].EndSector + 2048})
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewPartitionPlan(disk, PartitionOptions{UEFI: true})
+			tc.modify(p)
+			if err := p.Validate(); (err == nil) != tc.ok {
+				t.Errorf("Validate() = %v, want ok = %v", err, tc.ok)
+			}
+		})
+	}
+
+	// Disks too small for the root partition are rejected.
+	small := &Disk{Path: "/dev/sdz", NumBlocks: 400 * 1024 * 1024 / blockSize}
+	if err := NewPartitionPlan(small, PartitionOptions{UEFI: true}).Validate(); err == nil {
+		t.Error("Validate() accepted a plan for a 400MiB disk")
+	}
+}
+
+// dualBootDisk returns a 48GiB disk holding a Windows installation: an
+// ESP, the Microsoft reserved partition & a 40GiB NTFS partition.
+func dualBootDisk() *Disk {
+	d := &Disk{Path: "/dev/sdz", NumBlocks: 48 * 1024 * 1024 * 2, PartTabType: "gpt"}
+	for _, p := range []Disk{
+		{PartN: 1, Start: 2048, NumBlocks: 100 * 2048, PartType: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b", FS: "vfat"},
+		{PartN: 2, Start: 206848, NumBlocks: 16 * 2048, PartType: "e3c9e316-0b5c-4db8-817d-f92df00215ae"},
+		{PartN: 3, Start: 239616, NumBlocks: 40 * 1024 * 2048, PartType: "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7", FS: "ntfs", Label: "Windows"},
+	} {
+		p := p
+		d.Partitions = append(d.Partitions, &p)
+	}
+	return d
+}
+
+func TestNewPartitionPlanAlongside(t *testing.T) {
+	plan := NewPartitionPlan(dualBootDisk(), PartitionOptions{UEFI: true, Alongside: true})
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	if esp := plan.MountedAt("/boot/efi"); esp == nil || esp.Num != 1 || !esp.Existing {
+		t.Errorf("EFI system partition = %+v, want the existing partition 1", esp)
+	}
+	for _, want := range []struct {
+		mountPoint string
+		num        int
+	}{{"/boot", 4}, {"/", 5}} {
+		if p := plan.MountedAt(want.mountPoint); p == nil || p.Num != want.num || p.Existing {
+			t.Errorf("partition mounted at %s = %+v, want new partition %d", want.mountPoint, p, want.num)
+		}
+	}
+	// The new partitions fill the space after the Windows partition.
+	if boot := plan.Partition(4); boot.StartSector != 239616+40*1024*2048 {
+		t.Errorf("boot partition starts at sector %d, want %d", boot.StartSector, 239616+40*1024*2048)
+	}
+	script := plan.sfdiskScript()
+	if strings.Contains(script, "label:") || strings.Contains(script, "/dev/sdz1 ") || !strings.Contains(script, "/dev/sdz6 ") {
+		t.Errorf("sfdiskScript() =\n%s\nwant only the new partitions 4-6 appended", script)
+	}
+
+	// Shrinking the Windows partition to 20GiB frees more space than
+	// is left after it.
+	plan = NewPartitionPlan(dualBootDisk(), PartitionOptions{UEFI: true, Alongside: true, Shrink: 3, ShrinkToMB: 20 * 1024})
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	win := plan.Partition(3)
+	if win.EndSector != 239616+20*1024*2048 || win.OldEndSector != 239616+40*1024*2048 || win.Change() != "Shrunk" {
+		t.Errorf("shrunk partition = %+v", win)
+	}
+	if boot := plan.Partition(4); boot.StartSector != win.EndSector {
+		t.Errorf("boot partition starts at sector %d, want %d", boot.StartSector, win.EndSector)
+	}
+
+	tcs := []struct {
+		name   string
+		modify func(d *Disk, opts *PartitionOptions)
+	}{
+		{name: "no table", modify: func(d *Disk, opts *PartitionOptions) { d.PartTabType = "" }},
+		{name: "BIOS on GPT", modify: func(d *Disk, opts *PartitionOptions) { opts.UEFI = false }},
+		{name: "disk full", modify: func(d *Disk, opts *PartitionOptions) { d.Partitions[2].NumBlocks = d.NumBlocks - 239616 - 2048 }},
+		{name: "shrink missing partition", modify: func(d *Disk, opts *PartitionOptions) { opts.Shrink, opts.ShrinkToMB = 7, 1024 }},
+		{name: "shrink FAT", modify: func(d *Disk, opts *PartitionOptions) { opts.Shrink, opts.ShrinkToMB = 1, 50 }},
+		{name: "grow", modify: func(d *Disk, opts *PartitionOptions) { opts.Shrink, opts.ShrinkToMB = 3, 41*1024 }},
+		{
+			name: "too many msdos partitions",
+			modify: func(d *Disk, opts *PartitionOptions) {
+				d.PartTabType = "dos"
+				d.Partitions[0].PartType, d.Partitions[1].PartType, d.Partitions[2].PartType = "0xef", "0x7", "0x7"
+			},
+		},
+		{
+			name: "extended partition",
+			modify: func(d *Disk, opts *PartitionOptions) {
+				d.PartTabType = "dos"
+				d.Partitions = d.Partitions[2:]
+				d.Partitions[0].PartType = "0xf"
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			d, opts := dualBootDisk(), PartitionOptions{UEFI: true, Alongside: true}
+			tc.modify(d, &opts)
+			if err := NewPartitionPlan(d, opts).Validate(); err == nil {
+				t.Error("Validate() succeeded, want an error")
+			}
+		})
+	}
+
+	// BIOS installs alongside a single msdos partition are fine.
+	d := dualBootDisk()
+	d.PartTabType, d.Partitions = "dos", d.Partitions[2:]
+	d.Partitions[0].PartType = "0x7"
+	plan = NewPartitionPlan(d, PartitionOptions{Alongside: true})
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	if boot := plan.MountedAt("/boot"); boot.Num != 1 || !boot.Bootable || boot.Type != linuxTypeCode {
+		t.Errorf("boot partition = %+v", boot)
+	}
+}
+
+// customLayout returns a layout with a separate /home partition on XFS,
+// swap & an unencrypted root.
+func customLayout() []CustomPartition {
+	return []CustomPartition{
+		{SizeMB: 512, Filesystem: "ext4", MountPoint: "/boot"},
+		{SizeMB: 4096, Filesystem: "ext4", MountPoint: "/"},
+		{SizeMB: 1024, Filesystem: "swap"},
+		{Filesystem: "xfs", MountPoint: "/home", Encrypted: true, Label: "home"},
+		{SizeMB: 256, Filesystem: "fat32", MountPoint: "/boot/efi", Label: "EFI"},
+	}
+}
+
+func TestNewPartitionPlanCustom(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+	plan := NewPartitionPlan(disk, PartitionOptions{UEFI: true, Layout: customLayout()})
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	if !plan.Custom || len(plan.Partitions) != 5 {
+		t.Fatalf("plan = %+v, want the 5 custom partitions", plan)
+	}
+	for _, want := range []struct {
+		num                      int
+		name, typ, desc, fs, mnt string
+		mb                       int64
+	}{
+		{1, "boot", linuxFSTypeGUID, "Boot partition", "ext4", "/boot", 512},
+		{2, "root", linuxFSTypeGUID, "Root partition", "ext4", "/", 4096},
+		{3, "swap", swapTypeGUID, "Swap partition", "swap", "", 1024},
+		{4, "home", luksTypeGUID, "Encrypted partition for /home", "xfs", "/home", 0},
+		{5, "EFI", espTypeGUID, "EFI system partition", "fat32", "/boot/efi", 256},
+	} {
+		p := plan.Partition(want.num)
+		if p == nil || p.Name != want.name || p.Type != want.typ || p.Desc != want.desc || p.Filesystem != want.fs || p.MountPoint != want.mnt {
+			t.Errorf("partition %d = %+v", want.num, p)
+			continue
+		}
+		if mb := plan.Bytes(p.Sectors()) / mib; want.mb > 0 && mb != want.mb {
+			t.Errorf("partition %d is %dMiB, want %dMiB", want.num, mb, want.mb)
+		}
+	}
+	// /home takes the space left between root & the ESP.
+	if home, esp := plan.Partition(4), plan.Partition(5); home.EndSector != esp.StartSector {
+		t.Errorf("/home ends at sector %d, want %d", home.EndSector, esp.StartSector)
+	}
+
+	// Swap partitions are type 82 on msdos.
+	bios := NewPartitionPlan(disk, PartitionOptions{Layout: customLayout()[:4]})
+	if err := bios.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	if swap := bios.Partition(3); swap.Type != swapTypeCode {
+		t.Errorf("swap partition type = %q, want %q", swap.Type, swapTypeCode)
+	}
+	if boot := bios.MountedAt("/boot"); !boot.Bootable {
+		t.Errorf("boot partition = %+v, want it bootable", boot)
+	}
+
+	tcs := []struct {
+		name   string
+		modify func(l []CustomPartition) []CustomPartition
+	}{
+		{name: "no boot", modify: func(l []CustomPartition) []CustomPartition { return l[1:] }},
+		{name: "no root", modify: func(l []CustomPartition) []CustomPartition { return append(l[:1:1], l[2:]...) }},
+		{name: "no ESP", modify: func(l []CustomPartition) []CustomPartition { return l[:4] }},
+		{name: "encrypted boot", modify: func(l []CustomPartition) []CustomPartition { l[0].Encrypted = true; return l }},
+		{name: "duplicate mount", modify: func(l []CustomPartition) []CustomPartition { l[3].MountPoint = "/"; return l }},
+		{name: "relative mount", modify: func(l []CustomPartition) []CustomPartition { l[3].MountPoint = "home"; return l }},
+		{name: "beneath boot", modify: func(l []CustomPartition) []CustomPartition { l[3].MountPoint = "/boot/home"; return l }},
+		{name: "mounted swap", modify: func(l []CustomPartition) []CustomPartition { l[2].MountPoint = "/swap"; return l }},
+		{name: "ext4 ESP", modify: func(l []CustomPartition) []CustomPartition { l[4].Filesystem = "ext4"; return l }},
+		{name: "unknown filesystem", modify: func(l []CustomPartition) []CustomPartition { l[3].Filesystem = "zfs"; return l }},
+		{name: "too big", modify: func(l []CustomPartition) []CustomPartition { l[3].SizeMB = 16 * 1024; return l }},
+		{name: "two filling", modify: func(l []CustomPartition) []CustomPartition { l[1].SizeMB = 0; return l }},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := PartitionOptions{UEFI: true, Layout: tc.modify(customLayout())}
+			if err := NewPartitionPlan(disk, opts).Validate(); err == nil {
+				t.Error("Validate() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDefaultLayout(t *testing.T) {
+	disk := &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize}
+	opts := PartitionOptions{UEFI: true}
+	layout := DefaultLayout(disk, opts)
+	if root := layout[1]; root.MountPoint != "/" || root.SizeMB != 0 || !root.Encrypted {
+		t.Errorf("root = %+v, want it to take the remaining space", root)
+	}
+	// Planning the default layout gives the default plan.
+	want := NewPartitionPlan(disk, opts)
+	opts.Layout = layout
+	got := NewPartitionPlan(disk, opts)
+	got.Custom = false
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewPartitionPlan(DefaultLayout()) = %+v\nwant %+v", got, want)
+	}
+}
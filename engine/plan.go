@@ -0,0 +1,37 @@
+package engine
+
+// redactedPw replaces passwords in planned actions.
+const redactedPw = "<password>"
+
+// Action describes an operation an install step will perform.
+type Action struct {
+	Desc string `json:"desc"`
+	// Argv is the command line run by the action, if any.
+	Argv []string `json:"argv,omitempty"`
+	// Stdin describes the input given to the command, with
+	// passwords redacted.
+	Stdin string `json:"stdin,omitempty"`
+	// Path is the file written or mount point used by the action.
+	Path string `json:"path,omitempty"`
+	// PartitionPlan is the partition table created by the action.
+	PartitionPlan *PartitionPlan `json:"partition_plan,omitempty"`
+}
+
+// StepPlan lists the actions a step will perform.
+type StepPlan struct {
+	Step    string   `json:"step"`
+	Actions []Action `json:"actions"`
+}
+
+// Plan returns the actions each step will perform for the given state,
+// without performing any of them.
+func Plan(state *State) []StepPlan {
+	var out []StepPlan
+	for _, step := range Steps {
+		out = append(out, StepPlan{
+			Step:    step.Name(),
+			Actions: step.Plan(state),
+		})
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	state := State{
+		InstallDevice: &Disk{Path: "/dev/sdz", NumBlocks: 16 * 1024 * 1024 * 1024 / blockSize},
+		Pw:            "hunter2",
+		User:          "alice",
+		Host:          "box",
+		Tz:            "UTC",
+		UEFI:          true,
+		Scrub:         true,
+	}
+	fake := useFakeRunner(t)
+	plan := Plan(&state)
+
+	if calls := fake.Calls(); len(calls) > 0 {
+		t.Errorf("Plan() ran commands: %v", cmdLines(calls))
+	}
+	if len(plan) != len(Steps) {
+		t.Fatalf("got %d step plans, want %d", len(plan), len(Steps))
+	}
+
+	wantParts := []PlannedPartition{
+		{Num: 1, Name: "boot", Type: linuxFSTypeGUID, Filesystem: "ext4", MountPoint: "/boot", Desc: "Boot partition", StartSector: 2048, EndSector: 526336},
+		{Num: 2, Name: "root", Type: luksTypeGUID, Filesystem: "ext4", Encrypted: true, MountPoint: "/", Desc: "Encrypted root partition", StartSector: 526336, EndSector: 33159168},
+		{Num: 3, Name: "metadata", Type: linuxFSTypeGUID, Filesystem: "ext4", Desc: "TwitchyLinux metadata partition", StartSector: 33159168, EndSector: 33290240},
+		{Num: 4, Name: "EFI", Type: espTypeGUID, Filesystem: "fat32", Label: "EFI", MountPoint: "/boot/efi", Desc: "EFI system partition", StartSector: 33290240, EndSector: 33552384},
+	}
+	if got := plan[0].Actions[0].PartitionPlan; got == nil || !reflect.DeepEqual(got.Partitions, wantParts) {
+		t.Errorf("planned partitions = %+v, want %+v", got, wantParts)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(plan); err != nil {
+		t.Fatal(err)
+	}
+	j := buf.String()
+	if strings.Contains(j, state.Pw) {
+		t.Errorf("plan contains the password: %s", j)
+	}
+	if !strings.Contains(j, redactedPw) {
+		t.Errorf("plan does not describe password input: %s", j)
+	}
+}
@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CheckStatus is the outcome of a preflight check.
+type CheckStatus int
+
+// Preflight check outcomes. Installation is blocked if any check fails.
+const (
+	CheckPass CheckStatus = iota
+	CheckWarn
+	CheckFail
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "pass"
+	case CheckWarn:
+		return "warn"
+	}
+	return "fail"
+}
+
+// CheckResult is the outcome of a single preflight check.
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// Preflight describes whether the system meets the requirements for
+// installation.
+type Preflight struct {
+	Results []CheckResult
+	// DiskBytes is the size of the smallest disk the installation fits
+	// on, or zero if it could not be determined.
+	DiskBytes int64
+}
+
+// Failed returns true if any check failed.
+func (p *Preflight) Failed() bool {
+	for _, r := range p.Results {
+		if r.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDisk returns an error if the installation does not fit on d.
+func (p *Preflight) CheckDisk(d *Disk) error {
+	if size := d.SizeBytes(); size < p.DiskBytes {
+		return fmt.Errorf("%s is too small: %s, but at least %s is needed", d.Path, ByteCountDecimal(size), ByteCountDecimal(p.DiskBytes))
+	}
+	return nil
+}
+
+// CheckPlan returns an error if the installation does not fit in the
+// space plan allocates: the whole of d, or when installing alongside
+// other systems or with a custom layout, the new partitions. With LVM,
+// the files must fit in the root volume, & the LVM tools be present, as
+// must the btrfs tools for a btrfs root filesystem.
+func (p *Preflight) CheckPlan(d *Disk, plan *PartitionPlan) error {
+	if lv := plan.VolumeAt("/"); lv != nil {
+		if need := p.DiskBytes - requiredDiskBytes(0, plan.UEFI); lv.Bytes < need {
+			return fmt.Errorf("the root volume is too small: %s, but at least %s is needed", ByteCountDecimal(lv.Bytes), ByteCountDecimal(need))
+		}
+		for _, t := range lvmTools {
+			if _, err := lookPath(t); err != nil {
+				return fmt.Errorf("%s is needed to create the LVM volumes, but is missing from PATH", t)
+			}
+		}
+	}
+	if len(plan.Subvolumes) > 0 {
+		for _, t := range btrfsTools {
+			if _, err := lookPath(t); err != nil {
+				return fmt.Errorf("%s is needed to create the btrfs root filesystem, but is missing from PATH", t)
+			}
+		}
+	}
+	if !plan.Alongside && !plan.Custom {
+		return p.CheckDisk(d)
+	}
+	if size := plan.NewBytes() + 2*reservedMB*mib; size < p.DiskBytes {
+		if !plan.Alongside {
+			return fmt.Errorf("the partitions on %s are too small: %s, but at least %s is needed", d.Path, ByteCountDecimal(size), ByteCountDecimal(p.DiskBytes))
+		}
+		return fmt.Errorf("the free space on %s is too small: %s, but at least %s is needed", d.Path, ByteCountDecimal(size), ByteCountDecimal(p.DiskBytes))
+	}
+	return nil
+}
+
+func (p *Preflight) add(name string, status CheckStatus, format string, args ...interface{}) {
+	p.Results = append(p.Results, CheckResult{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Thresholds for the preflight checks.
+var (
+	// minMemBytes is the least memory the live system needs to install.
+	minMemBytes int64 = 1024 * 1024 * 1024
+	// recommendedMemBytes is the memory below which installation is slow.
+	recommendedMemBytes int64 = 2 * 1024 * 1024 * 1024
+	// fsOverheadPercent is the extra space needed on top of the size of
+	// the installed files, for filesystem metadata & the journal.
+	fsOverheadPercent int64 = 10
+	// luksHeaderMB is the space taken by the LUKS2 header.
+	luksHeaderMB int64 = 16
+)
+
+// requiredTools are the commands run on the live system during
+// installation.
+var requiredTools = []string{"sfdisk", "partprobe", "cryptsetup", "mkfs.ext4", "grub-install", "lsblk"}
+
+// These are replaced by tests.
+var (
+	procMeminfo = "/proc/meminfo"
+	lookPath    = exec.LookPath
+	geteuid     = os.Geteuid
+	machine     = func() string {
+		var u syscall.Utsname
+		if err := syscall.Uname(&u); err != nil {
+			return ""
+		}
+		var b strings.Builder
+		for _, c := range u.Machine {
+			if c == 0 {
+				break
+			}
+			b.WriteByte(byte(c))
+		}
+		return b.String()
+	}
+)
+
+// RunPreflight checks the system meets the requirements for installing
+// from source onto one of disks, with a UEFI or BIOS bootloader. Sizing
+// the source may involve walking the live filesystem, so this can take a
+// few seconds.
+func RunPreflight(disks []Disk, source string, uefi bool) *Preflight {
+	p := &Preflight{}
+	p.checkRoot()
+	p.checkArch()
+	p.checkMemory()
+	p.checkTools(source, uefi)
+	p.checkFirmware(uefi)
+	p.checkDisks(disks, source, uefi)
+	return p
+}
+
+func (p *Preflight) checkRoot() {
+	if geteuid() != 0 {
+		p.add("Administrator", CheckFail, "The installer must be run as root")
+		return
+	}
+	p.add("Administrator", CheckPass, "Running as root")
+}
+
+func (p *Preflight) checkArch() {
+	if m := machine(); m != "x86_64" {
+		p.add("Architecture", CheckFail, "%s CPUs are not supported (x86_64 is required)", m)
+		return
+	}
+	p.add("Architecture", CheckPass, "x86_64")
+}
+
+func (p *Preflight) checkMemory() {
+	mem, err := memTotal()
+	switch {
+	case err != nil:
+		p.add("Memory", CheckWarn, "Could not determine: %v", err)
+	case mem < minMemBytes:
+		p.add("Memory", CheckFail, "%s, but at least %s is required", ByteCountDecimal(mem), ByteCountDecimal(minMemBytes))
+	case mem < recommendedMemBytes:
+		p.add("Memory", CheckWarn, "%s, which is less than the recommended %s", ByteCountDecimal(mem), ByteCountDecimal(recommendedMemBytes))
+	default:
+		p.add("Memory", CheckPass, "%s", ByteCountDecimal(mem))
+	}
+}
+
+// memTotal returns the total memory of the system.
+func memTotal() (int64, error) {
+	f, err := os.Open(procMeminfo)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemTotal missing from %s", procMeminfo)
+}
+
+func (p *Preflight) checkTools(source string, uefi bool) {
+	tools := append([]string{}, requiredTools...)
+	if uefi {
+		tools = append(tools, "mkfs.vfat")
+	}
+	if _, ok := sourceFor(source).(tarballSource); ok {
+		tools = append(tools, "tar")
+	}
+	var missing []string
+	for _, t := range tools {
+		if _, err := lookPath(t); err != nil {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		p.add("Tools", CheckFail, "Missing from PATH: %s", strings.Join(missing, ", "))
+		return
+	}
+	p.add("Tools", CheckPass, "All %d required tools found", len(tools))
+}
+
+func (p *Preflight) checkFirmware(uefi bool) {
+	switch efi := FirmwareIsEFI(); {
+	case uefi && !efi:
+		p.add("Firmware", CheckWarn, "Installing for UEFI, but the live system was booted by BIOS; the boot entry must be added in the firmware setup")
+	case !uefi && efi:
+		p.add("Firmware", CheckWarn, "Installing for BIOS, but the live system was booted by UEFI; legacy boot must be enabled in the firmware setup")
+	case uefi:
+		p.add("Firmware", CheckPass, "UEFI")
+	default:
+		p.add("Firmware", CheckPass, "BIOS")
+	}
+}
+
+func (p *Preflight) checkDisks(disks []Disk, source string, uefi bool) {
+	src, err := NewSource(source)
+	if err != nil {
+		p.add("Disk capacity", CheckFail, "Invalid source: %v", err)
+		return
+	}
+	sourceBytes, err := src.Size()
+	if err != nil {
+		p.add("Disk capacity", CheckWarn, "Could not determine the size of %s: %v", src.Desc(), err)
+		return
+	}
+	p.DiskBytes = requiredDiskBytes(sourceBytes, uefi)
+
+	var fit int
+	for i := range disks {
+		if p.CheckDisk(&disks[i]) == nil {
+			fit++
+		}
+	}
+	switch {
+	case len(disks) == 0:
+		p.add("Disk capacity", CheckFail, "No disks were found")
+	case fit == 0:
+		p.add("Disk capacity", CheckFail, "No disk is large enough: at least %s is needed", ByteCountDecimal(p.DiskBytes))
+	case fit < len(disks):
+		p.add("Disk capacity", CheckWarn, "%d of %d disks are too small: at least %s is needed", len(disks)-fit, len(disks), ByteCountDecimal(p.DiskBytes))
+	default:
+		p.add("Disk capacity", CheckPass, "At least %s is needed", ByteCountDecimal(p.DiskBytes))
+	}
+}
+
+// requiredDiskBytes returns the size of the smallest disk on which
+// sourceBytes of files can be installed.
+func requiredDiskBytes(sourceBytes int64, uefi bool) int64 {
+	fixedMB := int64(2*reservedMB+bootPartSizeMB+metadataPartSizeMB) + luksHeaderMB
+	if uefi {
+		fixedMB += espPartSizeMB
+	}
+	return fixedMB*1024*1024 + sourceBytes*(100+fsOverheadPercent)/100
+}
@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// usePreflightEnv fakes the system inspected by the preflight checks.
+func usePreflightEnv(t *testing.T, euid int, arch, meminfo string, missing ...string) {
+	p := filepath.Join(t.TempDir(), "meminfo")
+	if err := ioutil.WriteFile(p, []byte(meminfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldMeminfo, oldLookPath, oldGeteuid, oldMachine := procMeminfo, lookPath, geteuid, machine
+	procMeminfo = p
+	lookPath = func(name string) (string, error) {
+		for _, m := range missing {
+			if m == name {
+				return "", errors.New("not found")
+			}
+		}
+		return "/usr/bin/" + name, nil
+	}
+	geteuid = func() int { return euid }
+	machine = func() string { return arch }
+	t.Cleanup(func() {
+		procMeminfo, lookPath, geteuid, machine = oldMeminfo, oldLookPath, oldGeteuid, oldMachine
+	})
+}
+
+// preflightStatus returns the status of each check, by name.
+func preflightStatus(p *Preflight) map[string]CheckStatus {
+	out := map[string]CheckStatus{}
+	for _, r := range p.Results {
+		out[r.Name] = r.Status
+	}
+	return out
+}
+
+func TestPreflight(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "usr"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "usr/big"), make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldSource := sourceRoot
+	sourceRoot = src
+	t.Cleanup(func() { sourceRoot = oldSource })
+
+	const gib = 1024 * 1024 * 1024
+	bigDisk := Disk{Path: "/dev/sda", NumBlocks: 16 * gib / blockSize}
+	tinyDisk := Disk{Path: "/dev/sdb", NumBlocks: 256 * 1024 * 1024 / blockSize}
+
+	tcs := []struct {
+		name       string
+		euid       int
+		arch       string
+		meminfo    string
+		missing    []string
+		disks      []Disk
+		want       map[string]CheckStatus
+		wantFailed bool
+	}{
+		{
+			name:    "ok",
+			arch:    "x86_64",
+			meminfo: "MemTotal:        8000000 kB\nMemFree:         4000000 kB\n",
+			disks:   []Disk{bigDisk},
+			want: map[string]CheckStatus{
+				"Administrator": CheckPass,
+				"Architecture":  CheckPass,
+				"Memory":        CheckPass,
+				"Tools":         CheckPass,
+				"Disk capacity": CheckPass,
+			},
+		},
+		{
+			name:    "warnings",
+			arch:    "x86_64",
+			meminfo: "MemTotal:        1500000 kB\n",
+			disks:   []Disk{bigDisk, tinyDisk},
+			want: map[string]CheckStatus{
+				"Memory":        CheckWarn,
+				"Disk capacity": CheckWarn,
+			},
+		},
+		{
+			name:       "failures",
+			euid:       1000,
+			arch:       "aarch64",
+			meminfo:    "MemTotal:         500000 kB\n",
+			missing:    []string{"cryptsetup"},
+			disks:      []Disk{tinyDisk},
+			wantFailed: true,
+			want: map[string]CheckStatus{
+				"Administrator": CheckFail,
+				"Architecture":  CheckFail,
+				"Memory":        CheckFail,
+				"Tools":         CheckFail,
+				"Disk capacity": CheckFail,
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			usePreflightEnv(t, tc.euid, tc.arch, tc.meminfo, tc.missing...)
+			p := RunPreflight(tc.disks, "", false)
+			got := preflightStatus(p)
+			for name, want := range tc.want {
+				if got[name] != want {
+					t.Errorf("%s check = %v, want %v", name, got[name], want)
+				}
+			}
+			if p.Failed() != tc.wantFailed {
+				t.Errorf("Failed() = %v, want %v (results: %+v)", p.Failed(), tc.wantFailed, p.Results)
+			}
+		})
+	}
+}
+
+func TestPreflightCheckDisk(t *testing.T) {
+	p := Preflight{DiskBytes: requiredDiskBytes(4*1024*1024*1024, true)}
+	if err := p.CheckDisk(&Disk{Path: "/dev/sda", NumBlocks: 4 * 1024 * 1024 * 1024 / blockSize}); err == nil {
+		t.Error("CheckDisk() accepted a disk the size of the source")
+	}
+	if err := p.CheckDisk(&Disk{Path: "/dev/sda", NumBlocks: 8 * 1024 * 1024 * 1024 / blockSize}); err != nil {
+		t.Errorf("CheckDisk() failed: %v", err)
+	}
+}
+
+func TestPreflightCheckPlan(t *testing.T) {
+	d := dualBootDisk()
+	plan := NewPartitionPlan(d, PartitionOptions{UEFI: true, Alongside: true})
+	p := Preflight{DiskBytes: requiredDiskBytes(4*1024*1024*1024, true)}
+	if err := p.CheckPlan(d, plan); err != nil {
+		t.Errorf("CheckPlan() failed: %v", err)
+	}
+	// The disk is large enough, but the free space is not.
+	p.DiskBytes = requiredDiskBytes(12*1024*1024*1024, true)
+	if err := p.CheckDisk(d); err != nil {
+		t.Errorf("CheckDisk() failed: %v", err)
+	}
+	if err := p.CheckPlan(d, plan); err == nil {
+		t.Error("CheckPlan() accepted 8GiB of free space for 12GiB of files")
+	}
+
+	// With LVM, the files must fit in the root volume.
+	usePreflightEnv(t, 0, "x86_64", "")
+	d = &Disk{Path: "/dev/sdz", NumBlocks: 64 * 1024 * 1024 * 2}
+	lvm := &LVMOptions{RootMB: 16 * 1024, SwapMB: 4096}
+	if err := p.CheckPlan(d, NewPartitionPlan(d, PartitionOptions{UEFI: true, LVM: lvm})); err != nil {
+		t.Errorf("CheckPlan() failed: %v", err)
+	}
+	lvm.RootMB = 8 * 1024
+	if err := p.CheckPlan(d, NewPartitionPlan(d, PartitionOptions{UEFI: true, LVM: lvm})); err == nil {
+		t.Error("CheckPlan() accepted an 8GiB root volume for 12GiB of files")
+	}
+	lvm.RootMB = 16 * 1024
+	usePreflightEnv(t, 0, "x86_64", "", "lvcreate")
+	if err := p.CheckPlan(d, NewPartitionPlan(d, PartitionOptions{UEFI: true, LVM: lvm})); err == nil {
+		t.Error("CheckPlan() succeeded without lvcreate")
+	}
+
+	// A btrfs root filesystem needs the btrfs tools.
+	usePreflightEnv(t, 0, "x86_64", "", "btrfs")
+	if err := p.CheckPlan(d, NewPartitionPlan(d, PartitionOptions{UEFI: true})); err != nil {
+		t.Errorf("CheckPlan() failed: %v", err)
+	}
+	if err := p.CheckPlan(d, NewPartitionPlan(d, PartitionOptions{UEFI: true, RootFS: "btrfs"})); err == nil {
+		t.Error("CheckPlan() succeeded without btrfs")
+	}
+}
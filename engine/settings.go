@@ -0,0 +1,20 @@
+package engine
+
+import "errors"
+
+// ValidateSettings checks the user-provided install settings, returning
+// an error describing the first problem found. It is shared by the
+// settings pane and answer-file installs so both apply the same rules.
+func ValidateSettings(pw, confirmPw, host, user string) error {
+	switch {
+	case pw == "":
+		return errors.New("password must not be empty")
+	case confirmPw != pw:
+		return errors.New("passwords do not match")
+	case host == "":
+		return errors.New("hostname must not be empty")
+	case user == "":
+		return errors.New("username must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source provides the filesystem tree which is installed.
+type Source interface {
+	// Open makes the tree readable, returning the directory it is rooted
+	// at. Opening a source which is already open returns the same
+	// directory.
+	Open(ctx context.Context, updateChan chan Update, installState *State) (string, error)
+	// Plan describes the actions Open would perform.
+	Plan() []Action
+	// Size estimates the space needed on the root filesystem to install
+	// the source.
+	Size() (int64, error)
+	// Desc describes the source for display.
+	Desc() string
+}
+
+// tarballSuffixes are the file extensions of images unpacked with tar.
+var tarballSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.zst", ".tar.bz2"}
+
+// compressionRatio estimates how much larger the contents of compressed
+// images are than the images themselves.
+const compressionRatio = 3
+
+// NewSource returns the source for the image at p, or the live root
+// filesystem if p is empty. Tarballs are recognised by their extension;
+// any other file is taken to be a squashfs or other filesystem image.
+func NewSource(p string) (Source, error) {
+	if p == "" {
+		return liveSource{}, nil
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not an image file", p)
+	}
+	return sourceFor(p), nil
+}
+
+// sourceFor returns the source for the image at p, without checking it
+// exists.
+func sourceFor(p string) Source {
+	if p == "" {
+		return liveSource{}
+	}
+	for _, suffix := range tarballSuffixes {
+		if strings.HasSuffix(p, suffix) {
+			return tarballSource{Path: p}
+		}
+	}
+	return imageSource{Path: p}
+}
+
+// openSource opens the source of an installation.
+func openSource(ctx context.Context, updateChan chan Update, installState *State) (string, error) {
+	src, err := NewSource(installState.Source)
+	if err != nil {
+		return "", err
+	}
+	return src.Open(ctx, updateChan, installState)
+}
+
+// liveSource installs the running live system.
+type liveSource struct{}
+
+func (liveSource) Open(ctx context.Context, updateChan chan Update, installState *State) (string, error) {
+	return sourceRoot, nil
+}
+
+func (liveSource) Plan() []Action {
+	return nil
+}
+
+func (liveSource) Size() (int64, error) {
+	m, err := loadCopyManifest(sourceRoot)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range m.Entries {
+		size, _ := treeSize(path.Join(sourceRoot, e.From), m.excluder(e))
+		total += size
+	}
+	return total, nil
+}
+
+func (liveSource) Desc() string {
+	return "the live system"
+}
+
+// imageMount is where filesystem images are mounted.
+const imageMount = "/tmp/install_mounts/source"
+
+// imageSource installs the contents of a squashfs (or other filesystem)
+// image, mounted read-only over a loop device.
+type imageSource struct {
+	Path string
+}
+
+func (s imageSource) Open(ctx context.Context, updateChan chan Update, installState *State) (string, error) {
+	if installState.ledger().holds(resource{Kind: resMount, Name: imageMount}) {
+		return imageMount, nil
+	}
+	if err := os.MkdirAll(imageMount, 0755); err != nil {
+		return "", err
+	}
+	argv := s.mountArgv()
+	if err := runCmd(ctx, updateChan, "[SOURCE]: Mount ", argv[0], argv[1:]...); err != nil {
+		return "", fmt.Errorf("failed to mount %s: %v", s.Path, err)
+	}
+	installState.ledger().mounted(imageMount)
+	return imageMount, nil
+}
+
+func (s imageSource) mountArgv() []string {
+	return []string{"mount", "-o", "loop,ro", s.Path, imageMount}
+}
+
+func (s imageSource) Plan() []Action {
+	return []Action{{Desc: "Mount source image", Argv: s.mountArgv()}}
+}
+
+// squashfsMagic begins a squashfs superblock.
+var squashfsMagic = []byte("hsqs")
+
+// Size returns the size of the image, scaled by compressionRatio if it
+// is a (compressed) squashfs.
+func (s imageSource) Size() (int64, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	magic := make([]byte, len(squashfsMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, squashfsMagic) {
+		return st.Size() * compressionRatio, nil
+	}
+	return st.Size(), nil
+}
+
+func (s imageSource) Desc() string {
+	return "image " + s.Path
+}
+
+// tarballStage is where tarballs are unpacked. It is on the root
+// filesystem being installed, so the live system need not have room for
+// the unpacked image; it is removed once the installation finishes.
+const tarballStage = "/tmp/install_mounts/root/.twlinst-source"
+
+// tarballSource installs the contents of a tarball, which is unpacked
+// to a scratch directory & copied from there.
+type tarballSource struct {
+	Path string
+}
+
+func (s tarballSource) Open(ctx context.Context, updateChan chan Update, installState *State) (string, error) {
+	if installState.ledger().holds(resource{Kind: resDir, Name: tarballStage}) {
+		return tarballStage, nil
+	}
+	if err := os.MkdirAll(tarballStage, 0755); err != nil {
+		return "", err
+	}
+	installState.ledger().created(tarballStage)
+	argv := s.unpackArgv()
+	if err := runCmd(ctx, updateChan, "[SOURCE]: Unpack ", argv[0], argv[1:]...); err != nil {
+		return "", fmt.Errorf("failed to unpack %s: %v", s.Path, err)
+	}
+	return tarballStage, nil
+}
+
+// unpackArgv returns the command which unpacks the tarball, preserving
+// ownership, permissions, ACLs & extended attributes.
+func (s tarballSource) unpackArgv() []string {
+	return []string{"tar", "--extract", "--file", s.Path, "--directory", tarballStage,
+		"--numeric-owner", "--preserve-permissions", "--acls", "--xattrs", "--xattrs-include=*"}
+}
+
+func (s tarballSource) Plan() []Action {
+	return []Action{{Desc: "Unpack source tarball", Argv: s.unpackArgv()}}
+}
+
+// Size returns the size of the tarball, scaled by compressionRatio if it
+// is compressed. Twice the space is needed, as the tarball is unpacked
+// onto the root filesystem before being copied into place.
+func (s tarballSource) Size() (int64, error) {
+	st, err := os.Stat(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	size := st.Size()
+	if !strings.HasSuffix(s.Path, ".tar") {
+		size *= compressionRatio
+	}
+	return 2 * size, nil
+}
+
+func (s tarballSource) Desc() string {
+	return "tarball " + s.Path
+}
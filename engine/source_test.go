@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewSource(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"root.squashfs", "root.img", "root.tar.zst"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		path    string
+		want    Source
+		wantErr bool
+	}{
+		{path: "", want: liveSource{}},
+		{path: filepath.Join(dir, "root.squashfs"), want: imageSource{Path: filepath.Join(dir, "root.squashfs")}},
+		{path: filepath.Join(dir, "root.img"), want: imageSource{Path: filepath.Join(dir, "root.img")}},
+		{path: filepath.Join(dir, "root.tar.zst"), want: tarballSource{Path: filepath.Join(dir, "root.tar.zst")}},
+		{path: filepath.Join(dir, "missing.squashfs"), wantErr: true},
+		{path: dir, wantErr: true},
+	}
+	for _, tc := range tcs {
+		got, err := NewSource(tc.path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("NewSource(%q) returned error %v, want error %v", tc.path, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("NewSource(%q) = %#v, want %#v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestImageSourceOpen(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating the mount point requires root")
+	}
+	fake := useFakeRunner(t)
+	var state State
+	src := imageSource{Path: "/images/root.squashfs"}
+	for i := 0; i < 2; i++ {
+		dir, err := src.Open(context.Background(), discardUpdates(t), &state)
+		if err != nil || dir != imageMount {
+			t.Fatalf("Open() = %q, %v, want %q", dir, err, imageMount)
+		}
+	}
+	// The image is only mounted once, & unmounted with the disk.
+	if err := state.ledger().unwind(discardUpdates(t)); err != nil {
+		t.Fatalf("unwind() failed: %v", err)
+	}
+	checkCmdLines(t, fake.Calls(), []string{
+		"mount -o loop,ro /images/root.squashfs /tmp/install_mounts/source",
+		"umount /tmp/install_mounts/source",
+	})
+}
+
+func TestSourcePlan(t *testing.T) {
+	state := State{
+		InstallDevice: &Disk{Path: "/dev/sdz"},
+		Source:        "/images/root.tar.gz",
+	}
+	var got []Action
+	for _, a := range (&CopyStep{}).Plan(&state) {
+		if len(a.Argv) > 0 && a.Argv[0] == "tar" {
+			got = append(got, a)
+		}
+	}
+	want := []Action{{Desc: "Unpack source tarball", Argv: tarballSource{Path: "/images/root.tar.gz"}.unpackArgv()}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() unpacks with %+v, want %+v", got, want)
+	}
+}
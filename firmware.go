@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"./engine"
+)
+
+// Valid values for the -boot-mode flag.
+const (
+	bootModeAuto = "auto"
+	bootModeBIOS = "bios"
+	bootModeUEFI = "uefi"
+)
+
+// checkBootMode returns an error if mode is not a recognised boot mode.
+func checkBootMode(mode string) error {
+	switch mode {
+	case bootModeAuto, bootModeBIOS, bootModeUEFI:
+		return nil
+	}
+	return fmt.Errorf("invalid boot mode %q (expected %q, %q or %q)", mode, bootModeAuto, bootModeBIOS, bootModeUEFI)
+}
+
+// installUEFI returns true if the system should be installed with a
+// GPT partition table & UEFI bootloader, rather than a msdos partition
+// table & BIOS bootloader. Unless overridden, this matches the firmware
+// mode the live system was booted in.
+func installUEFI(mode string) bool {
+	switch mode {
+	case bootModeBIOS:
+		return false
+	case bootModeUEFI:
+		return true
+	}
+	return engine.FirmwareIsEFI()
+}
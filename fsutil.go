@@ -1,227 +1,152 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
-)
-
-type disk struct {
-	Name, Path string
-
-	Model    string
-	Serial   string
-	Bus, Rev string
-	Symlinks []string
+	"sync/atomic"
 
-	NumBlocks int
-
-	Major, Minor int
-	PartN        int
-
-	PartTabType string
-	PartUUID    string
-	FsUUID      string
-	Partitions  []*disk
-	FS, Label   string
-}
-
-func (d *disk) pathForPartition(partNum int) string {
-	if _, err := os.Stat(fmt.Sprintf("%s%d", d.Path, partNum)); err == nil {
-		return fmt.Sprintf("%s%d", d.Path, partNum)
-	}
-	if _, err := os.Stat(fmt.Sprintf("%sp%d", d.Path, partNum)); err == nil {
-		return fmt.Sprintf("%sp%d", d.Path, partNum)
-	}
-
-	// fallback
-	if strings.Contains(d.Path, "/sd") {
-		return d.Path + fmt.Sprint(partNum)
-	}
-	return d.Path + "p" + fmt.Sprint(partNum)
-}
+	"./engine"
+	"github.com/gotk3/gotk3/glib"
+)
 
-var disks []disk
+var disks []engine.Disk
 
-func getDisk(path string) disk {
+func getDisk(path string) engine.Disk {
 	path = strings.Split(path, " ")[0]
 	for _, d := range disks {
 		if d.Path == path {
 			return d
 		}
 	}
-	return disk{}
+	return engine.Disk{}
 }
 
-func getDevBlockSize(name string) (int, error) {
-	d, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/block/%s/size", name))
+func readDiskInfo(mw *mainWindow) {
+	var err error
+	disks, err = engine.GetDiskInfo()
 	if err != nil {
-		return 0, err
+		mw.setDebugValue([]string{"disks"}, "")
+		fmt.Fprintf(os.Stderr, "GetDiskInfo() failed: %v", err)
+		return
 	}
-	return strconv.Atoi(strings.Trim(string(d), "\n\t\r "))
+	mw.showDisks()
 }
 
-func getUdevDiskInfo(path string, isRoot bool) (*disk, error) {
-	c := exec.Command("udevadm", "info", "-q", "all", "--name", path)
-	o, err := c.Output()
+// watchDisks updates the list of disks as they are hotplugged. It blocks,
+// so is run from its own goroutine.
+func (mw *mainWindow) watchDisks() {
+	updates, err := engine.WatchDisks(context.Background())
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Failed to watch for disk changes: %v\n", err)
+		return
 	}
-	r := bufio.NewScanner(bytes.NewReader(o))
-	out := disk{Path: path}
-
-	for r.Scan() {
-		line := r.Text()
-		if len(line) < 4 {
+	for u := range updates {
+		if u.Err != nil {
+			fmt.Fprintf(os.Stderr, "GetDiskInfo() failed: %v\n", u.Err)
 			continue
 		}
-
-		switch line[:3] {
-		case "N: ":
-			out.Name = line[3:]
-		case "S: ":
-			out.Symlinks = append(out.Symlinks, line[3:])
-		case "E: ":
-			var err error
-			if strings.HasPrefix(line, "E: ID_MODEL=") {
-				out.Model = line[len("E: ID_MODEL="):]
-			} else if strings.HasPrefix(line, "E: ID_PART_TABLE_TYPE=") {
-				out.PartTabType = line[len("E: ID_PART_TABLE_TYPE="):]
-			} else if strings.HasPrefix(line, "E: ID_PART_TABLE_UUID=") {
-				out.PartUUID = line[len("E: ID_PART_TABLE_UUID="):]
-			} else if strings.HasPrefix(line, "E: ID_SERIAL=") {
-				out.Serial = line[len("E: ID_SERIAL="):]
-			} else if strings.HasPrefix(line, "E: ID_REVISION=") {
-				out.Rev = line[len("E: ID_REVISION="):]
-			} else if strings.HasPrefix(line, "E: ID_BUS=") {
-				out.Bus = line[len("E: ID_BUS="):]
-			} else if strings.HasPrefix(line, "E: ID_FS_TYPE=") {
-				out.FS = line[len("E: ID_FS_TYPE="):]
-			} else if strings.HasPrefix(line, "E: ID_FS_LABEL=") {
-				out.Label = line[len("E: ID_FS_LABEL="):]
-			} else if strings.HasPrefix(line, "E: ID_FS_UUID=") {
-				out.FsUUID = line[len("E: ID_FS_UUID="):]
-			} else if strings.HasPrefix(line, "E: MAJOR=") {
-				out.Major, err = strconv.Atoi(line[len("E: MAJOR="):])
-				if err != nil {
-					return nil, fmt.Errorf("decoding major: %v", err)
-				}
-			} else if strings.HasPrefix(line, "E: MINOR=") {
-				out.Minor, err = strconv.Atoi(line[len("E: MINOR="):])
-				if err != nil {
-					return nil, fmt.Errorf("decoding minor: %v", err)
-				}
-			} else if strings.HasPrefix(line, "E: PARTN=") {
-				out.PartN, err = strconv.Atoi(line[len("E: PARTN="):])
-				if err != nil {
-					return nil, fmt.Errorf("decoding partN: %v", err)
-				}
-			}
-		}
-	}
-
-	if out.Major != 0 && isRoot {
-		for i := 1; i < 12; i++ {
-			part, err := getUdevDiskInfo(fmt.Sprintf("%s%d", path, i), false)
-			if err != nil {
-				if _, ok := err.(*exec.ExitError); ok {
-					return &out, nil
-				}
-				return nil, err
+		ds := u.Disks
+		glib.IdleAdd(func() {
+			disks = ds
+			mw.showDisks()
+			// Whether a disk is large enough is checked again, in case
+			// the disk to install to has just been plugged in.
+			if mw.currPane == paneIntro {
+				mw.runPreflight(ds)
 			}
-			if part.PartN != 0 {
-				out.Partitions = append(out.Partitions, part)
+			// Partitions must not be probed once the install has started.
+			if mw.currPane <= paneSettings {
+				mw.findOtherOSes(ds)
 			}
-		}
+		})
 	}
+}
 
-	return &out, nil
+// findOtherOSes starts looking for operating systems on ds, to add to the
+// boot menu, superseding any earlier search. It is called from the GTK
+// main loop (or before it starts).
+func (mw *mainWindow) findOtherOSes(ds []engine.Disk) {
+	gen := atomic.AddInt64(&mw.osProbe.gen, 1)
+	go mw.probeOtherOSes(ds, gen)
 }
 
-func getDiskInfo() ([]disk, error) {
-	stdout, err := exec.Command("lsblk", "-Jadp").Output()
-	if err != nil {
-		return nil, err
+// probeOtherOSes searches ds for operating systems, once any earlier
+// search has finished. Partitions are mounted in turn, so it is run from
+// its own goroutine. The search is skipped, or its results dropped, if a
+// newer one has been started since.
+func (mw *mainWindow) probeOtherOSes(ds []engine.Disk, gen int64) {
+	mw.osProbe.mu.Lock()
+	defer mw.osProbe.mu.Unlock()
+	if mw.osProbe.stopped || gen != atomic.LoadInt64(&mw.osProbe.gen) {
+		return
 	}
-	var blockDevs map[string][]struct {
-		Name string `json:"name"`
-		Size string `json:"size"`
-		Type string `json:"type"`
+	oses, err := engine.FindOtherOSes(ds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FindOtherOSes() failed: %v\n", err)
 	}
-	if err := json.Unmarshal(stdout, &blockDevs); err != nil {
-		fmt.Println(string(stdout))
-		return nil, err
+	if gen != atomic.LoadInt64(&mw.osProbe.gen) {
+		return
 	}
-
-	var out []disk
-	for _, blkDev := range blockDevs["blockdevices"] {
-		if blkDev.Type == "disk" {
-			diskInfo, err := getUdevDiskInfo(blkDev.Name, true)
-			if err != nil {
-				return nil, err
-			}
-			diskInfo.NumBlocks, err = getDevBlockSize(diskInfo.Name)
-			if err != nil {
-				return nil, err
-			}
-			out = append(out, *diskInfo)
+	glib.IdleAdd(func() {
+		mw.otherOSes = oses
+		mw.removeDebugValue([]string{"other systems"})
+		mw.setDebugValue([]string{"other systems"}, "")
+		for _, o := range oses {
+			mw.setDebugValue([]string{"other systems", o.Desc()}, o.Boot)
 		}
-	}
-
-	return out, nil
+	})
 }
 
-func byteCountDecimal(b int64) string {
-	const unit = 1000
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+// stopFindingOtherOSes waits for any search for operating systems to
+// finish, & prevents more from starting, so none of the install device's
+// partitions are mounted once the installation begins.
+func (mw *mainWindow) stopFindingOtherOSes() {
+	mw.osProbe.mu.Lock()
+	defer mw.osProbe.mu.Unlock()
+	mw.osProbe.stopped = true
 }
 
-func readDiskInfo(mw *mainWindow) {
+// showDisks lists the disks in the debug treeview & the disk selector. The
+// selector is left alone once the settings have been confirmed, so the
+// disk shown on the confirmation pane can't change underneath the user.
+func (mw *mainWindow) showDisks() {
+	mw.removeDebugValue([]string{"disks"})
 	mw.setDebugValue([]string{"disks"}, "")
-	var err error
-	disks, err = getDiskInfo()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "getDiskInfo() failed: %v", err)
-		return
-	}
 	for _, disk := range disks {
 		mw.setDebugValue([]string{"disks", disk.Name}, "")
 		mw.setDebugValue([]string{"disks", disk.Name, "Bus"}, disk.Bus)
 		mw.setDebugValue([]string{"disks", disk.Name, "Model"}, disk.Model)
 		mw.setDebugValue([]string{"disks", disk.Name, "Serial"}, disk.Serial)
-		mw.setDebugValue([]string{"disks", disk.Name, "Size"}, byteCountDecimal(int64(disk.NumBlocks*512)))
+		mw.setDebugValue([]string{"disks", disk.Name, "Size"}, engine.ByteCountDecimal(disk.SizeBytes()))
 		mw.setDebugValue([]string{"disks", disk.Name, "Revision"}, disk.Rev)
 		mw.setDebugValue([]string{"disks", disk.Name, "Partition Table"}, disk.PartTabType)
+		mw.setDebugValue([]string{"disks", disk.Name, "Sector Size"}, fmt.Sprintf("%d logical, %d physical", disk.LogicalBlockSize, disk.PhysicalBlockSize))
+		mw.setDebugValue([]string{"disks", disk.Name, "Optimal I/O Size"}, fmt.Sprint(disk.OptimalIOSize))
+		mw.setDebugValue([]string{"disks", disk.Name, "Removable"}, fmt.Sprint(disk.Removable))
+		mw.setDebugValue([]string{"disks", disk.Name, "Rotational"}, fmt.Sprint(disk.Rotational))
+		if disk.LiveMedium {
+			mw.setDebugValue([]string{"disks", disk.Name, "Live Medium"}, "true")
+		}
+		if len(disk.InUse) > 0 {
+			mw.setDebugValue([]string{"disks", disk.Name, "In Use"}, strings.Join(disk.InUse, "; "))
+		}
 
 		if len(disk.Partitions) > 0 {
 			mw.setDebugValue([]string{"disks", disk.Name, "Partitions"}, "")
 			for _, part := range disk.Partitions {
 				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN)}, "")
-				bs, err := getDevBlockSize(part.Name)
-				if err != nil {
-					mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Size"}, "Failed to read size: "+err.Error())
-				} else {
-					mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Size"}, byteCountDecimal(int64(bs*512)))
-				}
+				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Size"}, engine.ByteCountDecimal(part.SizeBytes()))
+				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Start"}, fmt.Sprintf("block %d", part.Start))
+				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Type"}, part.PartType)
 				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Label"}, part.Label)
 				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "Filesystem"}, part.FS)
 				mw.setDebugValue([]string{"disks", disk.Name, "Partitions", fmt.Sprint(part.PartN), "FS UUID"}, part.FsUUID)
 			}
 		}
 	}
-	mw.setDisks(disks)
+	if mw.currPane <= paneSettings {
+		mw.setDisks(disks)
+	}
 }
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 
+	"./engine"
+	"github.com/gotk3/gotk3/cairo"
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
@@ -17,6 +21,15 @@ const (
 	winTitle = "Welcome to TwitchyLinux!"
 )
 
+// Indices of the panes in mainWindow.panes, in the order they are shown.
+const (
+	paneIntro = iota
+	paneSettings
+	panePartitions
+	paneConfirm
+	paneProgress
+)
+
 type debugInfoNode struct {
 	Name, Value string
 	Item        *gtk.TreeIter
@@ -34,6 +47,21 @@ type mainWindow struct {
 	abortBtn         *gtk.Button
 	versionLab       *gtk.Label
 
+	resumeBox   *gtk.Box
+	resumeLabel *gtk.Label
+	// checkpoint describes a failed installation which can be resumed.
+	checkpoint *engine.Checkpoint
+
+	preflightGrid    *gtk.Grid
+	preflightPending *gtk.Label
+	// preflightLabels show the results in preflightGrid.
+	preflightLabels []*gtk.Label
+	// preflight holds the results of the preflight checks, once they
+	// have finished. preflightGen counts the runs of the checks started,
+	// so only the latest one's results are shown.
+	preflight    *engine.Preflight
+	preflightGen int64
+
 	debugInfo  *gtk.TreeView
 	debugModel *gtk.TreeStore
 	debugData  map[string]*debugInfoNode
@@ -44,6 +72,30 @@ type mainWindow struct {
 
 		TzCtrl   *gtk.ComboBoxText
 		DiskCtrl *gtk.ComboBoxText
+		// DiskInUseLabel explains why the selected disk is unsafe to
+		// install to, & DiskOverrideCheck allows it anyway.
+		DiskInUseLabel    *gtk.Label
+		DiskOverrideCheck *gtk.CheckButton
+		DiskWarnLabel     *gtk.Label
+		// AlongsideCheck installs into the disk's free space, after
+		// shrinking the partition chosen in ShrinkCombo (if any) to
+		// ShrinkSizeSpin megabytes.
+		AlongsideCheck *gtk.CheckButton
+		ShrinkBox      *gtk.Box
+		ShrinkCombo    *gtk.ComboBoxText
+		ShrinkSizeSpin *gtk.SpinButton
+		// LVMCheck splits the encrypted partition into logical volumes,
+		// of LVMRootSpin, LVMHomeSpin & LVMSwapSpin megabytes for root,
+		// home & swap. LVMErrLabel explains why they don't fit.
+		LVMCheck    *gtk.CheckButton
+		LVMBox      *gtk.Box
+		LVMRootSpin *gtk.SpinButton
+		LVMHomeSpin *gtk.SpinButton
+		LVMSwapSpin *gtk.SpinButton
+		LVMErrLabel *gtk.Label
+		// BtrfsCheck formats the root partition (or volumes) with btrfs,
+		// rather than ext4.
+		BtrfsCheck *gtk.CheckButton
 
 		PwCtrl    *gtk.Entry
 		PwConfirm *gtk.Entry
@@ -53,6 +105,7 @@ type mainWindow struct {
 		ScrubWarnLabel *gtk.Label
 
 		AutologinCheck *gtk.CheckButton
+		VerifyCheck    *gtk.CheckButton
 
 		PkgChecksBox *gtk.Box
 		Pkgs         []optPkg
@@ -62,14 +115,70 @@ type mainWindow struct {
 	installView       *gtk.TextView
 	installViewScroll *gtk.ScrolledWindow
 	stepLabels        []*gtk.Label
-	progressUpdate    chan progressUpdate
+	progressBar       *gtk.ProgressBar
+	progressUpdate    chan engine.Update
+	// cancelInstall aborts the running installation. It is nil when no
+	// installation is in progress.
+	cancelInstall context.CancelFunc
+
+	// partitionBar draws partitionPlan, the partition table shown on the
+	// confirmation pane.
+	partitionBar  *gtk.DrawingArea
+	partitionPlan *engine.PartitionPlan
+
+	// partitions is the partition editor pane.
+	partitions struct {
+		Bar   *gtk.DrawingArea
+		Table *gtk.TreeView
+		Model *gtk.ListStore
+
+		DeleteBtn    *gtk.Button
+		PropsGrid    *gtk.Grid
+		SizeSpin     *gtk.SpinButton
+		FillCheck    *gtk.CheckButton
+		FsCombo      *gtk.ComboBoxText
+		MountEntry   *gtk.Entry
+		LabelEntry   *gtk.Entry
+		EncryptCheck *gtk.CheckButton
+		ErrLabel     *gtk.Label
+
+		// Layout holds the new partitions being edited, & Edited is set
+		// once the user has changed them from the default layout.
+		// LayoutFor records the disk & settings Layout was made for.
+		Layout    []engine.CustomPartition
+		Edited    bool
+		LayoutFor string
+		// Plan is the partition table drawn by Bar, & Rows the index in
+		// Layout of each row of Table, or -1 for existing partitions.
+		Plan *engine.PartitionPlan
+		Rows []int
+		// updating is set while the table & the selected partition's
+		// properties are being filled in, so the callbacks of their
+		// widgets don't edit the layout.
+		updating bool
+	}
+
+	// otherOSes are the operating systems found on the disks, which are
+	// added to the boot menu.
+	otherOSes []engine.OtherOS
+	// osProbe serializes the searches for other operating systems, which
+	// mount the disks' partitions: see findOtherOSes.
+	osProbe struct {
+		// mu is held while a search runs. stopped is set once the
+		// installation starts, after which none may.
+		mu      sync.Mutex
+		stopped bool
+		// gen counts the searches started, so only the latest one's
+		// results are used.
+		gen int64
+	}
 }
 
 func makeMainWindow() (*mainWindow, error) {
 	mw := mainWindow{
 		debugData:      make(map[string]*debugInfoNode),
 		panes:          make(map[int]*gtk.Grid),
-		progressUpdate: make(chan progressUpdate, 2),
+		progressUpdate: make(chan engine.Update, 2),
 	}
 
 	b, err := gtk.BuilderNewFromFile("layout.glade")
@@ -111,13 +220,15 @@ func (mw *mainWindow) build(b *gtk.Builder) error {
 		return errors.New("couldnt find abortBtn")
 	}
 	mw.abortBtn = obj.(*gtk.Button)
-	mw.abortBtn.Connect("clicked", mw.callbackWindowDestroy)
+	mw.abortBtn.Connect("clicked", mw.callbackAbort)
 	obj, err = b.GetObject("nextBtn")
 	if err != nil {
 		return errors.New("couldnt find nextBtn")
 	}
 	mw.nextBtn = obj.(*gtk.Button)
 	mw.nextBtn.Connect("clicked", mw.callbackNext)
+	// Enabled once the preflight checks pass.
+	mw.nextBtn.SetSensitive(false)
 	obj, err = b.GetObject("previousBtn")
 	if err != nil {
 		return errors.New("couldnt find prevBtn")
@@ -131,14 +242,17 @@ func (mw *mainWindow) build(b *gtk.Builder) error {
 	if err != nil {
 		return errors.New("couldnt find contentGrid")
 	}
-	mw.panes[0] = obj.(*gtk.Grid)
-	if err := mw.loadPaneReference(b, "contentGrid_settings", "fullGrid_settings", 1); err != nil {
+	mw.panes[paneIntro] = obj.(*gtk.Grid)
+	if err := mw.loadPaneReference(b, "contentGrid_settings", "fullGrid_settings", paneSettings); err != nil {
+		return err
+	}
+	if err := mw.loadPaneReference(b, "contentGrid_partitions", "fullGrid_partitions", panePartitions); err != nil {
 		return err
 	}
-	if err := mw.loadPaneReference(b, "contentGrid_confirmation", "fullGrid_confirmation", 2); err != nil {
+	if err := mw.loadPaneReference(b, "contentGrid_confirmation", "fullGrid_confirmation", paneConfirm); err != nil {
 		return err
 	}
-	if err := mw.loadPaneReference(b, "contentGrid_progress", "fullGrid_progress", 3); err != nil {
+	if err := mw.loadPaneReference(b, "contentGrid_progress", "fullGrid_progress", paneProgress); err != nil {
 		return err
 	}
 
@@ -153,6 +267,14 @@ func (mw *mainWindow) build(b *gtk.Builder) error {
 		return errors.New("couldnt find confirmInfo")
 	}
 	mw.confirmView = obj.(*gtk.TextView)
+	obj, err = b.GetObject("partitionBar")
+	if err != nil {
+		return errors.New("couldnt find partitionBar")
+	}
+	mw.partitionBar = obj.(*gtk.DrawingArea)
+	mw.partitionBar.Connect("draw", func(da *gtk.DrawingArea, cr *cairo.Context) {
+		drawPartitionBar(mw.partitionPlan, da, cr)
+	})
 
 	obj, err = b.GetObject("outputProgressText")
 	if err != nil {
@@ -164,7 +286,7 @@ func (mw *mainWindow) build(b *gtk.Builder) error {
 		return errors.New("couldnt find outputProgressScroller")
 	}
 	mw.installViewScroll = obj.(*gtk.ScrolledWindow)
-	for i, _ := range steps {
+	for i, _ := range engine.Steps {
 		obj, err = b.GetObject(fmt.Sprintf("progressstep_%d", i+1))
 		if err != nil {
 			return errors.New("couldnt find progress step")
@@ -172,6 +294,39 @@ func (mw *mainWindow) build(b *gtk.Builder) error {
 		mw.stepLabels = append(mw.stepLabels, obj.(*gtk.Label))
 	}
 
+	obj, err = b.GetObject("installProgressBar")
+	if err != nil {
+		return errors.New("couldnt find installProgressBar")
+	}
+	mw.progressBar = obj.(*gtk.ProgressBar)
+
+	obj, err = b.GetObject("resumeBox")
+	if err != nil {
+		return errors.New("couldnt find resumeBox")
+	}
+	mw.resumeBox = obj.(*gtk.Box)
+	obj, err = b.GetObject("resumeLabel")
+	if err != nil {
+		return errors.New("couldnt find resumeLabel")
+	}
+	mw.resumeLabel = obj.(*gtk.Label)
+	obj, err = b.GetObject("resumeBtn")
+	if err != nil {
+		return errors.New("couldnt find resumeBtn")
+	}
+	obj.(*gtk.Button).Connect("clicked", mw.callbackResume)
+
+	obj, err = b.GetObject("preflightGrid")
+	if err != nil {
+		return errors.New("couldnt find preflightGrid")
+	}
+	mw.preflightGrid = obj.(*gtk.Grid)
+	obj, err = b.GetObject("preflightPending")
+	if err != nil {
+		return errors.New("couldnt find preflightPending")
+	}
+	mw.preflightPending = obj.(*gtk.Label)
+
 	obj, err = b.GetObject("versionLabel")
 	if err != nil {
 		return errors.New("couldnt find versionLabel")
@@ -273,6 +428,86 @@ func (mw *mainWindow) makeSettingsPane(b *gtk.Builder) error {
 		return errors.New("couldnt find installDiskCombo")
 	}
 	mw.settings.DiskCtrl = obj.(*gtk.ComboBoxText)
+	mw.settings.DiskCtrl.Connect("changed", mw.callbackDiskChanged)
+	obj, err = b.GetObject("diskInUseLabel")
+	if err != nil {
+		return errors.New("couldnt find diskInUseLabel")
+	}
+	mw.settings.DiskInUseLabel = obj.(*gtk.Label)
+	obj, err = b.GetObject("diskOverrideCheck")
+	if err != nil {
+		return errors.New("couldnt find diskOverrideCheck")
+	}
+	mw.settings.DiskOverrideCheck = obj.(*gtk.CheckButton)
+	mw.settings.DiskOverrideCheck.Connect("toggled", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("installDiskWarning")
+	if err != nil {
+		return errors.New("couldnt find installDiskWarning")
+	}
+	mw.settings.DiskWarnLabel = obj.(*gtk.Label)
+	obj, err = b.GetObject("alongsideCheck")
+	if err != nil {
+		return errors.New("couldnt find alongsideCheck")
+	}
+	mw.settings.AlongsideCheck = obj.(*gtk.CheckButton)
+	mw.settings.AlongsideCheck.Connect("toggled", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("shrinkBox")
+	if err != nil {
+		return errors.New("couldnt find shrinkBox")
+	}
+	mw.settings.ShrinkBox = obj.(*gtk.Box)
+	obj, err = b.GetObject("shrinkCombo")
+	if err != nil {
+		return errors.New("couldnt find shrinkCombo")
+	}
+	mw.settings.ShrinkCombo = obj.(*gtk.ComboBoxText)
+	mw.settings.ShrinkCombo.Connect("changed", mw.callbackShrinkChanged)
+	obj, err = b.GetObject("shrinkSizeSpin")
+	if err != nil {
+		return errors.New("couldnt find shrinkSizeSpin")
+	}
+	mw.settings.ShrinkSizeSpin = obj.(*gtk.SpinButton)
+	mw.settings.ShrinkSizeSpin.Connect("value-changed", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("lvmCheck")
+	if err != nil {
+		return errors.New("couldnt find lvmCheck")
+	}
+	mw.settings.LVMCheck = obj.(*gtk.CheckButton)
+	mw.settings.LVMCheck.Connect("toggled", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("lvmBox")
+	if err != nil {
+		return errors.New("couldnt find lvmBox")
+	}
+	mw.settings.LVMBox = obj.(*gtk.Box)
+	obj, err = b.GetObject("lvmRootSpin")
+	if err != nil {
+		return errors.New("couldnt find lvmRootSpin")
+	}
+	mw.settings.LVMRootSpin = obj.(*gtk.SpinButton)
+	mw.settings.LVMRootSpin.Connect("value-changed", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("lvmSwapSpin")
+	if err != nil {
+		return errors.New("couldnt find lvmSwapSpin")
+	}
+	mw.settings.LVMSwapSpin = obj.(*gtk.SpinButton)
+	mw.settings.LVMSwapSpin.Connect("value-changed", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("lvmHomeSpin")
+	if err != nil {
+		return errors.New("couldnt find lvmHomeSpin")
+	}
+	mw.settings.LVMHomeSpin = obj.(*gtk.SpinButton)
+	mw.settings.LVMHomeSpin.Connect("value-changed", mw.callbackSettingsTyped)
+	obj, err = b.GetObject("lvmErrorLabel")
+	if err != nil {
+		return errors.New("couldnt find lvmErrorLabel")
+	}
+	mw.settings.LVMErrLabel = obj.(*gtk.Label)
+	obj, err = b.GetObject("btrfsCheck")
+	if err != nil {
+		return errors.New("couldnt find btrfsCheck")
+	}
+	mw.settings.BtrfsCheck = obj.(*gtk.CheckButton)
+	mw.settings.BtrfsCheck.Connect("toggled", mw.callbackSettingsTyped)
 
 	obj, err = b.GetObject("passwordInput")
 	if err != nil {
@@ -321,11 +556,119 @@ func (mw *mainWindow) makeSettingsPane(b *gtk.Builder) error {
 	mw.settings.AutologinCheck = obj.(*gtk.CheckButton)
 	mw.settings.AutologinCheck.Connect("toggled", mw.callbackSettingsTyped)
 
+	obj, err = b.GetObject("verifyCheck")
+	if err != nil {
+		return errors.New("couldnt find verifyCheck")
+	}
+	mw.settings.VerifyCheck = obj.(*gtk.CheckButton)
+
 	obj, err = b.GetObject("clearDiskWarning")
 	if err != nil {
 		return errors.New("couldnt find clearDiskWarning")
 	}
 	mw.settings.ScrubWarnLabel = obj.(*gtk.Label)
 
-	return mw.makePkgChooserCheckboxes(b)
+	if err := mw.makePkgChooserCheckboxes(b); err != nil {
+		return err
+	}
+	return mw.makePartitionsPane(b)
+}
+
+func (mw *mainWindow) makePartitionsPane(b *gtk.Builder) error {
+	obj, err := b.GetObject("partitionEditorBar")
+	if err != nil {
+		return errors.New("couldnt find partitionEditorBar")
+	}
+	mw.partitions.Bar = obj.(*gtk.DrawingArea)
+	mw.partitions.Bar.Connect("draw", func(da *gtk.DrawingArea, cr *cairo.Context) {
+		drawPartitionBar(mw.partitions.Plan, da, cr)
+	})
+
+	obj, err = b.GetObject("partitionTable")
+	if err != nil {
+		return errors.New("couldnt find partitionTable")
+	}
+	mw.partitions.Table = obj.(*gtk.TreeView)
+	for i, title := range []string{"#", "Change", "Size", "Filesystem", "Mount point", "Encrypted", "Label"} {
+		mw.partitions.Table.AppendColumn(createTextColumn(title, i))
+	}
+	mw.partitions.Model, err = gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+	if err != nil {
+		return err
+	}
+	mw.partitions.Table.SetModel(mw.partitions.Model)
+	selection, err := mw.partitions.Table.GetSelection()
+	if err != nil {
+		return err
+	}
+	selection.SetMode(gtk.SELECTION_SINGLE)
+	selection.Connect("changed", mw.callbackPartitionSelected)
+
+	obj, err = b.GetObject("addPartitionBtn")
+	if err != nil {
+		return errors.New("couldnt find addPartitionBtn")
+	}
+	obj.(*gtk.Button).Connect("clicked", mw.callbackAddPartition)
+	obj, err = b.GetObject("deletePartitionBtn")
+	if err != nil {
+		return errors.New("couldnt find deletePartitionBtn")
+	}
+	mw.partitions.DeleteBtn = obj.(*gtk.Button)
+	mw.partitions.DeleteBtn.Connect("clicked", mw.callbackDeletePartition)
+	obj, err = b.GetObject("resetPartitionsBtn")
+	if err != nil {
+		return errors.New("couldnt find resetPartitionsBtn")
+	}
+	obj.(*gtk.Button).Connect("clicked", mw.callbackResetPartitions)
+
+	obj, err = b.GetObject("partitionPropsGrid")
+	if err != nil {
+		return errors.New("couldnt find partitionPropsGrid")
+	}
+	mw.partitions.PropsGrid = obj.(*gtk.Grid)
+	obj, err = b.GetObject("partitionSizeSpin")
+	if err != nil {
+		return errors.New("couldnt find partitionSizeSpin")
+	}
+	mw.partitions.SizeSpin = obj.(*gtk.SpinButton)
+	mw.partitions.SizeSpin.Connect("value-changed", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionFillCheck")
+	if err != nil {
+		return errors.New("couldnt find partitionFillCheck")
+	}
+	mw.partitions.FillCheck = obj.(*gtk.CheckButton)
+	mw.partitions.FillCheck.Connect("toggled", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionFsCombo")
+	if err != nil {
+		return errors.New("couldnt find partitionFsCombo")
+	}
+	mw.partitions.FsCombo = obj.(*gtk.ComboBoxText)
+	for _, fs := range engine.Filesystems {
+		mw.partitions.FsCombo.Append(fs, fs)
+	}
+	mw.partitions.FsCombo.Connect("changed", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionMountEntry")
+	if err != nil {
+		return errors.New("couldnt find partitionMountEntry")
+	}
+	mw.partitions.MountEntry = obj.(*gtk.Entry)
+	mw.partitions.MountEntry.Connect("changed", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionLabelEntry")
+	if err != nil {
+		return errors.New("couldnt find partitionLabelEntry")
+	}
+	mw.partitions.LabelEntry = obj.(*gtk.Entry)
+	mw.partitions.LabelEntry.Connect("changed", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionEncryptCheck")
+	if err != nil {
+		return errors.New("couldnt find partitionEncryptCheck")
+	}
+	mw.partitions.EncryptCheck = obj.(*gtk.CheckButton)
+	mw.partitions.EncryptCheck.Connect("toggled", mw.callbackPartitionEdited)
+	obj, err = b.GetObject("partitionErrorLabel")
+	if err != nil {
+		return errors.New("couldnt find partitionErrorLabel")
+	}
+	mw.partitions.ErrLabel = obj.(*gtk.Label)
+	return nil
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 	"unsafe"
 
+	"./engine"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 )
@@ -18,115 +20,41 @@ import (
 // }
 import "C"
 
-var steps = []InstallStep{
-	&PartitionStep{},
-	&CopyStep{},
-	&ConfigureStep{},
-	&CleanupStep{},
-}
-
-type InstallStep interface {
-	Run(chan progressUpdate, *installState) error
-	Name() string
-}
-
-type installState struct {
-	InstallDevice *disk
-	Pw, User      string
-	Tz, Host      string
-	Scrub         bool
-	Autologin     bool
-
-	OptionalPkgs []string
-}
-
-type progressUpdate struct {
-	Percent         int
-	TransistionStep int
-
-	CmdMsg     string
-	InfoMsg    string
-	WarnMsg    string
-	ErrMsg     string
-	IsProgress bool
-}
-
-func progressInfo(updateChan chan progressUpdate, fmtStr string, args ...interface{}) {
-	updateChan <- progressUpdate{
-		InfoMsg: fmt.Sprintf("  "+fmtStr, args...),
-	}
-}
-
-func runCmd(updateChan chan progressUpdate, logPrefix, cmd string, args ...string) error {
-	e := exec.Command(cmd, args...)
-	progressInfo(updateChan, "%s%s\n", logPrefix, args)
-	out, err := e.CombinedOutput()
-	if len(out) > 4 {
-		progressInfo(updateChan, "  Output: %q\n", string(out))
-	}
-	return err
-}
-
-type cmdInteractiveWriter struct {
-	updateChan chan progressUpdate
-	logPrefix  string
-	IsErr      bool
-	IsProgress bool
-}
-
-func (c *cmdInteractiveWriter) Write(in []byte) (int, error) {
-	for _, line := range strings.Split(string(in), "\n") {
-		line = strings.Trim(line, " \r\n")
-		if len(line) < 2 {
-			continue
-		}
-
-		var out progressUpdate
-		if c.IsErr {
-			out = progressUpdate{
-				WarnMsg: fmt.Sprintf("  %s%s\n", c.logPrefix, line),
-			}
-		} else {
-			out = progressUpdate{
-				InfoMsg: fmt.Sprintf("  %s%s\n", c.logPrefix, line),
-			}
-		}
-		out.IsProgress = c.IsProgress
-		c.updateChan <- out
-	}
-	return len(in), nil
-}
-
-func runCmdInteractive(updateChan chan progressUpdate, logPrefix, cmd string, args ...string) error {
-	e := exec.Command(cmd, args...)
-	progressInfo(updateChan, "%s%s\n", logPrefix, args)
-
-	e.Stdout = &cmdInteractiveWriter{
-		updateChan: updateChan,
-		logPrefix:  logPrefix,
-	}
-	e.Stderr = &cmdInteractiveWriter{
-		updateChan: updateChan,
-		logPrefix:  logPrefix,
-		IsErr:      true,
-	}
-
-	return e.Run()
-}
-
 func (mw *mainWindow) processProgressEventsRoutine(textBuffer *gtk.TextBuffer, scrollWindow *gtk.ScrolledWindow) {
 	var outText string
 	sync := make(chan bool)
 
+	start := time.Now()
+
 	for evt := range mw.progressUpdate {
-		if evt.TransistionStep > 0 {
+		if evt.Kind == engine.KindProgress || evt.Kind == engine.KindFinished {
+			text := progressText(evt.Percent, time.Since(start))
+			glib.IdleAdd(func() {
+				mw.progressBar.SetFraction(float64(evt.Percent) / 100)
+				mw.progressBar.SetText(text)
+				sync <- true
+			})
+			<-sync
+		}
+		if evt.Kind == engine.KindStepFinished {
+			glib.IdleAdd(func() {
+				if evt.Step-1 < len(mw.stepLabels) {
+					lab := mw.stepLabels[evt.Step-1]
+					text, _ := lab.GetText()
+					lab.SetText("✔ " + text)
+				}
+				sync <- true
+			})
+			<-sync
+		}
+		if evt.Kind == engine.KindStepStarted {
 			glib.IdleAdd(func() {
 				for _, lab := range mw.stepLabels {
 					sc, _ := lab.GetStyleContext()
 					sc.RemoveClass("active-progress-label")
 				}
-				if evt.TransistionStep-1 < len(mw.stepLabels) {
-					sc, _ := mw.stepLabels[evt.TransistionStep-1].GetStyleContext()
+				if evt.Step-1 < len(mw.stepLabels) {
+					sc, _ := mw.stepLabels[evt.Step-1].GetStyleContext()
 					sc.AddClass("active-progress-label")
 				}
 				sync <- true
@@ -200,25 +128,79 @@ func (mw *mainWindow) processProgressEventsRoutine(textBuffer *gtk.TextBuffer, s
 	}
 }
 
-func (mw *mainWindow) doInstallRoutine(state installState) {
-	for i, step := range steps {
-		mw.progressUpdate <- progressUpdate{
-			CmdMsg:          fmt.Sprintf("Starting %s\n", step.Name()),
-			TransistionStep: i + 1,
-		}
-		if err := step.Run(mw.progressUpdate, &state); err != nil {
-			fmt.Fprintf(os.Stderr, "Step %d failed: %v\n", i+1, err)
-			mw.progressUpdate <- progressUpdate{
-				ErrMsg: fmt.Sprintf("\nError!: %v\n", err),
-			}
-			return
-		}
-		mw.progressUpdate <- progressUpdate{
-			CmdMsg: fmt.Sprintf("Finished %s\n", step.Name()),
+// progressText describes overall install progress, estimating the time
+// remaining from the time elapsed so far.
+func progressText(percent int, elapsed time.Duration) string {
+	if percent <= 0 {
+		return "0%"
+	}
+	if percent >= 100 {
+		return "100%"
+	}
+	remaining := elapsed * time.Duration(100-percent) / time.Duration(percent)
+	if remaining < time.Minute {
+		return fmt.Sprintf("%d%% — less than a minute remaining", percent)
+	}
+	return fmt.Sprintf("%d%% — about %d minutes remaining", percent, int(remaining.Round(time.Minute)/time.Minute))
+}
+
+// hideSkippedSteps hides the progress labels of steps which have nothing
+// to do for the installation, such as snapshotting a non-btrfs root.
+func (mw *mainWindow) hideSkippedSteps(state *engine.State) {
+	for i, step := range engine.Steps {
+		if i < len(mw.stepLabels) && step.Weight(state) == 0 {
+			mw.stepLabels[i].SetNoShowAll(true)
+			mw.stepLabels[i].Hide()
 		}
 	}
+}
+
+func (mw *mainWindow) doInstallRoutine(ctx context.Context, state engine.State) {
+	// A search for other systems may have the install device's
+	// partitions mounted.
+	mw.stopFindingOtherOSes()
+	if err := engine.Run(ctx, mw.progressUpdate, &state); err != nil {
+		fmt.Fprintf(os.Stderr, "Install failed: %v\n", err)
+	}
+	mw.installFinished()
+}
+
+func (mw *mainWindow) doResumeRoutine(ctx context.Context, checkpoint *engine.Checkpoint) {
+	// A search for other systems may have the install device's
+	// partitions mounted.
+	mw.stopFindingOtherOSes()
+	if err := engine.Resume(ctx, mw.progressUpdate, checkpoint); err != nil {
+		fmt.Fprintf(os.Stderr, "Install failed: %v\n", err)
+	}
+	mw.installFinished()
+}
+
+// installFinished is called once the installation has stopped.
+func (mw *mainWindow) installFinished() {
+	// With the install over, the abort button quits the installer.
+	glib.IdleAdd(func() {
+		mw.cancelInstall = nil
+		mw.abortBtn.SetSensitive(true)
+	})
+}
 
-	mw.progressUpdate <- progressUpdate{
-		CmdMsg: "\nInstallation of TwitchyLinux has finished!!\nYou may now power-cycle your computer & remove installation media.\n",
+// showResumeOption offers to resume a failed installation, if there
+// is one.
+func (mw *mainWindow) showResumeOption() {
+	checkpoint, err := engine.LoadCheckpoint()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read checkpoint: %v\n", err)
+		return
+	}
+	if checkpoint == nil {
+		return
 	}
+	if _, ok := checkpoint.ResumeStep(); !ok {
+		return
+	}
+
+	mw.checkpoint = checkpoint
+	mw.resumeLabel.SetText(fmt.Sprintf("A previous installation to %s did not finish. It can be resumed from the %q step.", checkpoint.Device, checkpoint.StepName()))
+	mw.resumeBox.SetNoShowAll(false)
+	mw.resumeBox.ShowAll()
 }
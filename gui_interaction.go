@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"unsafe"
 
+	"./engine"
 	"github.com/gotk3/gotk3/gtk"
 )
 
@@ -26,15 +30,43 @@ func (mw *mainWindow) setTzs(timezones []string) {
 	for _, t := range timezones {
 		mw.settings.TzCtrl.Append(t, t)
 	}
-	mw.settings.TzCtrl.SetActiveID("America/Los_Angeles")
+	mw.settings.TzCtrl.SetActiveID(defaultTimezone)
 }
 
-// Called from initiialization code to populate the list of disks.
-func (mw *mainWindow) setDisks(disks []disk) {
-	for _, d := range disks {
-		mw.settings.DiskCtrl.Append(d.Path, fmt.Sprintf("%s (%s) - %s bus, %s partition table", d.Path, d.Model, d.Bus, d.PartTabType))
+// Populates the list of disks, called from initiialization code & when
+// disks are hotplugged. Disks in use are marked. The selected disk (& its
+// override) is kept if still present, otherwise the first disk not in use
+// is selected.
+func (mw *mainWindow) setDisks(disks []engine.Disk) {
+	prev := mw.settings.DiskCtrl.GetActiveID()
+	override := mw.settings.DiskOverrideCheck.GetActive()
+	shrink, shrinkMB := mw.settings.ShrinkCombo.GetActiveID(), mw.settings.ShrinkSizeSpin.GetValue()
+	mw.settings.DiskCtrl.RemoveAll()
+
+	active := -1
+	for i, d := range disks {
+		label := fmt.Sprintf("%s (%s) - %s bus, %s partition table", d.Path, d.Model, d.Bus, d.PartTabType)
+		switch {
+		case d.LiveMedium:
+			label += " (live system)"
+		case len(d.InUse) > 0:
+			label += " (in use)"
+		case active < 0:
+			active = i
+		}
+		mw.settings.DiskCtrl.Append(d.Path, label)
+	}
+	if prev != "" && mw.settings.DiskCtrl.SetActiveID(prev) {
+		mw.settings.DiskOverrideCheck.SetActive(override)
+		if mw.settings.ShrinkCombo.SetActiveID(shrink) {
+			mw.settings.ShrinkSizeSpin.SetValue(shrinkMB)
+		}
+		return
 	}
-	mw.settings.DiskCtrl.SetActive(0)
+	if active < 0 {
+		active = 0
+	}
+	mw.settings.DiskCtrl.SetActive(active)
 }
 
 // Creates a new entry in the debug treeview & populates its value. Called
@@ -56,6 +88,22 @@ func (mw *mainWindow) setDebugValue(roots []string, val string) error {
 	return nil
 }
 
+// Removes an entry & its children from the debug treeview, if present.
+func (mw *mainWindow) removeDebugValue(roots []string) {
+	nodes := mw.debugData
+	for _, r := range roots[:len(roots)-1] {
+		n, ok := nodes[r]
+		if !ok {
+			return
+		}
+		nodes = n.Children
+	}
+	if n, ok := nodes[roots[len(roots)-1]]; ok {
+		mw.debugModel.Remove(n.Item)
+		delete(nodes, n.Name)
+	}
+}
+
 func (mw *mainWindow) iterSetDebugValue(n *debugInfoNode, roots []string, val string) error {
 	if len(roots) == 1 {
 		item := mw.debugModel.Append(n.Item)
@@ -93,14 +141,190 @@ func (mw *mainWindow) callbackSettingsTyped() {
 		mw.settings.ScrubWarnLabel.Show()
 	}
 
-	isValid := mainPw != "" && confPw == mainPw && host != "" && user != ""
-	if isValid {
+	// Disks in use can only be chosen with the override checked, & the
+	// live medium or disks too small for the installation not at all.
+	mw.showDiskInUse()
+	mw.showAlongside()
+	if mw.settings.LVMCheck.GetActive() {
+		mw.settings.LVMBox.Show()
+	} else {
+		mw.settings.LVMBox.Hide()
+	}
+	if err := mw.lvmError(); err != nil {
+		mw.settings.LVMErrLabel.SetText(err.Error())
+		mw.settings.LVMErrLabel.Show()
+	} else {
+		mw.settings.LVMErrLabel.Hide()
+	}
+	diskErr := mw.diskError()
+	if diskErr != nil {
+		mw.settings.DiskCtrl.SetTooltipText(diskErr.Error())
+	} else {
+		mw.settings.DiskCtrl.SetTooltipText("")
+	}
+
+	if engine.ValidateSettings(mainPw, confPw, host, user) == nil && diskErr == nil {
 		mw.nextBtn.SetSensitive(true)
 	} else {
 		mw.nextBtn.SetSensitive(false)
 	}
 }
 
+// diskError returns an error if the selected disk (or when installing
+// alongside, its free space) is too small for the installation.
+func (mw *mainWindow) diskError() error {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	if err := d.CheckEligible(mw.settings.DiskOverrideCheck.GetActive()); err != nil {
+		return err
+	}
+	return mw.planError(&d, mw.partitionOptions())
+}
+
+// planError returns an error if the partitions chosen by opts cannot be
+// created on d, or are too small for the installation.
+func (mw *mainWindow) planError(d *engine.Disk, opts engine.PartitionOptions) error {
+	plan := engine.NewPartitionPlan(d, opts)
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	if mw.preflight == nil {
+		return nil
+	}
+	return mw.preflight.CheckPlan(d, plan)
+}
+
+// lvmError returns an error if the logical volume sizes chosen on the
+// settings pane do not fit on the selected disk, though the installation
+// would without LVM.
+func (mw *mainWindow) lvmError() error {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	opts := mw.partitionOptions()
+	if opts.LVM == nil || d.Path == "" {
+		return nil
+	}
+	err := mw.planError(&d, opts)
+	if err == nil {
+		return nil
+	}
+	// Problems which are not caused by LVM are shown for the disk.
+	opts.LVM = nil
+	if mw.planError(&d, opts) != nil {
+		return nil
+	}
+	return err
+}
+
+// partitionOptions returns the partitioning choices made on the settings
+// pane.
+func (mw *mainWindow) partitionOptions() engine.PartitionOptions {
+	opts := engine.PartitionOptions{
+		UEFI:      installUEFI(*bootMode),
+		Alongside: mw.settings.AlongsideCheck.GetVisible() && mw.settings.AlongsideCheck.GetActive(),
+	}
+	if opts.Alongside {
+		if n, err := strconv.Atoi(mw.settings.ShrinkCombo.GetActiveID()); err == nil && n > 0 {
+			opts.Shrink, opts.ShrinkToMB = n, mw.settings.ShrinkSizeSpin.GetValueAsInt()
+		}
+	}
+	if mw.settings.LVMCheck.GetActive() {
+		opts.LVM = &engine.LVMOptions{
+			RootMB: mw.settings.LVMRootSpin.GetValueAsInt(),
+			HomeMB: mw.settings.LVMHomeSpin.GetValueAsInt(),
+			SwapMB: mw.settings.LVMSwapSpin.GetValueAsInt(),
+		}
+	}
+	if mw.settings.BtrfsCheck.GetActive() {
+		opts.RootFS = "btrfs"
+	}
+	return opts
+}
+
+// showAlongside offers to install alongside the selected disk's
+// partitions, if it has any, & to shrink one of them if so.
+func (mw *mainWindow) showAlongside() {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	if len(d.Partitions) == 0 {
+		mw.settings.AlongsideCheck.Hide()
+	} else {
+		mw.settings.AlongsideCheck.Show()
+	}
+	if mw.partitionOptions().Alongside {
+		mw.settings.ShrinkBox.Show()
+		mw.settings.DiskWarnLabel.SetText("The existing partitions will be kept, though a partition chosen to be shrunk may be damaged if it fails.")
+	} else {
+		mw.settings.ShrinkBox.Hide()
+		mw.settings.DiskWarnLabel.SetText("WARNING: The contents of the selected disk will be irreversibly overwritten!")
+	}
+}
+
+// setShrinkParts lists the partitions of d which can be shrunk to make
+// room to install alongside them.
+func (mw *mainWindow) setShrinkParts(d engine.Disk) {
+	mw.settings.ShrinkCombo.RemoveAll()
+	mw.settings.ShrinkCombo.Append("0", "Use the existing free space")
+	for _, p := range d.Partitions {
+		if p.FS != "ext4" && p.FS != "ntfs" {
+			continue
+		}
+		label := fmt.Sprintf("Shrink %s (%s", p.Path, p.FS)
+		if p.Label != "" {
+			label += ", " + p.Label
+		}
+		mw.settings.ShrinkCombo.Append(strconv.Itoa(p.PartN), fmt.Sprintf("%s, %s) to", label, engine.ByteCountDecimal(p.SizeBytes())))
+	}
+	mw.settings.ShrinkCombo.SetActiveID("0")
+}
+
+// This callback is called when a different partition to shrink is
+// selected, limiting its new size to less than its current size.
+func (mw *mainWindow) callbackShrinkChanged() {
+	n, _ := strconv.Atoi(mw.settings.ShrinkCombo.GetActiveID())
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	mw.settings.ShrinkSizeSpin.SetSensitive(false)
+	for _, p := range d.Partitions {
+		if p.PartN == n {
+			sizeMB := float64(p.SizeBytes() / (1024 * 1024))
+			mw.settings.ShrinkSizeSpin.SetRange(1, sizeMB-1)
+			mw.settings.ShrinkSizeSpin.SetValue(sizeMB / 2)
+			mw.settings.ShrinkSizeSpin.SetSensitive(true)
+		}
+	}
+	if mw.currPane == paneSettings {
+		mw.callbackSettingsTyped()
+	}
+}
+
+// showDiskInUse explains why the selected disk is in use, offering the
+// override unless it is the live medium.
+func (mw *mainWindow) showDiskInUse() {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	switch {
+	case d.LiveMedium:
+		mw.settings.DiskInUseLabel.SetText("This disk holds the running live system, so cannot be installed to.")
+		mw.settings.DiskInUseLabel.Show()
+		mw.settings.DiskOverrideCheck.Hide()
+	case len(d.InUse) > 0:
+		mw.settings.DiskInUseLabel.SetText("This disk is in use:\n  " + strings.Join(d.InUse, "\n  "))
+		mw.settings.DiskInUseLabel.Show()
+		mw.settings.DiskOverrideCheck.Show()
+	default:
+		mw.settings.DiskInUseLabel.Hide()
+		mw.settings.DiskOverrideCheck.Hide()
+	}
+}
+
+// This callback is called when a different disk is selected.
+func (mw *mainWindow) callbackDiskChanged() {
+	// The override & partition to shrink only apply to the disk they
+	// were chosen for.
+	mw.settings.DiskOverrideCheck.SetActive(false)
+	mw.setShrinkParts(getDisk(mw.settings.DiskCtrl.GetActiveText()))
+	// The selection is set while the intro pane is shown.
+	if mw.currPane == paneSettings {
+		mw.callbackSettingsTyped()
+	}
+}
+
 // This callback is called when the password inputs are changed.
 // This sets the red coloring on the label if they dont match,
 // and invokes callbackSettingsTyped() to validate remaining fields.
@@ -132,7 +356,7 @@ func (mw *mainWindow) callbackNext() {
 		mw.currPane = len(mw.panes) - 1
 		return
 	}
-	if mw.currPane == 0 {
+	if mw.currPane == paneIntro {
 		mw.prevBtn.SetSensitive(false)
 	} else {
 		mw.prevBtn.SetSensitive(true)
@@ -157,11 +381,11 @@ func (mw *mainWindow) callbackNext() {
 	// Also, if pressing next symbolizes some action (ie: install),
 	// that action is initiated from here.
 	sc, _ := mw.nextBtn.GetStyleContext()
-	if mw.currPane == 2 {
+	if mw.currPane == paneConfirm {
 		sc.AddClass("danger")
 		mw.nextBtn.SetLabel("Install")
 		mw.populateConfirmDetails()
-	} else if mw.currPane == 3 {
+	} else if mw.currPane == paneProgress {
 		mw.nextBtn.SetSensitive(false)
 		mw.prevBtn.SetSensitive(false)
 		sc.RemoveClass("danger")
@@ -169,34 +393,39 @@ func (mw *mainWindow) callbackNext() {
 	} else {
 		mw.nextBtn.SetLabel("Next")
 		sc.RemoveClass("danger")
-		if mw.currPane == 1 {
+		if mw.currPane == paneSettings {
 			mw.nextBtn.SetSensitive(false)
 			mw.callbackSettingsTyped()
 		}
+		if mw.currPane == panePartitions {
+			mw.showPartitionEditor()
+		}
 	}
 }
 
-func (mw *mainWindow) doSetupStartInstall() {
+// settingsState returns the install state described by the
+// settings pane.
+func (mw *mainWindow) settingsState() (engine.State, error) {
 	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	if d.Path == "" {
+		return engine.State{}, fmt.Errorf("%s is no longer present", mw.settings.DiskCtrl.GetActiveID())
+	}
 	p, err := mw.settings.PwCtrl.GetText()
 	if err != nil {
-		fmt.Printf("Failed to read password: %v\n", err)
-		return
+		return engine.State{}, fmt.Errorf("failed to read password: %v", err)
 	}
 	u, err := mw.settings.UserCtrl.GetText()
 	if err != nil {
-		fmt.Printf("Failed to read username: %v\n", err)
-		return
+		return engine.State{}, fmt.Errorf("failed to read username: %v", err)
 	}
 	h, err := mw.settings.HostCtrl.GetText()
 	if err != nil {
-		fmt.Printf("Failed to read username: %v\n", err)
-		return
+		return engine.State{}, fmt.Errorf("failed to read hostname: %v", err)
 	}
 	scrub := mw.settings.ScrubCheck.GetActive()
 	autologin := mw.settings.AutologinCheck.GetActive()
 
-	state := installState{
+	state := engine.State{
 		InstallDevice: &d,
 		Pw:            p,
 		User:          u,
@@ -204,15 +433,70 @@ func (mw *mainWindow) doSetupStartInstall() {
 		Scrub:         scrub,
 		Autologin:     autologin,
 		Tz:            mw.settings.TzCtrl.GetActiveText(),
+		UEFI:          installUEFI(*bootMode),
+		CopyWorkers:   *copyWorkers,
+		SkipVerify:    !mw.settings.VerifyCheck.GetActive(),
+		Source:        *sourceImage,
 	}
+	opts := mw.layoutOptions()
+	state.Alongside, state.ShrinkPart, state.ShrinkToMB = opts.Alongside, opts.Shrink, opts.ShrinkToMB
+	state.Layout, state.LVM, state.RootFS = opts.Layout, opts.LVM, opts.RootFS
+	state.OtherOSes = mw.otherOSes
 
 	for _, pkg := range mw.settings.Pkgs {
 		if pkg.checkbox.GetActive() {
 			state.OptionalPkgs = append(state.OptionalPkgs, pkg.Name)
 		}
 	}
+	return state, nil
+}
+
+func (mw *mainWindow) doSetupStartInstall() {
+	state, err := mw.settingsState()
+	if err != nil {
+		// The disk may have been unplugged since the settings were
+		// confirmed, so they must be chosen again.
+		dialog := gtk.MessageDialogNew(mw.win, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_OK,
+			"Cannot start the installation: %s.\n\nPlease check the settings and try again.", err)
+		dialog.Run()
+		dialog.Destroy()
+		mw.currPane = paneSettings + 1
+		mw.callbackPrev()
+		return
+	}
+	mw.hideSkippedSteps(&state)
+	ctx, cancel := context.WithCancel(context.Background())
+	mw.cancelInstall = cancel
+	go mw.doInstallRoutine(ctx, state)
+}
+
+// This callback is invoked when the resume button is pressed.
+func (mw *mainWindow) callbackResume() {
+	from, ok := mw.checkpoint.ResumeStep()
+	if !ok {
+		return
+	}
+
+	// Skip straight to the progress pane.
+	currentPane, err := mw.fullGrid.GetChildAt(0, 1)
+	if err != nil {
+		fmt.Printf("Failed to get current pane: %v\n", err)
+		return
+	}
+	mw.currPane = len(mw.panes) - 1
+	mw.fullGrid.Remove(currentPane)
+	mw.fullGrid.Attach(mw.panes[mw.currPane], 0, 1, 1, 1)
+	mw.nextBtn.SetSensitive(false)
+	mw.prevBtn.SetSensitive(false)
+	mw.hideSkippedSteps(&mw.checkpoint.State)
+	for i := 0; i < from && i < len(mw.stepLabels); i++ {
+		text, _ := mw.stepLabels[i].GetText()
+		mw.stepLabels[i].SetText("✔ " + text)
+	}
 
-	go mw.doInstallRoutine(state)
+	ctx, cancel := context.WithCancel(context.Background())
+	mw.cancelInstall = cancel
+	go mw.doResumeRoutine(ctx, mw.checkpoint)
 }
 
 // This callback is invoked when the previous button is pressed.
@@ -222,13 +506,15 @@ func (mw *mainWindow) callbackPrev() {
 		mw.currPane = 0
 		return
 	}
-	if mw.currPane == 0 {
+	if mw.currPane == paneIntro {
 		mw.prevBtn.SetSensitive(false)
 	} else {
 		mw.prevBtn.SetSensitive(true)
 	}
 	if mw.currPane == len(mw.panes)-1 {
 		mw.nextBtn.SetSensitive(false)
+	} else if mw.currPane == paneIntro {
+		mw.nextBtn.SetSensitive(mw.preflightPassed())
 	} else {
 		mw.nextBtn.SetSensitive(true)
 	}
@@ -249,9 +535,14 @@ func (mw *mainWindow) callbackPrev() {
 	}
 	sc.RemoveClass("danger")
 
-	if mw.currPane == 1 {
+	if mw.currPane == paneSettings {
+		// Pick up disks hotplugged since the settings were confirmed.
+		mw.setDisks(disks)
 		mw.callbackSettingsTyped()
 	}
+	if mw.currPane == panePartitions {
+		mw.showPartitionEditor()
+	}
 }
 
 type textviewStyleSelection struct {
@@ -304,10 +595,18 @@ func (mw *mainWindow) populateConfirmDetails() {
 	writeStyled(d.Model+" ("+d.Serial+")", "")
 	writeStyled("\n", "")
 	writeStyled("  Capacity: ", "settingName")
-	writeStyled(byteCountDecimal(int64(d.NumBlocks*512))+"\n", "")
+	writeStyled(engine.ByteCountDecimal(d.SizeBytes())+"\n", "")
+	writeStyled("  Sector size: ", "settingName")
+	writeStyled(fmt.Sprintf("%d bytes logical, %d bytes physical\n", d.LogicalBlockSize, d.PhysicalBlockSize), "")
 	writeStyled("  UUID: ", "settingName")
 	writeStyled(d.PartUUID, "")
 	writeStyled("\n", "")
+	writeStyled("  Boot mode: ", "settingName")
+	if installUEFI(*bootMode) {
+		writeStyled("UEFI (GPT partition table)\n", "")
+	} else {
+		writeStyled("BIOS (msdos partition table)\n", "")
+	}
 	writeStyled("  Partitions: ", "settingName")
 	writeStyled(fmt.Sprintf("%d read from %s table", len(d.Partitions), d.PartTabType), "")
 	writeStyled("\n", "")
@@ -317,15 +616,44 @@ func (mw *mainWindow) populateConfirmDetails() {
 		writeStyled(fmt.Sprintf("      Filesystem UUID: %s\n", part.FsUUID), "")
 		writeStyled(fmt.Sprintf("      Partition UUID: %s\n", part.PartUUID), "")
 	}
-	writeStyled("  WARNING: Any existing data on this disk will be lost.\n", "warning")
+	if plan := engine.NewPartitionPlan(&d, mw.layoutOptions()); plan.Alongside {
+		writeStyled("  Installing alongside the existing partitions:\n", "settingName")
+		for _, p := range plan.Partitions {
+			class := ""
+			if p.Change() == "Shrunk" {
+				class = "warning"
+			}
+			writeStyled(fmt.Sprintf("    %-9s %d: %s", p.Change(), p.Num, p.Desc), class)
+			if p.Filesystem != "" {
+				writeStyled(" ["+p.Filesystem+"]", class)
+			}
+			if p.Change() == "Shrunk" {
+				writeStyled(fmt.Sprintf(", from %s", engine.ByteCountDecimal(plan.Bytes(p.OldEndSector-p.StartSector))), class)
+			}
+			writeStyled(fmt.Sprintf(" (%s)\n", engine.ByteCountDecimal(plan.Bytes(p.Sectors()))), class)
+		}
+		if mw.partitionOptions().Shrink != 0 {
+			writeStyled("  WARNING: Back up the partition being shrunk; its data may be lost if shrinking fails.\n", "warning")
+		}
+	} else {
+		writeStyled("  WARNING: Any existing data on this disk will be lost.\n", "warning")
+	}
 
 	if mw.settings.ScrubCheck.GetActive() {
-		writeStyled("  Zeros will be written to existing partition (scrubbing) before formatting.\n", "")
+		writeStyled("  Zeros will be written to the encrypted partition (scrubbing) before formatting.\n", "")
 	} else {
 		writeStyled("  WARNING: Encrypted partition will not be scrubbed. This may reveal information\n", "warning")
 		writeStyled("  about the usage patterns of your system if your disk is examined.\n", "warning")
 	}
 
+	if state, err := mw.settingsState(); err == nil {
+		writeStyled("\nBoot menu:\n", "settingName")
+		writeStyled("  TwitchyLinux\n", "")
+		for _, o := range state.BootMenuOSes() {
+			writeStyled("  "+o.Desc()+"\n", "")
+		}
+	}
+
 	p, _ := mw.settings.PwCtrl.GetText()
 	// If I find a nice entropy evaluation library, we should use that instead.
 	// I am fully aware that 8 chars is both too short, and a poor estimate of entropy.
@@ -344,6 +672,39 @@ func (mw *mainWindow) populateConfirmDetails() {
 		}
 	}
 
+	mw.partitionPlan = nil
+	defer mw.partitionBar.QueueDraw()
+	if state, err := mw.settingsState(); err == nil {
+		writeStyled("\nPlanned actions:\n", "settingName")
+		for _, step := range engine.Plan(&state) {
+			writeStyled("  "+step.Step+"\n", "settingName")
+			for _, a := range step.Actions {
+				writeStyled("    "+a.Desc+"\n", "")
+				if pp := a.PartitionPlan; pp != nil {
+					mw.partitionPlan = pp
+					for _, p := range pp.Partitions {
+						writeStyled(fmt.Sprintf("      %d: [%s] %s, sectors %d - %d (%s, %s)\n", p.Num, p.Filesystem, p.Desc, p.StartSector, p.EndSector, engine.ByteCountDecimal(pp.Bytes(p.Sectors())), strings.ToLower(p.Change())), "")
+					}
+					for _, lv := range pp.Volumes {
+						writeStyled(fmt.Sprintf("         [%s] %s in volume group %s (%s)\n", lv.Filesystem, lv.Desc, pp.VolumeGroup, engine.ByteCountDecimal(lv.Bytes)), "")
+					}
+					for _, sv := range pp.Subvolumes {
+						writeStyled(fmt.Sprintf("         [btrfs] Subvolume %s, mounted at %s\n", sv.Name, sv.MountPoint), "")
+					}
+				}
+				if len(a.Argv) > 0 {
+					writeStyled("      $ "+strings.Join(a.Argv, " ")+"\n", "")
+				}
+				if a.Stdin != "" {
+					writeStyled(fmt.Sprintf("      stdin: %q\n", a.Stdin), "")
+				}
+				if a.Path != "" {
+					writeStyled("      path: "+a.Path+"\n", "")
+				}
+			}
+		}
+	}
+
 	textBuffer.SetText(outText)
 	for _, t := range styles {
 		if t.Class != "" {
@@ -352,6 +713,25 @@ func (mw *mainWindow) populateConfirmDetails() {
 	}
 }
 
+// This callback is invoked when the abort button is pressed.
+func (mw *mainWindow) callbackAbort() {
+	if mw.cancelInstall == nil {
+		gtk.MainQuit()
+		return
+	}
+
+	dialog := gtk.MessageDialogNew(mw.win, gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_YES_NO,
+		"Abort the installation?\n\nThe disk will be left partially installed, and will need to be installed again before it can be used.")
+	resp := dialog.Run()
+	dialog.Destroy()
+	if resp != gtk.RESPONSE_YES || mw.cancelInstall == nil {
+		return
+	}
+
+	mw.abortBtn.SetSensitive(false)
+	mw.cancelInstall()
+}
+
 func (mw *mainWindow) callbackWindowDestroy() {
 	gtk.MainQuit()
 }
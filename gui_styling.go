@@ -37,6 +37,19 @@ const styling = `
 	font-weight: bold;
 }
 
+.check-pass {
+	color: #11AA11;
+}
+
+.check-warn {
+	color: #DD8800;
+}
+
+.check-fail {
+	color: #CC1111;
+	font-weight: bold;
+}
+
 .active-progress-label {
 	font-weight: bold;
 	font-size: 135%;
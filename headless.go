@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"./engine"
+)
+
+// answerFile describes an unattended installation. The password is always
+// used as the disk encryption password; if passwordHash is set (in crypt(3)
+// format), it is used for the user & root accounts instead.
+type answerFile struct {
+	Disk struct {
+		Path   string `json:"path"`
+		Serial string `json:"serial"`
+		Model  string `json:"model"`
+	} `json:"disk"`
+
+	User         string `json:"user"`
+	Hostname     string `json:"hostname"`
+	Timezone     string `json:"timezone"`
+	Password     string `json:"password"`
+	PasswordHash string `json:"password_hash"`
+
+	Scrub      bool     `json:"scrub"`
+	Autologin  bool     `json:"autologin"`
+	SkipVerify bool     `json:"skip_verify"`
+	Packages   []string `json:"packages"`
+
+	// Source is the image to install from, unless overridden by -source.
+	Source string `json:"source"`
+	// AllowBusyDisk permits installing to a disk which is mounted or
+	// otherwise in use. The live medium is never allowed.
+	AllowBusyDisk bool `json:"allow_busy_disk"`
+	// Alongside keeps the disk's existing partitions, installing into its
+	// free space. ShrinkPartition is the number of an ext4 or NTFS
+	// partition to shrink to ShrinkToMB first, making room.
+	Alongside       bool `json:"alongside"`
+	ShrinkPartition int  `json:"shrink_partition"`
+	ShrinkToMB      int  `json:"shrink_to_mb"`
+	// Partitions, if set, replaces the default layout of the new
+	// partitions.
+	Partitions []engine.CustomPartition `json:"partitions"`
+	// LVM, if set, splits the encrypted root partition into logical
+	// volumes for root, home & swap of the given sizes.
+	LVM *engine.LVMOptions `json:"lvm"`
+	// RootFilesystem is the filesystem of the root partition (or
+	// volumes): ext4 if empty, or btrfs.
+	RootFilesystem string `json:"root_filesystem"`
+}
+
+func readAnswerFile(p string) (*answerFile, error) {
+	d, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	out := answerFile{Timezone: defaultTimezone}
+	if err := json.Unmarshal(d, &out); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return &out, nil
+}
+
+// matches returns true if the disk matches all the selectors specified
+// in the answer file.
+func (a *answerFile) matches(d engine.Disk) bool {
+	if a.Disk.Path != "" && a.Disk.Path != d.Path {
+		var isSymlink bool
+		for _, l := range d.Symlinks {
+			if a.Disk.Path == l {
+				isSymlink = true
+			}
+		}
+		if !isSymlink {
+			return false
+		}
+	}
+	if a.Disk.Serial != "" && a.Disk.Serial != d.Serial {
+		return false
+	}
+	if a.Disk.Model != "" && a.Disk.Model != d.Model {
+		return false
+	}
+	return true
+}
+
+// installState resolves & validates the answers, returning the state
+// to install with.
+func (a *answerFile) installState(disks []engine.Disk) (*engine.State, error) {
+	if err := engine.ValidateSettings(a.Password, a.Password, a.Hostname, a.User); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path.Join(tzBase, a.Timezone)); err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", a.Timezone, err)
+	}
+	for _, pkg := range a.Packages {
+		if _, err := os.Stat(path.Join("/deb-pkgs", pkg)); err != nil {
+			return nil, fmt.Errorf("invalid package %q: %v", pkg, err)
+		}
+	}
+
+	source := a.Source
+	if *sourceImage != "" {
+		source = *sourceImage
+	}
+	if _, err := engine.NewSource(source); err != nil {
+		return nil, fmt.Errorf("invalid source: %v", err)
+	}
+
+	if a.Disk.Path == "" && a.Disk.Serial == "" && a.Disk.Model == "" {
+		return nil, errors.New("no disk specified")
+	}
+	var matched []engine.Disk
+	for _, d := range disks {
+		if a.matches(d) {
+			matched = append(matched, d)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, errors.New("no disk matched the disk selector")
+	case 1:
+	default:
+		return nil, fmt.Errorf("disk selector is ambiguous: %d disks matched", len(matched))
+	}
+	if err := matched[0].CheckEligible(a.AllowBusyDisk); err != nil {
+		return nil, err
+	}
+
+	return &engine.State{
+		InstallDevice: &matched[0],
+		Pw:            a.Password,
+		PwHash:        a.PasswordHash,
+		User:          a.User,
+		Host:          a.Hostname,
+		Tz:            a.Timezone,
+		Scrub:         a.Scrub,
+		Autologin:     a.Autologin,
+		UEFI:          installUEFI(*bootMode),
+		CopyWorkers:   *copyWorkers,
+		SkipVerify:    a.SkipVerify,
+		Source:        source,
+		OptionalPkgs:  a.Packages,
+		Alongside:     a.Alongside,
+		ShrinkPart:    a.ShrinkPartition,
+		ShrinkToMB:    a.ShrinkToMB,
+		Layout:        a.Partitions,
+		LVM:           a.LVM,
+		RootFS:        a.RootFilesystem,
+	}, nil
+}
+
+// printProgressEvents writes progress messages to stdout until
+// updateChan is closed.
+func printProgressEvents(updateChan chan engine.Update, done chan bool) {
+	lastPercent := -1
+	for evt := range updateChan {
+		if evt.Kind == engine.KindProgress && evt.Percent != lastPercent {
+			lastPercent = evt.Percent
+			fmt.Printf("Progress: %d%%\n", evt.Percent)
+		}
+		for _, msg := range []string{evt.CmdMsg, evt.ErrMsg, evt.WarnMsg, evt.InfoMsg} {
+			if msg != "" {
+				fmt.Print(msg)
+			}
+		}
+	}
+	done <- true
+}
+
+// runHeadless installs TwitchyLinux without a GUI, using the settings
+// from the answer file at answersPath.
+func runHeadless(answersPath string) error {
+	answers, err := readAnswerFile(answersPath)
+	if err != nil {
+		return err
+	}
+	disks, err := engine.GetDiskInfo()
+	if err != nil {
+		return fmt.Errorf("GetDiskInfo() failed: %v", err)
+	}
+	state, err := answers.installState(disks)
+	if err != nil {
+		return fmt.Errorf("%s: %v", answersPath, err)
+	}
+	if state.OtherOSes, err = engine.FindOtherOSes(disks); err != nil {
+		return fmt.Errorf("FindOtherOSes() failed: %v", err)
+	}
+
+	if *planOnly {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(engine.Plan(state))
+	}
+
+	preflight := engine.RunPreflight(disks, state.Source, state.UEFI)
+	for _, r := range preflight.Results {
+		fmt.Printf("[%s] %s: %s\n", strings.ToUpper(r.Status.String()), r.Name, r.Detail)
+	}
+	if preflight.Failed() {
+		return errors.New("the system does not meet the requirements for installation")
+	}
+	plan := state.PartitionPlan()
+	if err := plan.Validate(); err != nil {
+		return fmt.Errorf("cannot install to %s: %v", state.InstallDevice.Path, err)
+	}
+	if err := preflight.CheckPlan(state.InstallDevice, plan); err != nil {
+		return err
+	}
+
+	return runPrintingProgress(func(ctx context.Context, updateChan chan engine.Update) error {
+		return engine.Run(ctx, updateChan, state)
+	})
+}
+
+// runResume resumes a failed installation without a GUI.
+func runResume() error {
+	checkpoint, err := engine.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		return errors.New("there is no failed installation to resume")
+	}
+	if _, ok := checkpoint.ResumeStep(); !ok {
+		return errors.New("the failed installation cannot be resumed, and must be started again")
+	}
+	return runPrintingProgress(func(ctx context.Context, updateChan chan engine.Update) error {
+		return engine.Resume(ctx, updateChan, checkpoint)
+	})
+}
+
+// runPrintingProgress runs an installation, printing its progress.
+func runPrintingProgress(install func(context.Context, chan engine.Update) error) error {
+	updateChan, done := make(chan engine.Update, 2), make(chan bool)
+	go printProgressEvents(updateChan, done)
+	// Abort the install (tearing down the disk) on an interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := install(ctx, updateChan)
+	close(updateChan)
+	<-done
+	return err
+}
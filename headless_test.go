@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"./engine"
+)
+
+func TestAnswerFileMatches(t *testing.T) {
+	d := engine.Disk{
+		Path:     "/dev/sda",
+		Serial:   "S3Z9NB0K123456",
+		Model:    "Samsung_SSD_860_EVO",
+		Symlinks: []string{"/dev/disk/by-id/ata-Samsung_SSD_860_EVO_S3Z9NB0K123456", "/dev/disk/by-path/pci-0000:00:17.0-ata-1"},
+	}
+	tcs := []struct {
+		name                string
+		path, serial, model string
+		want                bool
+	}{
+		{name: "path", path: "/dev/sda", want: true},
+		{name: "by-id link", path: "/dev/disk/by-id/ata-Samsung_SSD_860_EVO_S3Z9NB0K123456", want: true},
+		{name: "by-path link", path: "/dev/disk/by-path/pci-0000:00:17.0-ata-1", want: true},
+		{name: "other path", path: "/dev/sdb"},
+		{name: "relative link", path: "disk/by-id/ata-Samsung_SSD_860_EVO_S3Z9NB0K123456"},
+		{name: "serial & model", serial: "S3Z9NB0K123456", model: "Samsung_SSD_860_EVO", want: true},
+		{name: "link & other serial", path: "/dev/disk/by-path/pci-0000:00:17.0-ata-1", serial: "WD-1234"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var a answerFile
+			a.Disk.Path, a.Disk.Serial, a.Disk.Model = tc.path, tc.serial, tc.model
+			if got := a.matches(d); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,17 +0,0 @@
-package main
-
-const fstabData = `# Begin /etc/fstab
-# file system  mount-point  type     options             dump  fsck
-#                                                              order
-/dev/mapper/cryptroot /     ext4 defaults 0 1
-UUID=BOOT_DEV /boot auto defaults 1 2
-
-#Uncomment for swap space
-#/dev/<yyy>     swap         swap     pri=1               0     0
-proc           /proc        proc     nosuid,noexec,nodev 0     0
-sysfs          /sys         sysfs    nosuid,noexec,nodev 0     0
-devpts         /dev/pts     devpts   gid=5,mode=620      0     0
-tmpfs          /run         tmpfs    defaults            0     0
-devtmpfs       /dev         devtmpfs mode=0755,nosuid    0     0
-# End /etc/fstab
-`
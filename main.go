@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"os"
 
+	"./engine"
 	"github.com/gotk3/gotk3/gtk"
 )
 
 var (
-	debugMode = flag.Bool("debug", false, "Enable debugging")
-	version   = flag.String("version", "", "Version to display")
+	debugMode   = flag.Bool("debug", false, "Enable debugging")
+	version     = flag.String("version", "", "Version to display")
+	bootMode    = flag.String("boot-mode", bootModeAuto, "Boot mode to install for (auto, bios or uefi)")
+	answers     = flag.String("answers", "", "Install without a GUI, using settings from the given answer file")
+	planOnly    = flag.Bool("plan", false, "With -answers, print the planned install actions as JSON instead of installing")
+	resume      = flag.Bool("resume", false, "Resume a failed installation without a GUI")
+	copyWorkers = flag.Int("copy-workers", 0, "Number of files to copy concurrently (default one per CPU)")
+	sourceImage = flag.String("source", "", "Install from a squashfs, filesystem image or tarball instead of the live system")
 )
 
 func main() {
@@ -23,6 +30,20 @@ func main() {
 			os.Exit(1)
 		}
 	}()
+	if err = checkBootMode(*bootMode); err != nil {
+		return
+	}
+	if _, err = engine.NewSource(*sourceImage); err != nil {
+		return
+	}
+	if *resume {
+		err = runResume()
+		return
+	}
+	if *answers != "" {
+		err = runHeadless(*answers)
+		return
+	}
 
 	gtk.Init(&args)
 
@@ -34,6 +55,10 @@ func main() {
 	readDiskInfo(mw)
 	readNetInfo(mw)
 	readTimezoneInfo(mw)
+	mw.showResumeOption()
+	mw.runPreflight(disks)
+	mw.findOtherOSes(disks)
+	go mw.watchDisks()
 
 	mw.mainLoop()
 }
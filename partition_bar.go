@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"./engine"
+	"github.com/gotk3/gotk3/cairo"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Colors of partitions in the partition bar, as RGB.
+var (
+	freeSpaceColor = [3]float64{0.85, 0.85, 0.85}
+	encryptedColor = [3]float64{0.45, 0.30, 0.65}
+	fsColors       = map[string][3]float64{
+		"ext4":  {0.20, 0.45, 0.75},
+		"xfs":   {0.15, 0.60, 0.65},
+		"btrfs": {0.30, 0.35, 0.80},
+		"fat32": {0.85, 0.55, 0.15},
+		"swap":  {0.75, 0.30, 0.30},
+		"lvm":   {0.45, 0.30, 0.65},
+	}
+	otherFSColor = [3]float64{0.40, 0.60, 0.40}
+	// existingColor marks the partitions preserved when installing
+	// alongside them.
+	existingColor = [3]float64{0.55, 0.55, 0.55}
+)
+
+func partitionColor(p *engine.PlannedPartition) [3]float64 {
+	if p.Existing {
+		return existingColor
+	}
+	if p.Encrypted {
+		return encryptedColor
+	}
+	if c, ok := fsColors[p.Filesystem]; ok {
+		return c
+	}
+	return otherFSColor
+}
+
+// partitionBarLabel names a partition in the partition bar.
+func partitionBarLabel(p *engine.PlannedPartition) string {
+	switch {
+	case p.MountPoint != "":
+		return fmt.Sprintf("%d: %s", p.Num, p.MountPoint)
+	case p.Name != "":
+		return fmt.Sprintf("%d: %s", p.Num, p.Name)
+	case p.Label != "":
+		return fmt.Sprintf("%d: %s", p.Num, p.Label)
+	}
+	return fmt.Sprintf("%d: %s", p.Num, p.Filesystem)
+}
+
+// drawPartitionBar draws the planned partition table as a bar across da
+// (on the partition editor & confirmation panes), each partition's width
+// proportional to its size. Partitions are labelled if there is room.
+func drawPartitionBar(plan *engine.PartitionPlan, da *gtk.DrawingArea, cr *cairo.Context) {
+	if plan == nil || plan.Sectors <= 0 {
+		return
+	}
+	w, h := float64(da.GetAllocatedWidth()), float64(da.GetAllocatedHeight())
+
+	cr.SetSourceRGB(freeSpaceColor[0], freeSpaceColor[1], freeSpaceColor[2])
+	cr.Rectangle(0, 0, w, h)
+	cr.Fill()
+
+	cr.SelectFontFace("Sans", cairo.FONT_SLANT_NORMAL, cairo.FONT_WEIGHT_NORMAL)
+	cr.SetFontSize(11)
+	cr.SetLineWidth(1)
+	for i := range plan.Partitions {
+		p := &plan.Partitions[i]
+		x := w * float64(p.StartSector) / float64(plan.Sectors)
+		pw := w * float64(p.Sectors()) / float64(plan.Sectors)
+		if pw < 2 {
+			pw = 2
+		}
+		c := partitionColor(p)
+		cr.SetSourceRGB(c[0], c[1], c[2])
+		cr.Rectangle(x, 0, pw, h)
+		cr.Fill()
+		cr.SetSourceRGB(1, 1, 1)
+		cr.Rectangle(x+0.5, 0.5, pw-1, h-1)
+		cr.Stroke()
+
+		for line, text := range []string{partitionBarLabel(p), engine.ByteCountDecimal(plan.Bytes(p.Sectors()))} {
+			if ext := cr.TextExtents(text); ext.Width+8 > pw {
+				continue
+			}
+			cr.MoveTo(x+4, h/2-4+float64(line)*14)
+			cr.ShowText(text)
+		}
+	}
+}
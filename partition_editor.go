@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"./engine"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// newPartitionMB is the size of partitions added in the partition editor.
+const newPartitionMB = 10 * 1024
+
+// layoutOptions returns the partitioning choices made on the settings &
+// partition editor panes.
+func (mw *mainWindow) layoutOptions() engine.PartitionOptions {
+	opts := mw.partitionOptions()
+	if mw.partitions.Edited {
+		opts.Layout = mw.partitions.Layout
+	}
+	return opts
+}
+
+// showPartitionEditor fills in the partition editor pane as it is shown.
+// The layout is reset to the default if the disk or partitioning choices
+// on the settings pane have changed since it was made. LVM only changes
+// how the root partition is used, so is not one of them.
+func (mw *mainWindow) showPartitionEditor() {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	opts := mw.partitionOptions()
+	opts.LVM = nil
+	if key := fmt.Sprintf("%s %+v", d.Path, opts); key != mw.partitions.LayoutFor {
+		mw.partitions.LayoutFor = key
+		mw.resetLayout()
+	}
+	mw.refreshPartitions(-1)
+}
+
+// resetLayout replaces the layout being edited with the default layout
+// for the selected disk.
+func (mw *mainWindow) resetLayout() {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	mw.partitions.Layout = engine.DefaultLayout(&d, mw.partitionOptions())
+	mw.partitions.Edited = false
+}
+
+// refreshPartitions plans the layout, redrawing the partition bar &
+// table & selecting the partition at index selected in the layout (or
+// none, if negative). Next is enabled if the plan is valid.
+func (mw *mainWindow) refreshPartitions(selected int) {
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	opts := mw.partitionOptions()
+	opts.Layout = mw.partitions.Layout
+	plan := engine.NewPartitionPlan(&d, opts)
+	mw.partitions.Plan = plan
+	mw.partitions.Bar.QueueDraw()
+
+	mw.partitions.updating = true
+	defer func() { mw.partitions.updating = false }()
+	mw.partitions.Model.Clear()
+	mw.partitions.Rows = nil
+	addRow := func(layoutIdx int, vals ...interface{}) {
+		iter := mw.partitions.Model.Append()
+		mw.partitions.Model.Set(iter, []int{0, 1, 2, 3, 4, 5, 6}, vals)
+		mw.partitions.Rows = append(mw.partitions.Rows, layoutIdx)
+	}
+	yesNo := map[bool]string{true: "yes", false: ""}
+
+	// The new partitions follow the existing ones in the plan, in the
+	// order of the layout, unless it could not be planned.
+	var planned []*engine.PlannedPartition
+	for i := range plan.Partitions {
+		p := &plan.Partitions[i]
+		if p.Existing {
+			addRow(-1, strconv.Itoa(p.Num), p.Change(), engine.ByteCountDecimal(plan.Bytes(p.Sectors())), p.Filesystem, p.MountPoint, "", p.Label)
+		} else {
+			planned = append(planned, p)
+		}
+	}
+	if len(planned) != len(mw.partitions.Layout) {
+		planned = nil
+	}
+	selectedRow := -1
+	for i, c := range mw.partitions.Layout {
+		num, size := "?", engine.ByteCountDecimal(int64(c.SizeMB)*1024*1024)
+		if planned != nil {
+			num, size = strconv.Itoa(planned[i].Num), engine.ByteCountDecimal(plan.Bytes(planned[i].Sectors()))
+		} else if c.SizeMB <= 0 {
+			size = "remaining space"
+		}
+		if i == selected {
+			selectedRow = len(mw.partitions.Rows)
+		}
+		addRow(i, num, "New", size, c.Filesystem, c.MountPoint, yesNo[c.Encrypted], c.Label)
+	}
+
+	if selectedRow >= 0 {
+		if path, err := gtk.TreePathNewFromString(strconv.Itoa(selectedRow)); err == nil {
+			if sel, err := mw.partitions.Table.GetSelection(); err == nil {
+				sel.SelectPath(path)
+			}
+		}
+	}
+	mw.showPartitionProps(selected)
+
+	err := plan.Validate()
+	if err == nil && mw.preflight != nil {
+		err = mw.preflight.CheckPlan(&d, plan)
+	}
+	if err != nil {
+		mw.partitions.ErrLabel.SetText(err.Error())
+	} else {
+		mw.partitions.ErrLabel.SetText("")
+	}
+	if mw.currPane == panePartitions {
+		mw.nextBtn.SetSensitive(err == nil)
+	}
+}
+
+// selectedPartition returns the index in the layout of the partition
+// selected in the table, or -1 if none (or an existing partition) is.
+func (mw *mainWindow) selectedPartition() int {
+	sel, err := mw.partitions.Table.GetSelection()
+	if err != nil {
+		return -1
+	}
+	_, iter, ok := sel.GetSelected()
+	if !ok {
+		return -1
+	}
+	path, err := mw.partitions.Model.GetPath(iter)
+	if err != nil {
+		return -1
+	}
+	if row := path.GetIndices()[0]; row < len(mw.partitions.Rows) {
+		return mw.partitions.Rows[row]
+	}
+	return -1
+}
+
+// plannedMB returns the size the partition at index i in the layout was
+// allocated, or newPartitionMB if the layout could not be planned.
+func (mw *mainWindow) plannedMB(i int) int {
+	plan := mw.partitions.Plan
+	var n int
+	for j := range plan.Partitions {
+		if p := &plan.Partitions[j]; !p.Existing {
+			if n == i {
+				return int(plan.Bytes(p.Sectors()) / (1024 * 1024))
+			}
+			n++
+		}
+	}
+	return newPartitionMB
+}
+
+// showPartitionProps fills in the properties of the partition at index
+// i in the layout, which can only be edited if a new partition is
+// selected.
+func (mw *mainWindow) showPartitionProps(i int) {
+	updating := mw.partitions.updating
+	mw.partitions.updating = true
+	defer func() { mw.partitions.updating = updating }()
+
+	mw.partitions.PropsGrid.SetSensitive(i >= 0)
+	mw.partitions.DeleteBtn.SetSensitive(i >= 0)
+	if i < 0 {
+		return
+	}
+	c := mw.partitions.Layout[i]
+	d := getDisk(mw.settings.DiskCtrl.GetActiveText())
+	mw.partitions.SizeSpin.SetRange(1, float64(d.SizeBytes()/(1024*1024)))
+	if c.SizeMB > 0 {
+		mw.partitions.SizeSpin.SetValue(float64(c.SizeMB))
+	} else {
+		mw.partitions.SizeSpin.SetValue(float64(mw.plannedMB(i)))
+	}
+	mw.partitions.SizeSpin.SetSensitive(c.SizeMB > 0)
+	mw.partitions.FillCheck.SetActive(c.SizeMB <= 0)
+	mw.partitions.FsCombo.SetActiveID(c.Filesystem)
+	mw.partitions.MountEntry.SetText(c.MountPoint)
+	mw.partitions.LabelEntry.SetText(c.Label)
+	mw.partitions.EncryptCheck.SetActive(c.Encrypted)
+}
+
+// This callback is called when a different row of the partition table
+// is selected.
+func (mw *mainWindow) callbackPartitionSelected() {
+	if mw.partitions.updating {
+		return
+	}
+	mw.showPartitionProps(mw.selectedPartition())
+}
+
+// This callback is called when any property of the selected partition is
+// changed, updating the layout to match.
+func (mw *mainWindow) callbackPartitionEdited() {
+	i := mw.selectedPartition()
+	if mw.partitions.updating || i < 0 {
+		return
+	}
+	c := &mw.partitions.Layout[i]
+	fs := mw.partitions.FsCombo.GetActiveID()
+	mountPoint, _ := mw.partitions.MountEntry.GetText()
+	if fs != c.Filesystem || mountPoint != c.MountPoint {
+		// The name & description follow from the mount point.
+		c.Name, c.Desc = "", ""
+	}
+	c.Filesystem, c.MountPoint = fs, mountPoint
+	c.Label, _ = mw.partitions.LabelEntry.GetText()
+	c.Encrypted = mw.partitions.EncryptCheck.GetActive()
+
+	if mw.partitions.FillCheck.GetActive() {
+		// Only one partition can take the remaining space.
+		for j := range mw.partitions.Layout {
+			if j != i && mw.partitions.Layout[j].SizeMB <= 0 {
+				mw.partitions.Layout[j].SizeMB = mw.plannedMB(j)
+			}
+		}
+		c.SizeMB = 0
+	} else {
+		c.SizeMB = mw.partitions.SizeSpin.GetValueAsInt()
+	}
+	mw.partitions.Edited = true
+	mw.refreshPartitions(i)
+}
+
+// This callback is invoked when the add partition button is pressed,
+// adding an ext4 partition after the selected one.
+func (mw *mainWindow) callbackAddPartition() {
+	i := len(mw.partitions.Layout)
+	if sel := mw.selectedPartition(); sel >= 0 {
+		i = sel + 1
+	}
+	layout := append([]engine.CustomPartition{}, mw.partitions.Layout[:i]...)
+	layout = append(layout, engine.CustomPartition{SizeMB: newPartitionMB, Filesystem: "ext4"})
+	mw.partitions.Layout = append(layout, mw.partitions.Layout[i:]...)
+	mw.partitions.Edited = true
+	mw.refreshPartitions(i)
+}
+
+// This callback is invoked when the delete partition button is pressed.
+func (mw *mainWindow) callbackDeletePartition() {
+	i := mw.selectedPartition()
+	if i < 0 {
+		return
+	}
+	mw.partitions.Layout = append(mw.partitions.Layout[:i:i], mw.partitions.Layout[i+1:]...)
+	mw.partitions.Edited = true
+	mw.refreshPartitions(-1)
+}
+
+// This callback is invoked when the reset button is pressed, discarding
+// the changes to the default layout.
+func (mw *mainWindow) callbackResetPartitions() {
+	mw.resetLayout()
+	mw.refreshPartitions(-1)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"./engine"
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// checkSymbols mark the outcome of each preflight check.
+var checkSymbols = map[engine.CheckStatus]string{
+	engine.CheckPass: "✔",
+	engine.CheckWarn: "⚠",
+	engine.CheckFail: "✖",
+}
+
+// runPreflight starts checking the system meets the requirements for
+// installing to one of ds, showing the results on the intro pane once
+// done. It is called from the GTK main loop (or before it starts), & is
+// called again as disks are plugged in or removed; the results of all but
+// the latest run are dropped.
+func (mw *mainWindow) runPreflight(ds []engine.Disk) {
+	gen := atomic.AddInt64(&mw.preflightGen, 1)
+	// The checks are slow, so are run from their own goroutine.
+	go func() {
+		p := engine.RunPreflight(ds, *sourceImage, installUEFI(*bootMode))
+		glib.IdleAdd(func() {
+			if gen == atomic.LoadInt64(&mw.preflightGen) {
+				mw.showPreflight(p)
+			}
+		})
+	}()
+}
+
+// showPreflight lists the preflight results on the intro pane, replacing
+// any earlier results, & enables the next button unless a check failed.
+func (mw *mainWindow) showPreflight(p *engine.Preflight) {
+	mw.preflight = p
+	if mw.preflightPending != nil {
+		mw.preflightPending.Destroy()
+		mw.preflightPending = nil
+	}
+	for _, lab := range mw.preflightLabels {
+		lab.Destroy()
+	}
+	mw.preflightLabels = nil
+	for i, r := range p.Results {
+		for col, text := range []string{checkSymbols[r.Status], r.Name, r.Detail} {
+			lab, err := gtk.LabelNew(text)
+			if err != nil {
+				panic(err)
+			}
+			lab.SetXAlign(0)
+			if col == 0 {
+				sc, _ := lab.GetStyleContext()
+				sc.AddClass("check-" + r.Status.String())
+			}
+			if col == 2 {
+				lab.SetLineWrap(true)
+				lab.SetHExpand(true)
+			}
+			mw.preflightGrid.Attach(lab, col, i, 1, 1)
+			mw.preflightLabels = append(mw.preflightLabels, lab)
+		}
+	}
+	mw.preflightGrid.ShowAll()
+
+	if mw.currPane == paneIntro {
+		mw.nextBtn.SetSensitive(mw.preflightPassed())
+	}
+}
+
+// preflightPassed returns true once the preflight checks have finished
+// without failures.
+func (mw *mainWindow) preflightPassed() bool {
+	return mw.preflight != nil && !mw.preflight.Failed()
+}
@@ -8,7 +8,10 @@ import (
 	"unicode"
 )
 
-const tzBase = "/usr/share/zoneinfo"
+const (
+	tzBase          = "/usr/share/zoneinfo"
+	defaultTimezone = "America/Los_Angeles"
+)
 
 var timezones []string
 